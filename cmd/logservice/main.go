@@ -2,12 +2,12 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"go-distributed/log"
 	"go-distributed/registry"
 	"go-distributed/service"
 	"go-distributed/utils"
 	stlog "log"
+	"log/slog"
 	"os"
 )
 
@@ -24,7 +24,7 @@ func main() {
 		port = "80"
 	}
 
-	serviceAddress := fmt.Sprintf("http://%v:%v", host, port)
+	serviceAddress := registry.ServiceURL(host, port)
 
 	r := registry.Registration{
 		ServiceName:      registry.LogService,
@@ -33,11 +33,16 @@ func main() {
 		ServiceUpdateURL: serviceAddress + "/service",
 	}
 
-	ctx, err := service.Start(context.Background(), host, port, r, log.RegisterHandlers)
+	// SIGTERM shuts the service down
+	sigCtx, stop := service.SignalContext(context.Background())
+	defer stop()
+
+	ctx, err := service.Start(sigCtx, host, port, r, log.RegisterHandlers)
 	if err != nil {
 		stlog.Fatalln(err)
 	}
+	log.SetLocalLogger(r.ServiceName)
 	<-ctx.Done()
 
-	fmt.Println("Log service shut down")
+	slog.Info("Log service shut down")
 }
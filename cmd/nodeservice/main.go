@@ -2,17 +2,18 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"go-distributed/log"
 	"go-distributed/node"
 	"go-distributed/registry"
 	"go-distributed/service"
 	"go-distributed/utils"
 	stlog "log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
-
-	"math/rand"
 )
 
 /* node service will manage the xray core */
@@ -31,8 +32,8 @@ func main() {
 
 	node.RestoreFirewall()
 
-	serviceAddress := fmt.Sprintf("http://%v:%v", host, port)
-	fmt.Println("Service address: ", serviceAddress)
+	serviceAddress := registry.ServiceURL(host, port)
+	slog.Info("Service address", "url", serviceAddress)
 
 	publicIP, err := utils.GetPublicIP()
 	if err != nil {
@@ -44,6 +45,11 @@ func main() {
 		stlog.Println("Error getting public IPv6:", err6)
 	}
 
+	// the REALITY key of the node is generated on the first boot, unless REALITY_PRIKEY pins one
+	if _, err := node.ConfigXray(); err != nil {
+		stlog.Fatalln("Error writing the Xray config:", err)
+	}
+
 	connectivity := node.GetConnectivity()
 
 	tags := []string{}
@@ -53,90 +59,79 @@ func main() {
 		}
 	}
 
+	metadata := node.RealityMetadata()
+	metadata["protocols"] = strings.Join(node.Protocols(), ",")
+
 	r := registry.Registration{
 		ServiceName:      registry.NodeService,
 		ServiceURL:       serviceAddress,
 		PublicIP:         publicIP,
 		PublicIPv6:       publicIPv6,
 		Description:      os.Getenv("Node_Description"),
-		RequiredServices: []registry.ServiceName{registry.LogService, registry.WebService},
 		ServiceUpdateURL: serviceAddress + "/services",
 		Tags:             tags,
+		// the web service only asks for protocols the node offers, and gives clients its REALITY public key
+		Metadata: metadata,
+		// the registry takes the node out of rotation while Xray is down
+		HealthCheck: &registry.HealthCheck{Path: "/healthz"},
 	}
 
-	ctx, err := service.Start(context.Background(), "", port, r, node.RegisterHandlers)
-	if err != nil {
-		stlog.Fatalln(err)
-	}
-
-	var logProviders []registry.Registration
-
-	for {
-		logProviders, err = registry.GetProviders(registry.LogService)
+	// report load and traffic with every heartbeat
+	registry.CollectServerInfo = node.CollectServerInfo
 
-		if err != nil {
-			stlog.Println("Error getting log service:" + err.Error() + ". Retrying in 3 seconds")
-			time.Sleep(3 * time.Second)
-		} else {
-			break
-		}
-	}
-
-	fmt.Printf("Logging service found at %s\n", logProviders)
-	logProvider := logProviders[rand.Intn(len(logProviders))]
-	log.SetClientLogger(logProvider.ServiceURL, r.ServiceName)
-
-	// get config from web service
-	var WebProviders []registry.Registration
-	for {
-		WebProviders, err = registry.GetProviders(registry.WebService)
-
-		if err != nil {
-			stlog.Println("Error getting web service:" + err.Error() + ". Retrying in 3 seconds")
-			time.Sleep(3 * time.Second)
-		} else {
-			break
-		}
-	}
-
-	fmt.Printf("Web service found at %s\n", WebProviders)
+	// the service stops once the node is drained, or on SIGTERM
+	sigCtx, stopSignals := service.SignalContext(context.Background())
+	defer stopSignals()
+	drainCtx, stop := context.WithCancel(sigCtx)
+	go func() {
+		<-node.Drained()
+		stop()
+	}()
 
-	// WebProvider := WebProviders[0]
+	// SIGUSR1 drains the node, like POST /drain does, and so does a drain through the registry, e.g. regctl drain
+	registry.OnDrain = func() { node.Drain(node.DrainTimeout) }
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		<-signals
+		node.Drain(node.DrainTimeout)
+	}()
 
-	/*resp, err := http.Get(fmt.Sprintf("%s/realitykey", WebProvider))
+	ctx, err := service.Start(drainCtx, "", port, r, node.RegisterHandlers,
+		service.Dependency{Name: registry.LogService, Policy: service.Block},
+		service.Dependency{Name: registry.WebService, Policy: service.Block},
+	)
 	if err != nil {
-		stlog.Println("Error getting reality key from web service: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		stlog.Println("Error getting reality key from web service: %v", resp.Status)
+		stlog.Fatalln(err)
 	}
 
-	realitykey := make([]byte, 64)
-	_, err = resp.Body.Read(realitykey)
+	logProvider, done, err := registry.NewPicker(registry.LogService, registry.Random).Pick("")
 	if err != nil {
-		stlog.Println("Error reading reality key from web service: %v", err)
+		stlog.Fatalln("Error getting log service:", err)
 	}
+	done(nil)
 
-	stlog.Println("Reality key obtained from web service: ", string(realitykey))*/
-
-	go func() {
-		for range time.Tick(10 * time.Second) {
-			node.CheckTriffic()
+	log.SetClientLogger(logProvider.ServiceURL, r.ServiceName)
+	service.OnShutdown(log.Flush)
+	slog.Info("Logging service found", "url", logProvider.ServiceURL)
+
+	service.Go(drainCtx, func(ctx context.Context) {
+		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				node.CheckTriffic()
+			}
 		}
-	}()
+	})
 
-	node.StartTrafficReport()
+	node.StartTrafficReport(drainCtx)
 
-	REALITY_PRIKEY := os.Getenv("REALITY_PRIKEY")
-
-	utils.ConfigXray(string(REALITY_PRIKEY))
-
-	err = utils.LaunchXray()
-	if err != nil {
-		stlog.Fatalln("Error launching xray:", err)
-	}
-	fmt.Println("Xray launched")
+	node.SuperviseXray()
+	node.StartKeyRotation(drainCtx)
+	slog.Info("Xray launched")
 	<-ctx.Done()
 }
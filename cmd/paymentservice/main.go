@@ -2,7 +2,7 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"go-distributed/log"
 	"go-distributed/payment/db"
 	"go-distributed/payment/order"
 	"go-distributed/registry"
@@ -16,6 +16,10 @@ func init() {
 	utils.LoadEnv()
 	db.Connect()
 	db.Sync()
+	// the pending orders are restored once the database is connected
+	if err := order.RestoreStateFromDB(); err != nil {
+		stlog.Fatalln("Error restoring orders:", err)
+	}
 }
 
 func main() {
@@ -28,7 +32,7 @@ func main() {
 		port = "80"
 	}
 
-	serviceAddress := fmt.Sprintf("http://%v:%v", host, port)
+	serviceAddress := registry.ServiceURL(host, port)
 
 	r := registry.Registration{
 		ServiceName:      registry.PaymentService,
@@ -37,10 +41,16 @@ func main() {
 		ServiceUpdateURL: serviceAddress + "/services",
 	}
 
-	ctx, err := service.Start(context.Background(), "localhost", port, r, order.RegisterHandlers)
+	// SIGTERM shuts the service down
+	sigCtx, stop := service.SignalContext(context.Background())
+	defer stop()
+
+	ctx, err := service.Start(sigCtx, "localhost", port, r, order.RegisterHandlers)
 	if err != nil {
 		stlog.Fatalln(err)
 	}
+	log.SetLocalLogger(r.ServiceName)
+	order.StartTasks(sigCtx)
 
 	<-ctx.Done()
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go-distributed/registry"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/* regctl inspects and manages the registrations of regservice through its admin API */
+
+const usage = `Usage: regctl [flags] <command> [ServiceID]
+
+Commands:
+  list             list all registrations
+  evict <id>       remove a registration
+  drain <id>       mark a registration as draining
+  repush <id>      push the providers of its required services to a service again
+  regkey <name>    print the registration key of a service name, its services' regkey
+
+The admin key is read from Registry_AdminKey, the registry replicas from Registry_Endpoints.
+
+Flags:
+`
+
+func main() {
+	log.SetFlags(0)
+
+	key := flag.String("key", os.Getenv("Registry_AdminKey"), "admin key of the registry")
+	endpoints := flag.String("registry", "", "comma-separated registry replicas, overriding Registry_Endpoints")
+	asJSON := flag.Bool("json", false, "print the registrations as JSON")
+	service := flag.String("service", "", "only list registrations of this service name")
+	namespace := flag.String("namespace", "", "only list registrations of this namespace")
+	selector := flag.String("selector", "", "only list registrations matching this selector, e.g. region=eu,tag=netflix")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *endpoints != "" {
+		registry.SetEndpoints(strings.Split(*endpoints, ",")...)
+	}
+	if *key == "" {
+		log.Fatalln("No admin key, set Registry_AdminKey or -key")
+	}
+	admin := registry.Admin{Key: *key}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if args[0] == "list" {
+		statuses, err := admin.Services()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		sel, err := registry.ParseSelector(*selector)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if *service != "" || *namespace != "" || len(sel) > 0 {
+			filtered := statuses[:0]
+			for _, s := range statuses {
+				if (*service == "" || string(s.ServiceName) == *service) && (*namespace == "" || namespaceOf(s.Registration) == *namespace) && sel.Matches(s.Registration) {
+					filtered = append(filtered, s)
+				}
+			}
+			statuses = filtered
+		}
+
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(statuses); err != nil {
+				log.Fatalln(err)
+			}
+			return
+		}
+		printTable(statuses)
+		return
+	}
+
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	switch args[0] {
+	case "evict":
+		err = admin.Evict(args[1])
+	case "drain":
+		err = admin.Drain(args[1])
+	case "repush":
+		err = admin.Repush(args[1])
+	case "regkey":
+		key, err := admin.RegistrationKey(registry.ServiceName(args[1]))
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(key)
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	fmt.Println("OK")
+}
+
+func printTable(statuses []registry.ServiceStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tSERVICE\tID\tURL\tHEARTBEAT\tSTATE\tTAGS\tREQUIRES\tLAST PATCH\tLAST PROBE")
+	for _, s := range statuses {
+		state := string(s.Health)
+		if state == "" {
+			state = string(registry.Healthy)
+		}
+		if s.Draining {
+			state += ",draining"
+		}
+
+		requires := make([]string, len(s.RequiredServices))
+		for i, name := range s.RequiredServices {
+			requires[i] = string(name)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s ago\t%s\t%s\t%s\t%s\t%s\n",
+			namespaceOf(s.Registration),
+			s.ServiceName,
+			s.ServiceID,
+			s.ServiceURL,
+			(time.Duration(s.HeartbeatAgeSeconds) * time.Second).String(),
+			state,
+			orDash(strings.Join(s.Tags, ",")),
+			orDash(strings.Join(requires, ",")),
+			outcome(s.LastPatch),
+			outcome(s.LastProbe),
+		)
+	}
+	w.Flush()
+}
+
+func outcome(o *registry.Outcome) string {
+	if o == nil {
+		return "-"
+	}
+	ago := time.Since(o.Time).Round(time.Second)
+	if o.Error == "" {
+		return fmt.Sprintf("ok %s ago", ago)
+	}
+	return fmt.Sprintf("failed %dx, %s ago: %s", o.Failures, ago, o.Error)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// namespaceOf returns the namespace of r; registrations from before namespaces have none.
+func namespaceOf(r registry.Registration) string {
+	if r.Namespace == "" {
+		return registry.DefaultNamespace
+	}
+	return r.Namespace
+}
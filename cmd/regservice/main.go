@@ -2,36 +2,147 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"go-distributed/log"
 	"go-distributed/registry"
+	"go-distributed/registry/auth"
 	"go-distributed/registry/heartbeat"
+	"go-distributed/service"
 	"go-distributed/utils"
-	"log"
+	stlog "log"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
 	utils.LoadEnv()
+	log.SetLocalLogger("RegistryService")
+
+	// Registry_Store selects the storage backend ("file" or "memory"), Registry_DataDir where the file store lives
+	store, err := registry.OpenStore(os.Getenv("Registry_Store"), os.Getenv("Registry_DataDir"))
+	if err != nil {
+		stlog.Fatalln("Error opening registry store:", err)
+	}
+	defer store.Close()
+
+	// A replicated registry lists all replica URLs in Registry_Peers and this replica's own URL in Registry_Self
+	cluster := registry.ClusterConfig{
+		Self:    os.Getenv("Registry_Self"),
+		DataDir: os.Getenv("Registry_DataDir"),
+	}
+	if cluster.DataDir == "" {
+		cluster.DataDir = "regdata"
+	}
+	for _, peer := range strings.Split(os.Getenv("Registry_Peers"), ",") {
+		peer = strings.TrimSpace(peer)
+		if peer != "" && peer != cluster.Self {
+			cluster.Peers = append(cluster.Peers, peer)
+		}
+	}
+
+	// Registry_KeyFile holds the keys signing the service tokens, which all replicas must share.
+	// The file is reloaded when it changes, so keys are rotated by editing it. A standalone registry
+	// creates its key in Registry_DataDir, so the tokens of the registrations it keeps stay valid.
+	keyFile := os.Getenv("Registry_KeyFile")
+	if keyFile == "" && len(cluster.Peers) > 0 {
+		stlog.Fatalln("Registry_KeyFile is required to run a replicated registry")
+	}
+	if keyFile == "" {
+		keyFile = filepath.Join(cluster.DataDir, "signing.keys")
+	}
+	keyring, err := auth.LoadOrCreateKeyring(keyFile)
+	if err != nil {
+		stlog.Fatalln("Error loading signing keys:", err)
+	}
+	stopKeys := make(chan struct{})
+	defer close(stopKeys)
+	go keyring.Watch(30*time.Second, stopKeys)
 
 	HBServer := heartbeat.NewHeartBeatServer()
-	http.Handle("/heartbeat/", HBServer)
-	http.Handle("/services", registry.NewRegistryService(HBServer))
+	registryService, err := registry.NewRegistryService(HBServer, store, cluster)
+	if err != nil {
+		stlog.Fatalln("Error restoring registry:", err)
+	}
+	registryService.UseKeyring(keyring)
+	// Registry_AdminKey enables the admin API used by regctl
+	registryService.UseAdminKey(os.Getenv("Registry_AdminKey"))
+	http.Handle("/heartbeat/", registryService.LeaderOnly(HBServer))
+	http.Handle("/services", registryService)
+	http.Handle("/services/", registryService)
+	http.Handle("/metrics", promhttp.Handler())
+	if raft := registryService.Raft(); raft != nil {
+		http.Handle("/raft/", raft)
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	// SIGTERM shuts the registry down
+	ctx, cancel := service.SignalContext(context.Background())
 	defer cancel()
 
 	var srv http.Server
 	// srv.Addr = registry.ServerIP + ":" + registry.ServerPort
 	srv.Addr = ":" + registry.ServerPort
 
+	// Registry_CAKeyFile enables mutual TLS: the registry CA, created on first start, issues the
+	// certificates of all services. Services trust the CA certificate in Registry_CAFile. Replicas
+	// must share the CA, so a replicated registry never creates it and requires both files.
+	serve := srv.ListenAndServe
+	if caKeyFile := os.Getenv("Registry_CAKeyFile"); caKeyFile != "" {
+		caFile := os.Getenv("Registry_CAFile")
+		if len(cluster.Peers) > 0 {
+			if caFile == "" {
+				stlog.Fatalln("Registry_CAFile is required to run a replicated registry with mutual TLS")
+			}
+			for _, file := range []string{caFile, caKeyFile} {
+				if _, err := os.Stat(file); err != nil {
+					stlog.Fatalln("Error loading registry CA:", err)
+				}
+			}
+		}
+		if caFile == "" {
+			caFile = filepath.Join(cluster.DataDir, "ca.crt")
+		}
+		ca, err := auth.LoadOrCreateCA(caFile, caKeyFile)
+		if err != nil {
+			stlog.Fatalln("Error loading registry CA:", err)
+		}
+
+		// Registry_TLSHosts lists further names the registry is reached at, e.g. "registry.internal,10.0.0.1"
+		hosts := []string{"localhost", "127.0.0.1"}
+		if u, err := url.Parse(cluster.Self); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+		for _, host := range strings.Split(os.Getenv("Registry_TLSHosts"), ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+		srv.TLSConfig = registryService.UseCA(ca, hosts)
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+	}
+
 	go func() {
-		log.Println(srv.ListenAndServe())
+		if err := serve(); err != http.ErrServerClosed {
+			stlog.Println(err)
+		}
 		cancel()
 	}()
 
-	fmt.Println("Registry service is running on ", srv.Addr)
+	slog.Info("Registry service is running", "addr", srv.Addr)
 
 	<-ctx.Done()
 
-	fmt.Println("Shutting down registry service")
+	slog.Info("Shutting down registry service")
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), service.ShutdownTimeout())
+	defer cancelShutdown()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		stlog.Println(err)
+	}
+	// stop raft and the sweep before the store is closed
+	registryService.Close()
 }
@@ -2,16 +2,15 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"go-distributed/log"
 	"go-distributed/registry"
 	"go-distributed/service"
 	"go-distributed/shell"
 	"go-distributed/utils"
 	stlog "log"
+	"log/slog"
 	"os"
-
-	"math/rand"
+	"time"
 )
 
 /* shell service is mainly for testing registry client and other utils */
@@ -28,30 +27,36 @@ func main() {
 		port = "80"
 	}
 
-	serviceAddress := fmt.Sprintf("http://%v:%v", host, port)
+	serviceAddress := registry.ServiceURL(host, port)
 
 	r := registry.Registration{
 		ServiceName:      registry.ShellService,
 		ServiceURL:       serviceAddress,
-		RequiredServices: []registry.ServiceName{registry.LogService},
 		ServiceUpdateURL: serviceAddress + "/services",
 	}
 
-	ctx, err := service.Start(context.Background(), "", port, r, shell.RegisterHandlers)
+	// SIGTERM shuts the service down
+	sigCtx, stop := service.SignalContext(context.Background())
+	defer stop()
+
+	ctx, err := service.Start(sigCtx, "", port, r, shell.RegisterHandlers,
+		service.Dependency{Name: registry.LogService, Policy: service.Timeout, Timeout: 30 * time.Second},
+	)
 	if err != nil {
 		stlog.Fatalln(err)
 	}
 
-	logProviders, err := registry.GetProviders(registry.LogService)
+	// select a logger provider randomly
+	logProvider, done, err := registry.NewPicker(registry.LogService, registry.Random).Pick("")
 
 	if err != nil {
 		stlog.Fatalf("Error getting log service: %v", err)
 	}
+	done(nil)
 
-	fmt.Printf("Logging service found at %s\n", logProviders)
-	// select a logger provider randomly
-	logProvider := logProviders[rand.Intn(len(logProviders))]
 	log.SetClientLogger(logProvider.ServiceURL, r.ServiceName)
+	service.OnShutdown(log.Flush)
+	slog.Info("Logging service found", "url", logProvider.ServiceURL)
 
 	<-ctx.Done()
 }
@@ -2,16 +2,17 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"go-distributed/log"
 	"go-distributed/registry"
 	"go-distributed/service"
+	"go-distributed/tracing"
 	"go-distributed/utils"
 	"go-distributed/web/controllers"
 	"go-distributed/web/db"
 	"go-distributed/web/middleware"
 	stlog "log"
-	"math/rand"
+	"log/slog"
+	"net/http"
 	"os"
 	"time"
 
@@ -29,7 +30,7 @@ func CORSMiddleware() gin.HandlerFunc {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
 		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -55,7 +56,7 @@ func main() {
 		GINPORT = "8080"
 	}
 
-	serviceAddress := fmt.Sprintf("http://%v:%v", host, port)
+	serviceAddress := registry.ServiceURL(host, port)
 
 	publicIP, err := utils.GetPublicIP()
 
@@ -65,39 +66,46 @@ func main() {
 
 	reg := registry.Registration{
 		ServiceName:      registry.WebService,
-		ServiceURL:       fmt.Sprintf("http://%v:%v", host, GINPORT),
+		ServiceURL:       serviceAddress, // internal endpoints, the web API is served on GIN_PORT
 		PublicIP:         publicIP,
-		RequiredServices: []registry.ServiceName{registry.NodeService, registry.LogService, registry.PaymentService},
 		ServiceUpdateURL: serviceAddress + "/service",
 	}
 
-	_, err = service.Start(context.Background(), "", port, reg, log.RegisterHandlers)
-	if err != nil {
-		stlog.Fatalln(err)
+	// Web_NodeSelector narrows the nodes offered to users, e.g. "region=eu" for the nodes started with Registry_Metadata=region=eu
+	if selector := os.Getenv("Web_NodeSelector"); selector != "" {
+		controllers.Nodes = registry.NodeService.Where(selector)
 	}
 
-	var logProviders []registry.Registration
+	// SIGTERM shuts the service down
+	sigCtx, stop := service.SignalContext(context.Background())
+	defer stop()
 
-	for {
-		logProviders, err = registry.GetProviders(registry.LogService)
+	// the web service runs without nodes or payments, but not without logging
+	ctx, err := service.Start(sigCtx, "", port, reg, log.RegisterHandlers,
+		service.Dependency{Name: registry.LogService, Policy: service.Block},
+		service.Dependency{Name: controllers.Nodes, Policy: service.Degraded},
+		service.Dependency{Name: registry.PaymentService, Policy: service.Degraded},
+	)
+	if err != nil {
+		stlog.Fatalln(err)
+	}
 
-		if err != nil {
-			stlog.Println("Error getting log service:" + err.Error() + ". Retrying in 3 seconds")
-			time.Sleep(3 * time.Second)
-		} else {
-			break
-		}
+	logProvider, done, err := registry.NewPicker(registry.LogService, registry.Random).Pick("")
+	if err != nil {
+		stlog.Fatalln("Error getting log service:", err)
 	}
+	done(nil)
 
-	fmt.Printf("Logging service found at %s\n", logProviders)
-	logProvider := logProviders[rand.Intn(len(logProviders))]
 	log.SetClientLogger(logProvider.ServiceURL, reg.ServiceName)
+	service.OnShutdown(log.Flush)
+	slog.Info("Logging service found", "url", logProvider.ServiceURL)
 
-	controllers.StartHeartbeatMonitor()
-	controllers.StartPlanMonitor()
+	controllers.StartHeartbeatMonitor(sigCtx)
+	controllers.StartPlanMonitor(sigCtx)
 
 	r := gin.Default()
 	r.Use(CORSMiddleware())
+	r.Use(middleware.Metrics)
 
 	globalLimiter := middleware.NewRateLimiter(15, time.Minute) // 15 requests/min/IP
 	globalLimiter.StartCleanup(10 * time.Minute)
@@ -108,20 +116,40 @@ func main() {
 	r.GET("/user", globalLimiter.Middleware(), middleware.RequireAuth, controllers.User)
 	r.GET("/realitykey", globalLimiter.Middleware(), middleware.RequireAuth, controllers.Realitykey)
 	r.GET("/servers", globalLimiter.Middleware(), middleware.RequireAuth, controllers.Servers)
+	r.GET("/servers/recommended", globalLimiter.Middleware(), middleware.RequireAuth, controllers.RecommendedServers)
 	r.GET("/version", globalLimiter.Middleware(), controllers.Version)
 	r.POST("/connect", globalLimiter.Middleware(), middleware.RequireAuth, controllers.Connect)
 	r.POST("/subscribe", globalLimiter.Middleware(), middleware.RequireAuth, controllers.Subscribe)
 	r.POST("/redeem", globalLimiter.Middleware(), middleware.RequireAuth, controllers.Redeem)
 
+	// the subscription feed is fetched with its token instead of logging in
+	r.POST("/subscription/token", globalLimiter.Middleware(), middleware.RequireAuth, controllers.SubscriptionToken)
+	r.DELETE("/subscription/token", globalLimiter.Middleware(), middleware.RequireAuth, controllers.RevokeSubscription)
+	r.GET("/subscription/:token", globalLimiter.Middleware(), controllers.Subscription)
+
 	r.POST("/heartbeat", middleware.RequireAuth, controllers.HeartbeatFromClient)
-	r.POST("/traffic", controllers.AddTraffic)
+	r.POST("/traffic", middleware.RequireService(registry.NodeService), controllers.AddTraffic)
 
 	r.POST("/payment", globalLimiter.Middleware(), middleware.RequireAuth, controllers.Payment)
 	r.GET("/payment/status/:order_id", globalLimiter.Middleware(), middleware.RequireAuth, controllers.GetPaymentStatus)
 	r.GET("/payment/list", globalLimiter.Middleware(), middleware.RequireAuth, controllers.ListPayments)
-	r.POST("/payment/callback", middleware.AdminAuth, controllers.Callback)
+	r.POST("/payment/callback", middleware.RequireService(registry.PaymentService), controllers.Callback)
 	// Admin routes
 	r.POST("/admin/setplan", middleware.AdminAuth, controllers.SetPlan)
 	r.POST("/admin/generatevoucher", middleware.AdminAuth, controllers.GenerateVoucher)
-	r.Run()
+
+	// nodes and the payment service call these on the service port, over mutual TLS when enabled
+	http.Handle("/traffic", r)
+	http.Handle("/payment/callback", r)
+
+	// the web API drains with the service port when the service shuts down
+	api := &http.Server{Addr: ":" + GINPORT, Handler: tracing.Handler(r, "webservice api")}
+	service.OnShutdown(api.Shutdown)
+	go func() {
+		if err := api.ListenAndServe(); err != http.ErrServerClosed {
+			stlog.Fatalln(err)
+		}
+	}()
+
+	<-ctx.Done()
 }
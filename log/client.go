@@ -2,33 +2,148 @@ package log
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"go-distributed/registry"
-	"io"
-	stlog "log"
 	"net/http"
+	"os"
+	"sync"
+	"time"
 )
 
+var (
+	// BufferSize is how many log lines wait to be shipped at most. Lines logged while the buffer is
+	// full go to the fallback file.
+	BufferSize = 1024
+
+	// BatchSize is how many log lines are shipped in one request at most.
+	BatchSize = 100
+
+	// BatchInterval is how long a log line waits at most before it is shipped.
+	BatchInterval = time.Second
+)
+
+// SetClientLogger makes the service clientService ship its log records, as JSON lines, to the log
+// service at serviceURL. Records are shipped in batches in the background; lines that cannot be
+// shipped are appended to the file in Log_FallbackFile, <clientService>.log by default.
 func SetClientLogger(serviceURL string, clientService registry.ServiceName) {
-	stlog.SetPrefix(fmt.Sprintf("[%v] - ", clientService))
-	stlog.SetFlags(0)
-	stlog.SetOutput(&clientLogger{url: serviceURL})
+	fallback := os.Getenv("Log_FallbackFile")
+	if fallback == "" {
+		fallback = string(clientService) + ".log"
+	}
+	s := newShipper(serviceURL, fallback)
+	go s.run()
+
+	shipperMutex.Lock()
+	current = s
+	shipperMutex.Unlock()
+	setDefault(newHandler(s), clientService)
+}
+
+// Flush ships the log lines logged so far, or writes them to the fallback file, by the deadline of ctx.
+// Services flush their logs while shutting down.
+func Flush(ctx context.Context) error {
+	shipperMutex.Lock()
+	s := current
+	shipperMutex.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	done := make(chan struct{})
+	select {
+	case s.flush <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var (
+	current      *shipper
+	shipperMutex sync.Mutex
+)
+
+// shipper sends the lines written to it to the log service.
+type shipper struct {
+	url      string
+	lines    chan []byte
+	flush    chan chan struct{}
+	fallback fileLog
+}
+
+func newShipper(url, fallback string) *shipper {
+	return &shipper{
+		url:      url,
+		lines:    make(chan []byte, BufferSize),
+		flush:    make(chan chan struct{}),
+		fallback: fileLog(fallback),
+	}
+}
+
+// Write queues a line without waiting for it to be shipped.
+func (s *shipper) Write(data []byte) (int, error) {
+	line := bytes.Clone(data)
+	select {
+	case s.lines <- line:
+	default:
+		s.fallback.Write(line)
+	}
+	return len(data), nil
 }
 
-type clientLogger struct {
-	url string
+func (s *shipper) run() {
+	ticker := time.NewTicker(BatchInterval)
+	defer ticker.Stop()
+
+	var batch [][]byte
+	for {
+		select {
+		case line := <-s.lines:
+			batch = append(batch, line)
+			if len(batch) < BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case done := <-s.flush:
+			for len(s.lines) > 0 {
+				batch = append(batch, <-s.lines)
+			}
+			s.send(batch)
+			batch = nil
+			close(done)
+			continue
+		}
+		s.send(batch)
+		batch = nil
+	}
 }
 
-var _ io.Writer = (*clientLogger)(nil)
+// send ships batch in requests of BatchSize lines, writing the lines the log service did not take to the fallback file.
+func (s *shipper) send(batch [][]byte) {
+	for len(batch) > 0 {
+		n := min(len(batch), BatchSize)
+		body := bytes.Join(batch[:n], nil)
+		if err := s.post(body); err != nil {
+			s.fallback.Write(body)
+		}
+		batch = batch[n:]
+	}
+}
 
-func (cl clientLogger) Write(data []byte) (int, error) {
-	b := bytes.NewBuffer([]byte(data))
-	res, err := http.Post(cl.url+"/log", "text/plain", b)
+func (s *shipper) post(body []byte) error {
+	res, err := registry.HTTPClient().Post(s.url+"/log", "application/x-ndjson", bytes.NewReader(body))
 	if err != nil {
-		return 0, err
+		return err
 	}
+	res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("Failed to send log message. Service responed with code %v", res.StatusCode)
+		return fmt.Errorf("Failed to send log message. Service responed with code %v", res.StatusCode)
 	}
-	return len(data), nil
+	return nil
 }
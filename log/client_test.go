@@ -0,0 +1,88 @@
+package log
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	stlog "log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestClientLogger(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	BatchSize = 3
+	defer func() { BatchSize = 100 }()
+
+	var mutex sync.Mutex
+	var requests int
+	var received []map[string]any
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		requests++
+		body, _ := io.ReadAll(r.Body)
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			var record map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				t.Errorf("expected JSON lines, got %q", scanner.Text())
+			}
+			received = append(received, record)
+		}
+	}))
+	defer server.Close()
+
+	fallback := filepath.Join(t.TempDir(), "fallback.log")
+	t.Setenv("Log_FallbackFile", fallback)
+	t.Setenv("Log_Level", "warn")
+	SetClientLogger(server.URL, "TestService")
+
+	for i := 0; i < 7; i++ {
+		slog.Warn("User connected", User("123e4567"))
+	}
+	slog.Info("below the level")
+	stlog.Println("from the standard library logger")
+	if err := Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	if len(received) != 7 {
+		t.Fatalf("expected 7 records, got %d", len(received))
+	}
+	if requests < 3 {
+		t.Errorf("expected the records to be shipped in batches of 3, got %d requests", requests)
+	}
+	if r := received[0]; r[ServiceKey] != "TestService" || r[UserKey] != "123e4567" || r["level"] != "WARN" {
+		t.Errorf("expected the service and user fields, got %v", r)
+	}
+	failing = true
+	mutex.Unlock()
+
+	// lines the log service does not take end up in the fallback file
+	slog.Error("Order failed", Order("42"))
+	if err := Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"order_id":"42"`) {
+		t.Errorf("expected the record in the fallback file, got %s", data)
+	}
+}
@@ -0,0 +1,87 @@
+package log
+
+import (
+	"context"
+	"go-distributed/registry"
+	"go-distributed/tracing"
+	"io"
+	stlog "log"
+	"log/slog"
+	"os"
+)
+
+// Services log through log/slog. The standard library logger writes to the same handler at level
+// info, so code still using it is logged too. Records carry the service and its ServiceID; these
+// keys name the fields records about users and orders should carry, e.g.
+//
+//	slog.Info("User connected", log.User(uuid), "port", port)
+//
+// Records logged with a context of a trace, e.g. slog.InfoContext(r.Context(), ...), carry its ID.
+const (
+	ServiceKey   = "service"
+	ServiceIDKey = "service_id"
+	UserKey      = "user"
+	OrderKey     = "order_id"
+	TraceKey     = "trace_id"
+)
+
+// User returns the field of the user with UUID uuid.
+func User(uuid string) slog.Attr {
+	return slog.String(UserKey, uuid)
+}
+
+// Order returns the field of the order with ID id.
+func Order(id string) slog.Attr {
+	return slog.String(OrderKey, id)
+}
+
+// Level returns the lowest level logged, set with Log_Level to debug, info, warn or error. Info by default.
+func Level() slog.Level {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("Log_Level"))); err != nil {
+		return slog.LevelInfo
+	}
+	return level
+}
+
+// SetLocalLogger makes services that do not ship their logs, e.g. the registry and the log service
+// itself, log records of service to standard error.
+func SetLocalLogger(service registry.ServiceName) {
+	setDefault(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: Level()}), service)
+}
+
+// setDefault makes h, with the fields of service, the handler of the default and the standard library logger.
+func setDefault(h slog.Handler, service registry.ServiceName) {
+	attrs := []slog.Attr{slog.String(ServiceKey, string(service))}
+	if id := registry.ServiceID(); id != "" {
+		attrs = append(attrs, slog.String(ServiceIDKey, id))
+	}
+	stlog.SetPrefix("")
+	stlog.SetFlags(0)
+	slog.SetDefault(slog.New(traceHandler{h.WithAttrs(attrs)}))
+}
+
+// traceHandler adds the ID of the trace of the context a record is logged with.
+type traceHandler struct {
+	slog.Handler
+}
+
+func (h traceHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := tracing.TraceID(ctx); id != "" {
+		r.AddAttrs(slog.String(TraceKey, id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h traceHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return traceHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h traceHandler) WithGroup(name string) slog.Handler {
+	return traceHandler{h.Handler.WithGroup(name)}
+}
+
+// newHandler returns the handler writing records as JSON lines to w.
+func newHandler(w io.Writer) slog.Handler {
+	return slog.NewJSONHandler(w, &slog.HandlerOptions{Level: Level()})
+}
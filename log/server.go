@@ -1,6 +1,7 @@
 package log
 
 import (
+	"bytes"
 	"io"
 	stlog "log"
 	"net/http"
@@ -20,8 +21,9 @@ func (fl fileLog) Write(data []byte) (int, error) {
 	return f.Write(data)
 }
 
+// Run makes the log service append the log lines it receives to the file destination.
 func Run(destination string) {
-	log = stlog.New(fileLog(destination), "[distributed-xray] - ", stlog.LstdFlags)
+	log = stlog.New(fileLog(destination), "", 0)
 }
 
 func RegisterHandlers() {
@@ -33,13 +35,18 @@ func RegisterHandlers() {
 				w.WriteHeader(http.StatusBadRequest)
 				return
 			}
-			write(string(msg))
+			write(msg)
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
 	})
 }
 
-func write(message string) {
-	log.Printf("%v\n", message)
+// write appends the lines of a batch, each a JSON record.
+func write(batch []byte) {
+	for _, line := range bytes.Split(batch, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) > 0 {
+			log.Printf("%s\n", line)
+		}
+	}
 }
@@ -0,0 +1,89 @@
+package node
+
+import (
+	"go-distributed/registry"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DrainTimeout is how long a drain waits for users to disconnect unless told otherwise.
+var DrainTimeout = 30 * time.Minute
+
+var (
+	draining  atomic.Bool
+	drained   = make(chan struct{})
+	drainOnce sync.Once
+)
+
+// Drain takes the node out of rotation. The registry lists it as draining, so the web service
+// assigns no new users to it, and the proxies of connected users keep running until the users
+// disconnect or timeout passes. Drained is closed afterwards.
+func Drain(timeout time.Duration) {
+	drainOnce.Do(func() {
+		draining.Store(true)
+		slog.Info("Draining node, waiting for users to disconnect", "timeout", timeout)
+
+		if err := registry.Drain(); err != nil {
+			slog.Error("Failed to mark node as draining", "error", err)
+		}
+
+		go func() {
+			deadline := time.Now().Add(timeout)
+			for activeConnections() > 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Second)
+			}
+
+			connectionsLock.Lock()
+			if len(proxyServices) > 0 {
+				slog.Warn("Drain deadline passed, closing proxies", "proxies", len(proxyServices))
+			}
+			for uuid, svc := range proxyServices {
+				svc.cancelFunc()
+				statsStore.Delete(connections[uuid])
+				delete(proxyServices, uuid)
+				delete(connections, uuid)
+				delete(users, uuid)
+			}
+			connectionsLock.Unlock()
+
+			slog.Info("Node drained")
+			close(drained)
+		}()
+	})
+}
+
+// Drained is closed once a drain has finished.
+func Drained() <-chan struct{} {
+	return drained
+}
+
+func activeConnections() int {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	return len(connections)
+}
+
+// handleDrain starts a drain on a request of the web service, e.g. POST /drain?timeout=30m
+func (sh *nodeHandler) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if _, err := registry.Verify(r, registry.WebService); err != nil {
+		slog.WarnContext(r.Context(), "Rejected drain request", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	timeout := DrainTimeout
+	if t := r.URL.Query().Get("timeout"); t != "" {
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+
+	Drain(timeout)
+	w.WriteHeader(http.StatusAccepted)
+}
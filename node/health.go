@@ -0,0 +1,48 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	statsService "github.com/xtls/xray-core/app/stats/command"
+)
+
+// checkXray returns an error if Xray is not running, e.g. while the supervisor waits to restart it,
+// or its API does not answer.
+func checkXray(ctx context.Context) error {
+	xray.mutex.Lock()
+	launched, running, exitErr, restarts := xray.launched, xray.running, xray.exitErr, xray.restarts
+	xray.mutex.Unlock()
+
+	if !launched {
+		return fmt.Errorf("xray not launched yet")
+	}
+	if !running {
+		return fmt.Errorf("xray exited: %v (restarted %d times)", exitErr, restarts)
+	}
+
+	ctl := new(XrayController)
+	if err := ctl.Init(cfg); err != nil {
+		return err
+	}
+	defer ctl.CmdConn.Close()
+
+	if _, err := ctl.SsClient.GetSysStats(ctx, &statsService.SysStatsRequest{}); err != nil {
+		return fmt.Errorf("xray API unreachable: %v", err)
+	}
+	return nil
+}
+
+// handleHealth serves the health check of the registry: the node is healthy while Xray runs and its API answers.
+func (sh *nodeHandler) handleHealth(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+
+	if err := checkXray(ctx); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,131 @@
+package node
+
+import (
+	"context"
+	"go-distributed/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeXray writes a shell script standing in for the Xray binary and points XRAY_PATH at it.
+func fakeXray(t *testing.T, script string) string {
+	t.Helper()
+	t.Setenv("XRAY_PATH", filepath.Join(t.TempDir(), "xray"))
+	path := utils.XrayPath()
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHealthXrayExited(t *testing.T) {
+	defer func(backoff time.Duration) { MinRestartBackoff = backoff }(MinRestartBackoff)
+	MinRestartBackoff = time.Hour
+
+	path := fakeXray(t, `echo "[Error] failed to start"; exit 1`)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		superviseXray(ctx, path)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := httptest.NewRecorder()
+		new(nodeHandler).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		if rec.Code == http.StatusServiceUnavailable && strings.Contains(rec.Body.String(), "xray exited") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the node to be unhealthy once Xray exited, got %v %q", rec.Code, rec.Body.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSupervisorRestartsXray(t *testing.T) {
+	defer func(backoff time.Duration, restore func(context.Context) error) {
+		MinRestartBackoff, restoreUsers = backoff, restore
+	}(MinRestartBackoff, restoreUsers)
+	MinRestartBackoff = 10 * time.Millisecond
+
+	var restores atomic.Int32
+	restoreUsers = func(ctx context.Context) error {
+		restores.Add(1)
+		return nil
+	}
+
+	xray.mutex.Lock()
+	before := xray.restarts
+	xray.mutex.Unlock()
+
+	// the fake exits at once, so it is restarted, and the connected users are added again every time
+	path := fakeXray(t, `echo "started"; exit 3`)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		superviseXray(ctx, path)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		xray.mutex.Lock()
+		restarts, exitErr := xray.restarts-before, xray.exitErr
+		xray.mutex.Unlock()
+		if restarts >= 3 && restores.Load() >= 2 {
+			if exitErr != nil && !strings.Contains(exitErr.Error(), "exit status 3") {
+				t.Errorf("expected the exit status of Xray, got %v", exitErr)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected Xray to be restarted, got %d restarts and %d restores", restarts, restores.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func TestSupervisorStopsXray(t *testing.T) {
+	path := fakeXray(t, `trap 'exit 0' TERM; while true; do sleep 0.05; done`)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		superviseXray(ctx, path)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		xray.mutex.Lock()
+		running := xray.running
+		xray.mutex.Unlock()
+		if running {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected Xray to run")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(StopTimeout):
+		t.Fatal("expected Xray to stop on SIGTERM")
+	}
+}
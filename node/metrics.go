@@ -0,0 +1,67 @@
+package node
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// node_active_proxies: proxies this node runs for connected users.
+	activeProxiesDesc = prometheus.NewDesc("node_active_proxies", "Proxies running for connected users.", nil, nil)
+
+	// node_user_bytes_total{user, direction}: bytes proxied for a connected user, by the UUID of the
+	// user and direction "up" (from the user) or "down" (to the user). The counters of a user are
+	// dropped when the user disconnects.
+	userBytesDesc = prometheus.NewDesc("node_user_bytes_total", "Bytes proxied for a connected user.", []string{"user", "direction"}, nil)
+
+	// node_xray_up: 1 while the Xray process runs, 0 while the supervisor waits to restart it.
+	xrayUpDesc = prometheus.NewDesc("node_xray_up", "Whether the Xray process runs.", nil, nil)
+
+	// node_xray_restarts_total: exits of the Xray process, each followed by a restart.
+	xrayRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "node_xray_restarts_total",
+		Help: "Exits of the Xray process the supervisor restarted.",
+	})
+)
+
+// proxyCollector reads the proxies and their traffic from the node state at scrape time.
+type proxyCollector struct{}
+
+func (proxyCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- activeProxiesDesc
+	ch <- userBytesDesc
+	ch <- xrayUpDesc
+}
+
+func (proxyCollector) Collect(ch chan<- prometheus.Metric) {
+	connectionsLock.Lock()
+	proxies := len(proxyServices)
+	ports := make(map[string]int, len(connections))
+	for uuid, port := range connections {
+		ports[uuid] = port
+	}
+	connectionsLock.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(activeProxiesDesc, prometheus.GaugeValue, float64(proxies))
+
+	xray.mutex.Lock()
+	up := 0.0
+	if xray.running {
+		up = 1
+	}
+	xray.mutex.Unlock()
+	ch <- prometheus.MustNewConstMetric(xrayUpDesc, prometheus.GaugeValue, up)
+	for uuid, port := range ports {
+		val, ok := statsStore.Load(port)
+		if !ok {
+			continue
+		}
+		stats := val.(*ConnStats)
+		ch <- prometheus.MustNewConstMetric(userBytesDesc, prometheus.CounterValue, float64(stats.Uploaded), uuid, "up")
+		ch <- prometheus.MustNewConstMetric(userBytesDesc, prometheus.CounterValue, float64(stats.Downloaded), uuid, "down")
+	}
+}
+
+func init() {
+	prometheus.MustRegister(proxyCollector{})
+}
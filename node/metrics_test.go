@@ -0,0 +1,36 @@
+package node
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestProxyMetrics(t *testing.T) {
+	connectionsLock.Lock()
+	connections["user-1"] = 20001
+	proxyServices["user-1"] = &ProxyService{cancelFunc: func() {}}
+	connectionsLock.Unlock()
+	statsStore.Store(20001, &ConnStats{Uploaded: 100, Downloaded: 2500})
+	defer func() {
+		connectionsLock.Lock()
+		delete(connections, "user-1")
+		delete(proxyServices, "user-1")
+		connectionsLock.Unlock()
+		statsStore.Delete(20001)
+	}()
+
+	expected := `
+# HELP node_active_proxies Proxies running for connected users.
+# TYPE node_active_proxies gauge
+node_active_proxies 1
+# HELP node_user_bytes_total Bytes proxied for a connected user.
+# TYPE node_user_bytes_total counter
+node_user_bytes_total{direction="down",user="user-1"} 2500
+node_user_bytes_total{direction="up",user="user-1"} 100
+`
+	if err := testutil.CollectAndCompare(proxyCollector{}, strings.NewReader(expected), "node_active_proxies", "node_user_bytes_total"); err != nil {
+		t.Error(err)
+	}
+}
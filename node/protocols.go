@@ -0,0 +1,209 @@
+package node
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"go-distributed/utils"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xtls/xray-core/app/proxyman/command"
+	"github.com/xtls/xray-core/common/protocol"
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/proxy/shadowsocks_2022"
+	"github.com/xtls/xray-core/proxy/trojan"
+	"github.com/xtls/xray-core/proxy/vless"
+	"github.com/xtls/xray-core/proxy/vmess"
+)
+
+// Protocol is a protocol users connect to Xray with, the protocol of an inbound in the Xray config.
+type Protocol string
+
+const (
+	VLESS       Protocol = "vless"
+	Trojan      Protocol = "trojan"
+	VMess       Protocol = "vmess"
+	Shadowsocks Protocol = "shadowsocks"
+)
+
+// inbound is an inbound of Xray users are added to.
+type inbound struct {
+	Tag     string
+	Address string            // the address the proxies of users forward to
+	Params  map[string]string // the connection parameters all users of the inbound share, e.g. the SNI
+}
+
+// inbounds are the inbounds users connect to, by protocol. Until UseInbounds is called, users connect
+// with VLESS to the inbound on localhost:443.
+var (
+	inbounds = map[Protocol]inbound{
+		VLESS: {Tag: utils.XrayInboundTag, Address: "localhost:443", Params: map[string]string{"flow": "xtls-rprx-vision"}},
+	}
+	inboundsLock sync.RWMutex
+)
+
+// UseInbounds makes new users connect to the inbounds of cfg, the Xray config written by utils.ConfigXray.
+// Of the inbounds of a protocol, the first is used, the one with the current REALITY key.
+func UseInbounds(cfg utils.XrayConfig) {
+	found := map[Protocol]inbound{}
+	for _, in := range cfg.Inbounds {
+		p := Protocol(in.Protocol)
+		switch p {
+		case VLESS, Trojan, VMess, Shadowsocks:
+		default:
+			continue
+		}
+		if _, ok := found[p]; ok {
+			continue
+		}
+
+		host := in.Listen
+		if host == "" || host == "0.0.0.0" || host == "::" {
+			host = "localhost"
+		}
+		params := map[string]string{}
+		if s := in.StreamSettings; s != nil && s.RealitySettings != nil {
+			params["security"] = "reality"
+			params["sni"] = s.RealitySettings.ServerNames[0]
+			params["sid"] = s.RealitySettings.ShortIDs[0]
+			if public, err := utils.XrayPublicKey(s.RealitySettings.PrivateKey); err == nil {
+				params["pubkey"] = public
+			}
+		}
+		switch p {
+		case VLESS:
+			params["flow"] = "xtls-rprx-vision"
+		case VMess:
+			params["encryption"] = "auto"
+		case Shadowsocks:
+			if settings, ok := in.Settings.(utils.XrayShadowsocksSettings); ok {
+				params["method"] = settings.Method
+				params["serverkey"] = settings.Password
+			}
+		}
+		found[p] = inbound{Tag: in.Tag, Address: net.JoinHostPort(host, strconv.Itoa(in.Port)), Params: params}
+	}
+	inboundsLock.Lock()
+	inbounds = found
+	inboundsLock.Unlock()
+}
+
+// inboundOf returns the inbound new users of p connect to.
+func inboundOf(p Protocol) (inbound, bool) {
+	inboundsLock.RLock()
+	defer inboundsLock.RUnlock()
+	in, ok := inbounds[p]
+	return in, ok
+}
+
+// Protocols returns the protocols users can connect with, sorted.
+func Protocols() []string {
+	inboundsLock.RLock()
+	defer inboundsLock.RUnlock()
+	var protocols []string
+	for p := range inbounds {
+		protocols = append(protocols, string(p))
+	}
+	sort.Strings(protocols)
+	return protocols
+}
+
+// newUser returns the user with uuid and email to add to in, the inbound of p. Trojan users connect
+// with their UUID as password, Shadowsocks users with the 16 bytes of their UUID as key.
+func newUser(uuid, email string, p Protocol, in inbound) (*UserInfo, error) {
+	user := &UserInfo{
+		Uuid:     uuid,
+		Level:    0,
+		InTag:    in.Tag,
+		Email:    email,
+		Protocol: p,
+	}
+	switch p {
+	case Trojan:
+		user.Password = uuid
+	case Shadowsocks:
+		key, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", ""))
+		if err != nil || len(key) != 16 {
+			return nil, fmt.Errorf("invalid uuid %q", uuid)
+		}
+		user.CipherType = utils.XrayShadowsocksMethod
+		user.Password = base64.StdEncoding.EncodeToString(key)
+	}
+	return user, nil
+}
+
+// account returns the Xray account of user, for the protocol of the inbound it is added to.
+func account(user *UserInfo) (*serial.TypedMessage, error) {
+	switch user.Protocol {
+	case VLESS, "":
+		return serial.ToTypedMessage(&vless.Account{
+			Id:         user.Uuid,
+			Flow:       "xtls-rprx-vision",
+			Encryption: "none",
+		}), nil
+	case Trojan:
+		return serial.ToTypedMessage(&trojan.Account{Password: user.Password}), nil
+	case VMess:
+		return serial.ToTypedMessage(&vmess.Account{
+			Id:               user.Uuid,
+			SecuritySettings: &protocol.SecurityConfig{Type: protocol.SecurityType_AUTO},
+		}), nil
+	case Shadowsocks:
+		return serial.ToTypedMessage(&shadowsocks_2022.Account{Key: user.Password}), nil
+	}
+	return nil, fmt.Errorf("unknown protocol %q", user.Protocol)
+}
+
+// addUser adds user to its inbound of Xray.
+func addUser(ctx context.Context, client command.HandlerServiceClient, user *UserInfo) error {
+	acc, err := account(user)
+	if err != nil {
+		return err
+	}
+	_, err = client.AlterInbound(ctx, &command.AlterInboundRequest{
+		Tag: user.InTag,
+		Operation: serial.ToTypedMessage(&command.AddUserOperation{
+			User: &protocol.User{
+				Level:   user.Level,
+				Email:   user.Email,
+				Account: acc,
+			},
+		}),
+	})
+	return err
+}
+
+// removeUser removes user from its inbound of Xray.
+func removeUser(ctx context.Context, client command.HandlerServiceClient, user *UserInfo) error {
+	_, err := client.AlterInbound(ctx, &command.AlterInboundRequest{
+		Tag: user.InTag,
+		Operation: serial.ToTypedMessage(&command.RemoveUserOperation{
+			Email: user.Email,
+		}),
+	})
+	return err
+}
+
+// connectParams returns what the client of user needs to connect to in, its inbound, besides the port
+// of its proxy: the protocol, the parameters of the inbound, e.g. the REALITY public key, and its
+// password, if any.
+func connectParams(user *UserInfo, in inbound) map[string]string {
+	params := map[string]string{"protocol": string(user.Protocol)}
+	for k, v := range in.Params {
+		if k != "serverkey" {
+			params[k] = v
+		}
+	}
+	switch user.Protocol {
+	case Trojan:
+		params["password"] = user.Password
+	case Shadowsocks:
+		params["password"] = in.Params["serverkey"] + ":" + user.Password
+	}
+	return params
+}
@@ -0,0 +1,92 @@
+package node
+
+import (
+	"go-distributed/utils"
+	"strings"
+	"testing"
+
+	"github.com/xtls/xray-core/common/serial"
+	"github.com/xtls/xray-core/proxy/shadowsocks_2022"
+	"github.com/xtls/xray-core/proxy/trojan"
+	"github.com/xtls/xray-core/proxy/vmess"
+)
+
+func TestProtocols(t *testing.T) {
+	defer func(old map[Protocol]inbound) { inbounds = old }(inbounds)
+
+	opts := utils.DefaultXrayOptions()
+	opts.PrivateKey = "mNoGzlLbIVdKM0ZJY4sVZ8IOnFhwhdpcIYWBDQ_xQiw"
+	opts.ServerNames = []string{"www.microsoft.com"}
+	opts.Listen = "0.0.0.0"
+	opts.Protocols = []string{"vless", "trojan", "vmess", "shadowsocks"}
+	opts.ShadowsocksKey = "l8FMqp0EGA0NnGbdsD3j8A=="
+	cfg, err := utils.BuildXrayConfig(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	UseInbounds(cfg)
+
+	if got := strings.Join(Protocols(), ","); got != "shadowsocks,trojan,vless,vmess" {
+		t.Errorf("expected every protocol, got %s", got)
+	}
+	if in := inbounds[Trojan]; in.Tag != utils.XrayTrojanTag || in.Address != "localhost:444" {
+		t.Errorf("expected the Trojan inbound on the next port, got %+v", in)
+	}
+
+	const uuid = "123e4567-e89b-12d3-a456-426614174000"
+	for _, test := range []struct {
+		protocol Protocol
+		params   map[string]string
+	}{
+		{VLESS, map[string]string{"security": "reality", "sni": "www.microsoft.com", "flow": "xtls-rprx-vision"}},
+		{Trojan, map[string]string{"security": "reality", "password": uuid}},
+		{VMess, map[string]string{"encryption": "auto"}},
+		{Shadowsocks, map[string]string{"method": utils.XrayShadowsocksMethod, "password": "l8FMqp0EGA0NnGbdsD3j8A==:Ej5FZ+ibEtOkVkJmFBdAAA=="}},
+	} {
+		user, err := newUser(uuid, "user@example.com", test.protocol, inbounds[test.protocol])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.InTag != inbounds[test.protocol].Tag {
+			t.Errorf("%s: expected the user on the inbound of the protocol, got %s", test.protocol, user.InTag)
+		}
+		if _, err := account(user); err != nil {
+			t.Errorf("%s: %v", test.protocol, err)
+		}
+
+		params := connectParams(user, inbounds[test.protocol])
+		if params["protocol"] != string(test.protocol) {
+			t.Errorf("%s: expected the protocol in the parameters, got %v", test.protocol, params)
+		}
+		for k, v := range test.params {
+			if params[k] != v {
+				t.Errorf("%s: expected %s=%s, got %v", test.protocol, k, v, params)
+			}
+		}
+		if _, ok := params["serverkey"]; ok {
+			t.Errorf("%s: expected the server key to stay on the node, got %v", test.protocol, params)
+		}
+	}
+
+	// the accounts Xray gets match the protocols
+	user, _ := newUser(uuid, "user@example.com", Trojan, inbounds[Trojan])
+	if acc, _ := account(user); acc.Type != serial.GetMessageType(&trojan.Account{}) {
+		t.Errorf("expected a Trojan account, got %s", acc.Type)
+	}
+	user, _ = newUser(uuid, "user@example.com", VMess, inbounds[VMess])
+	if acc, _ := account(user); acc.Type != serial.GetMessageType(&vmess.Account{}) {
+		t.Errorf("expected a VMess account, got %s", acc.Type)
+	}
+	user, _ = newUser(uuid, "user@example.com", Shadowsocks, inbounds[Shadowsocks])
+	if acc, _ := account(user); acc.Type != serial.GetMessageType(&shadowsocks_2022.Account{}) {
+		t.Errorf("expected a Shadowsocks account, got %s", acc.Type)
+	}
+
+	if _, err := newUser("not-a-uuid", "user@example.com", Shadowsocks, inbounds[Shadowsocks]); err == nil {
+		t.Error("expected a Shadowsocks user to need a valid uuid")
+	}
+	UseInbounds(utils.XrayConfig{})
+	if _, ok := inboundOf(VLESS); ok {
+		t.Error("expected protocols the node does not offer to be rejected")
+	}
+}
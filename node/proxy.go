@@ -70,7 +70,9 @@ func handleConnection(conn net.Conn, dst string, upLim, downLim *rate.Limiter, s
 	io.Copy(targetConn, limitReader(conn, upLim, &stats.Uploaded))
 }
 
-func NewProxy(ctx context.Context, port int, sourceIP string, rateLimit int, burst int, statsStore *StatsStore) error {
+// NewProxy forwards the connections of sourceIP to port to target, the inbound of Xray the user connects to,
+// until ctx is done.
+func NewProxy(ctx context.Context, port int, target string, sourceIP string, rateLimit int, burst int, statsStore *StatsStore) error {
 	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
 	if err != nil {
 		return err
@@ -99,6 +101,6 @@ func NewProxy(ctx context.Context, port int, sourceIP string, rateLimit int, bur
 			conn.Close()
 			continue
 		}
-		go handleConnection(conn, "localhost:443", upLim, downLim, statsStore)
+		go handleConnection(conn, target, upLim, downLim, statsStore)
 	}
 }
@@ -0,0 +1,410 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-distributed/log"
+	"go-distributed/registry"
+	"go-distributed/service"
+	"go-distributed/utils"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/app/proxyman/command"
+)
+
+var (
+	// KeyRotation is how long the node serves a REALITY key before it rotates to a new one, set with
+	// Xray_KeyRotation, e.g. 720h; zero disables rotation.
+	KeyRotation = 30 * 24 * time.Hour
+
+	// KeyOverlap is how long the previous key is still accepted after a rotation, set with Xray_KeyOverlap.
+	// Users connected with it keep their connection until then.
+	KeyOverlap = 24 * time.Hour
+)
+
+// RealityKey is a REALITY key of the node.
+type RealityKey struct {
+	utils.XrayKey
+	PublicKey string    `json:"publicKey"`
+	Slot      int       `json:"slot"` // the set of REALITY inbounds serving the key, see utils.XrayOptions
+	Created   time.Time `json:"created"`
+}
+
+// RealityKeys are the REALITY keys of the node, persisted in the key file so they survive restarts.
+type RealityKeys struct {
+	Current  RealityKey  `json:"current"`
+	Previous *RealityKey `json:"previous,omitempty"` // accepted until KeyOverlap after Current was created
+}
+
+// reality is the state of the REALITY keys of the node. shared is set when REALITY_PRIKEY pins a
+// key, which is then neither persisted nor rotated.
+var reality struct {
+	keys    RealityKeys
+	shared  bool
+	running map[string]bool // the tags of the inbounds Xray runs
+	mutex   sync.Mutex
+}
+
+// handlerClient connects to the HandlerService of Xray, which the inbounds of keys are added to and
+// removed from. It returns the client and a function closing it.
+var handlerClient = func() (command.HandlerServiceClient, func(), error) {
+	ctl := new(XrayController)
+	if err := ctl.Init(cfg); err != nil {
+		return nil, nil, err
+	}
+	return ctl.HsClient, func() { ctl.CmdConn.Close() }, nil
+}
+
+func init() {
+	if d, err := time.ParseDuration(os.Getenv("Xray_KeyRotation")); err == nil {
+		KeyRotation = d
+	}
+	if d, err := time.ParseDuration(os.Getenv("Xray_KeyOverlap")); err == nil {
+		KeyOverlap = d
+	}
+}
+
+// keyFile returns where the REALITY keys of the node are kept: Xray_KeyFile, or reality.json next to
+// the Xray config.
+func keyFile() string {
+	if path := os.Getenv("Xray_KeyFile"); path != "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(utils.XrayConfigPath()), "reality.json")
+}
+
+// newRealityKey generates a key to serve on slot.
+func newRealityKey(slot int, now time.Time) (RealityKey, error) {
+	key, err := utils.NewXrayKey()
+	if err != nil {
+		return RealityKey{}, err
+	}
+	public, err := utils.XrayPublicKey(key.PrivateKey)
+	if err != nil {
+		return RealityKey{}, err
+	}
+	return RealityKey{XrayKey: key, PublicKey: public, Slot: slot, Created: now}, nil
+}
+
+// loadKeys returns the keys in path, generating and saving them on the first boot.
+func loadKeys(path string, now time.Time) (RealityKeys, error) {
+	var keys RealityKeys
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if keys.Current, err = newRealityKey(0, now); err != nil {
+			return keys, err
+		}
+		slog.Info("Generated the REALITY key of the node", "file", path, "pubkey", keys.Current.PublicKey)
+		return keys, saveKeys(path, keys)
+	}
+	if err != nil {
+		return keys, err
+	}
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return keys, fmt.Errorf("invalid REALITY keys in %s: %w", path, err)
+	}
+	return keys, nil
+}
+
+// saveKeys writes keys to path atomically, readable by the node only.
+func saveKeys(path string, keys RealityKeys) error {
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".reality-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// rotate makes a new key current, on the other slot, and keeps the current one as the previous key.
+func (k *RealityKeys) rotate(now time.Time) error {
+	next, err := newRealityKey(1-k.Current.Slot, now)
+	if err != nil {
+		return err
+	}
+	previous := k.Current
+	k.Current, k.Previous = next, &previous
+	return nil
+}
+
+// next returns when the keys change next: when the previous key expires, or when the current key is due
+// for rotation. It returns the zero time if they never change.
+func (k *RealityKeys) next() time.Time {
+	if k.Previous != nil {
+		return k.Current.Created.Add(KeyOverlap)
+	}
+	if KeyRotation <= 0 {
+		return time.Time{}
+	}
+	return k.Current.Created.Add(KeyRotation)
+}
+
+// advance takes the step due at now, expiring the previous key or rotating the current one, and reports
+// whether the keys changed. The previous key expires in a step of its own, so its users are disconnected
+// before its inbounds serve a new key.
+func (k *RealityKeys) advance(now time.Time) (bool, error) {
+	if k.Previous != nil {
+		if now.Before(k.Current.Created.Add(KeyOverlap)) {
+			return false, nil
+		}
+		k.Previous = nil
+		return true, nil
+	}
+	if KeyRotation <= 0 || now.Before(k.Current.Created.Add(KeyRotation)) {
+		return false, nil
+	}
+	return true, k.rotate(now)
+}
+
+// options returns opts with the keys of the node.
+func (k *RealityKeys) options(opts utils.XrayOptions) utils.XrayOptions {
+	opts.PrivateKey, opts.ShortIDs, opts.KeySlot = k.Current.PrivateKey, k.Current.ShortIDs, k.Current.Slot
+	opts.PreviousKey = nil
+	if k.Previous != nil {
+		opts.PreviousKey = &k.Previous.XrayKey
+	}
+	return opts
+}
+
+// ConfigXray writes the Xray config of the node, with its REALITY keys, and makes users connect to its
+// inbounds. The node generates its keys on the first boot and keeps them in the key file, unless
+// REALITY_PRIKEY pins a key, which is then never rotated.
+func ConfigXray() (utils.XrayConfig, error) {
+	xrayConfig, err := writeXrayConfig()
+	if err != nil {
+		return xrayConfig, err
+	}
+	reality.mutex.Lock()
+	reality.running = inboundTags(xrayConfig)
+	reality.mutex.Unlock()
+	UseInbounds(xrayConfig)
+	return xrayConfig, nil
+}
+
+// writeXrayConfig writes the Xray config with the REALITY keys of the node, rotating the keys that
+// are due.
+func writeXrayConfig() (utils.XrayConfig, error) {
+	reality.mutex.Lock()
+	defer reality.mutex.Unlock()
+
+	opts, err := utils.LoadXrayOptions()
+	if err != nil {
+		return utils.XrayConfig{}, err
+	}
+	if key := os.Getenv("REALITY_PRIKEY"); key != "" {
+		public, err := utils.XrayPublicKey(key)
+		if err != nil {
+			return utils.XrayConfig{}, err
+		}
+		opts.PrivateKey = key
+		reality.shared = true
+		reality.keys = RealityKeys{Current: RealityKey{XrayKey: utils.XrayKey{PrivateKey: key, ShortIDs: opts.ShortIDs}, PublicKey: public}}
+	} else {
+		if reality.keys, err = loadKeys(keyFile(), time.Now()); err != nil {
+			return utils.XrayConfig{}, err
+		}
+		// keys due while the node was down are rotated now
+		changed := false
+		for {
+			step, err := reality.keys.advance(time.Now())
+			if err != nil {
+				return utils.XrayConfig{}, err
+			}
+			if !step {
+				break
+			}
+			changed = true
+		}
+		if changed {
+			if err := saveKeys(keyFile(), reality.keys); err != nil {
+				return utils.XrayConfig{}, err
+			}
+		}
+		opts = reality.keys.options(opts)
+	}
+
+	return utils.ConfigXray(opts)
+}
+
+func inboundTags(xrayConfig utils.XrayConfig) map[string]bool {
+	tags := map[string]bool{}
+	for _, in := range xrayConfig.Inbounds {
+		tags[in.Tag] = true
+	}
+	return tags
+}
+
+// RealityMetadata returns the public parts of the current REALITY key, which the node publishes in its
+// registration: the public key and the short IDs.
+func RealityMetadata() map[string]string {
+	reality.mutex.Lock()
+	defer reality.mutex.Unlock()
+	return map[string]string{
+		"reality_pubkey":   reality.keys.Current.PublicKey,
+		"reality_shortids": strings.Join(reality.keys.Current.ShortIDs, ","),
+	}
+}
+
+// StartKeyRotation rotates the REALITY key of the node on schedule until ctx is done. A rotation adds
+// the inbounds of the new key to Xray, sends new users to them and publishes the new key; the previous
+// key keeps serving its users until the overlap ends, when they are disconnected and its inbounds go.
+// Xray is not restarted, so the sessions of users outlive a rotation.
+func StartKeyRotation(ctx context.Context) {
+	reality.mutex.Lock()
+	shared := reality.shared
+	reality.mutex.Unlock()
+	if shared {
+		return
+	}
+
+	service.Go(ctx, func(ctx context.Context) {
+		retry := false
+		for {
+			wait := time.Minute
+			if !retry {
+				reality.mutex.Lock()
+				next := reality.keys.next()
+				reality.mutex.Unlock()
+				if next.IsZero() {
+					return
+				}
+				wait = time.Until(next)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+
+			err := advanceKeys(time.Now())
+			if err != nil {
+				slog.Error("Failed to rotate the REALITY key, retrying in a minute", "error", err)
+			}
+			retry = err != nil
+		}
+	})
+}
+
+// advanceKeys rotates or expires the keys due at now and puts the result into effect. It also completes
+// a change a previous call failed to put into effect.
+func advanceKeys(now time.Time) error {
+	reality.mutex.Lock()
+	keys := reality.keys
+	if keys.Previous != nil {
+		previous := *keys.Previous
+		keys.Previous = &previous
+	}
+	changed, err := keys.advance(now)
+	if err == nil && changed {
+		if err = saveKeys(keyFile(), keys); err == nil {
+			reality.keys = keys
+		}
+	}
+	reality.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return applyKeys()
+}
+
+// applyKeys rewrites the Xray config with the current keys and changes the inbounds of the running
+// Xray to match. The inbounds of a new key are added before users are sent to them; those of an
+// expired key are removed once its users are disconnected.
+func applyKeys() error {
+	xrayConfig, err := writeXrayConfig()
+	if err != nil {
+		return err
+	}
+	tags := inboundTags(xrayConfig)
+	reality.mutex.Lock()
+	running := reality.running
+	reality.mutex.Unlock()
+
+	var added []utils.XrayInbound
+	for _, in := range xrayConfig.Inbounds {
+		if !running[in.Tag] {
+			added = append(added, in)
+		}
+	}
+	removed := map[string]bool{}
+	for tag := range running {
+		if !tags[tag] {
+			removed[tag] = true
+		}
+	}
+	if len(added) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	client, closeClient, err := handlerClient()
+	if err != nil {
+		return err
+	}
+	defer closeClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	for _, in := range added {
+		// an Xray restarted since already runs the inbounds of the config, which no user was sent to yet
+		removeInbound(ctx, client, in.Tag)
+		if err := addInbound(ctx, client, in); err != nil {
+			return fmt.Errorf("failed to add inbound %s to Xray: %w", in.Tag, err)
+		}
+	}
+	UseInbounds(xrayConfig)
+	if len(added) > 0 {
+		if err := registry.SetMetadata(RealityMetadata()); err != nil {
+			slog.Error("Failed to publish the REALITY key", "error", err)
+		}
+		slog.Info("Rotated the REALITY key", "pubkey", RealityMetadata()["reality_pubkey"], "overlap", KeyOverlap)
+	}
+
+	if len(removed) > 0 {
+		// users on the inbounds that go connected with the expired key
+		connectionsLock.Lock()
+		var expired []string
+		for uuid, user := range users {
+			if removed[user.InTag] {
+				expired = append(expired, uuid)
+			}
+		}
+		connectionsLock.Unlock()
+		for _, uuid := range expired {
+			slog.Info("Disconnecting user of the expired REALITY key", log.User(uuid))
+			closeConnection(uuid)
+		}
+		for tag := range removed {
+			if err := removeInbound(ctx, client, tag); err != nil {
+				slog.Warn("Failed to remove inbound from Xray", "tag", tag, "error", err)
+			}
+		}
+		slog.Info("The previous REALITY key expired", "users", len(expired))
+	}
+
+	reality.mutex.Lock()
+	reality.running = tags
+	reality.mutex.Unlock()
+	return nil
+}
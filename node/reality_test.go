@@ -0,0 +1,181 @@
+package node
+
+import (
+	"context"
+	"go-distributed/utils"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/xtls/xray-core/app/proxyman/command"
+	"google.golang.org/grpc"
+)
+
+func TestRealityKeys(t *testing.T) {
+	defer func(rotation, overlap time.Duration) { KeyRotation, KeyOverlap = rotation, overlap }(KeyRotation, KeyOverlap)
+	KeyRotation, KeyOverlap = 30*24*time.Hour, 24*time.Hour
+
+	path := filepath.Join(t.TempDir(), "reality.json")
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys, err := loadKeys(path, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public, _ := utils.XrayPublicKey(keys.Current.PrivateKey); public != keys.Current.PublicKey || keys.Current.ShortIDs[0] == "" {
+		t.Fatalf("expected a new key with its public key and a short ID, got %+v", keys.Current)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the keys to be kept readable by the node only, got %v %v", info, err)
+	}
+	if again, _ := loadKeys(path, start); again.Current.PrivateKey != keys.Current.PrivateKey {
+		t.Fatal("expected the keys to survive restarts")
+	}
+
+	if changed, _ := keys.advance(start.Add(time.Hour)); changed {
+		t.Error("expected no rotation before it is due")
+	}
+	if next := keys.next(); !next.Equal(start.Add(KeyRotation)) {
+		t.Errorf("expected the rotation to be due after KeyRotation, got %v", next)
+	}
+
+	// the rotation moves the new key to the other set of inbounds and keeps the old one for the overlap
+	rotated := start.Add(KeyRotation)
+	old := keys.Current
+	if changed, err := keys.advance(rotated); err != nil || !changed {
+		t.Fatalf("expected the key to be rotated, got %v", err)
+	}
+	if keys.Previous == nil || keys.Previous.PrivateKey != old.PrivateKey || keys.Current.Slot != 1 || keys.Current.PrivateKey == old.PrivateKey {
+		t.Fatalf("expected a new key on the other slot and the old one kept, got %+v", keys)
+	}
+	if next := keys.next(); !next.Equal(rotated.Add(KeyOverlap)) {
+		t.Errorf("expected the previous key to expire after KeyOverlap, got %v", next)
+	}
+
+	if changed, _ := keys.advance(rotated.Add(KeyOverlap)); !changed || keys.Previous != nil || keys.Current.Slot != 1 {
+		t.Errorf("expected the previous key to expire, got %+v", keys)
+	}
+
+	// a rotation due as the previous key expires waits for the next step
+	late := rotated.Add(KeyRotation)
+	if changed, _ := keys.advance(late); !changed || keys.Current.Slot != 0 || keys.Previous == nil {
+		t.Errorf("expected the key to be rotated back to the first slot, got %+v", keys)
+	}
+	if changed, _ := keys.advance(late.Add(KeyRotation)); !changed || keys.Previous != nil || keys.Current.Slot != 0 {
+		t.Errorf("expected the previous key to expire before the next rotation, got %+v", keys)
+	}
+
+	KeyRotation = 0
+	if next := keys.next(); !next.IsZero() {
+		t.Errorf("expected no rotation when disabled, got %v", next)
+	}
+}
+
+// fakeHandler is the HandlerService of an Xray the test runs without, recording the inbounds added
+// and removed.
+type fakeHandler struct {
+	command.HandlerServiceClient
+	added, removed []string
+	onAdd          func()
+}
+
+func (h *fakeHandler) AddInbound(ctx context.Context, in *command.AddInboundRequest, opts ...grpc.CallOption) (*command.AddInboundResponse, error) {
+	if h.onAdd != nil {
+		h.onAdd()
+	}
+	h.added = append(h.added, in.Inbound.Tag)
+	return &command.AddInboundResponse{}, nil
+}
+
+func (h *fakeHandler) RemoveInbound(ctx context.Context, in *command.RemoveInboundRequest, opts ...grpc.CallOption) (*command.RemoveInboundResponse, error) {
+	h.removed = append(h.removed, in.Tag)
+	return &command.RemoveInboundResponse{}, nil
+}
+
+func TestKeyRotation(t *testing.T) {
+	handler := &fakeHandler{}
+	defer func(old func() (command.HandlerServiceClient, func(), error)) { handlerClient = old }(handlerClient)
+	handlerClient = func() (command.HandlerServiceClient, func(), error) { return handler, func() {}, nil }
+	defer func(old map[Protocol]inbound) { UseInbounds(utils.XrayConfig{}); inbounds = old }(inbounds)
+	defer func(rotation, overlap time.Duration) { KeyRotation, KeyOverlap = rotation, overlap }(KeyRotation, KeyOverlap)
+	KeyRotation, KeyOverlap = time.Hour, time.Hour
+
+	dir := t.TempDir()
+	t.Setenv("Xray_Config", filepath.Join(dir, "config.json"))
+	t.Setenv("Xray_KeyFile", filepath.Join(dir, "reality.json"))
+	t.Setenv("Xray_Protocols", "vless,trojan")
+	t.Setenv("REALITY_PRIKEY", "")
+
+	cfg, err := ConfigXray()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := RealityMetadata()["reality_pubkey"]
+	if len(cfg.Inbounds) != 3 || first == "" {
+		t.Fatalf("expected the inbounds of one key and the published key, got %d inbounds and %q", len(cfg.Inbounds), first)
+	}
+	if in, _ := inboundOf(VLESS); in.Params["pubkey"] != first {
+		t.Errorf("expected users to be given the key of the node, got %v", in.Params)
+	}
+
+	// a user connected with the first key
+	user, err := newUser("123e4567-e89b-12d3-a456-426614174000", "user@example.com", VLESS, inbounds[VLESS])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cancel := context.WithCancel(context.Background())
+	connectionsLock.Lock()
+	connections[user.Uuid] = 20000
+	users[user.Uuid] = user
+	proxyServices[user.Uuid] = &ProxyService{cancelFunc: cancel}
+	connectionsLock.Unlock()
+	defer closeConnection(user.Uuid)
+
+	reality.mutex.Lock()
+	created := reality.keys.Current.Created
+	reality.mutex.Unlock()
+
+	// users are sent to the new inbounds only once Xray runs them
+	handler.onAdd = func() {
+		if in, _ := inboundOf(VLESS); in.Params["pubkey"] != first {
+			t.Error("expected users to be sent to the new inbounds only after they were added to Xray")
+		}
+	}
+	if err := advanceKeys(created.Add(KeyRotation)); err != nil {
+		t.Fatal(err)
+	}
+	handler.onAdd = nil
+	if !slices.Contains(handler.added, utils.XrayInboundTagOf("vless", 1)) || len(handler.added) != 2 {
+		t.Errorf("expected the inbounds of the new key to be added to the running Xray, got %v", handler.added)
+	}
+	second := RealityMetadata()["reality_pubkey"]
+	in, _ := inboundOf(VLESS)
+	if second == first || in.Params["pubkey"] != second || in.Tag != utils.XrayInboundTagOf("vless", 1) {
+		t.Errorf("expected new users to get the new key on the other inbound, got %q %+v", second, in)
+	}
+	if activeConnections() != 1 {
+		t.Error("expected the user of the previous key to stay connected during the overlap")
+	}
+
+	reality.mutex.Lock()
+	created = reality.keys.Current.Created
+	reality.mutex.Unlock()
+	if err := advanceKeys(created.Add(KeyOverlap)); err != nil {
+		t.Fatal(err)
+	}
+	if activeConnections() != 0 {
+		t.Error("expected the user of the expired key to be disconnected")
+	}
+	if !slices.Contains(handler.removed, utils.XrayInboundTagOf("vless", 0)) {
+		t.Errorf("expected the inbounds of the expired key to be removed from Xray, got %v", handler.removed)
+	}
+
+	// the keys survive a restart of the node
+	if _, err := ConfigXray(); err != nil {
+		t.Fatal(err)
+	}
+	if got := RealityMetadata()["reality_pubkey"]; got != second {
+		t.Errorf("expected the node to keep its key across restarts, got %q", got)
+	}
+}
@@ -5,14 +5,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"go-distributed/log"
 	"go-distributed/registry"
+	"go-distributed/service"
 	"go-distributed/utils"
 	"io"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"net/http"
-	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -30,19 +31,21 @@ type User struct {
 
 type ProxyService struct {
 	cancelFunc context.CancelFunc
+	clientIP   string // the only address the proxy forwards connections from
 }
 
 var (
-	xrayCtl *XrayController
-	cfg     = &BaseConfig{
-		APIAddress: "127.0.0.1",
-		APIPort:    8080,
+	cfg = &BaseConfig{
+		APIAddress: utils.XrayAPIAddress,
+		APIPort:    utils.XrayAPIPort,
 	}
-	connections     = make(map[string]int) // uuid: port
+	connections     = make(map[string]int)       // uuid: port
+	users           = make(map[string]*UserInfo) // uuid: the user added to Xray, added again when Xray restarts
 	proxyServices   = make(map[string]*ProxyService)
 	connectionsLock sync.Mutex
 	statsStore      = &StatsStore{}
 	statsCache      = &StatsStore{}
+	webPicker       = registry.NewPicker(registry.WebService, registry.RoundRobin)
 )
 
 func RegisterHandlers() {
@@ -51,6 +54,8 @@ func RegisterHandlers() {
 	http.Handle("/limit", handler)
 	http.Handle("/connect", handler)
 	http.Handle("/disconnect", handler)
+	http.Handle("/drain", handler)
+	http.Handle("/healthz", handler)
 }
 
 func (sh *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -63,6 +68,9 @@ func (sh *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case "/connect":
 			sh.handleConnect(w, r)
 
+		case "/healthz":
+			sh.handleHealth(w, r)
+
 		default:
 			w.WriteHeader(http.StatusNotFound)
 		}
@@ -70,6 +78,9 @@ func (sh *nodeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		switch r.URL.Path {
 		case "/disconnect":
 			sh.handleDisconnect(w, r)
+
+		case "/drain":
+			sh.handleDrain(w, r)
 		}
 	default:
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -110,6 +121,12 @@ func (sh *nodeHandler) handleInfo(w http.ResponseWriter, r *http.Request) {
 }
 
 func (sh *nodeHandler) handleConnect(w http.ResponseWriter, r *http.Request) {
+	// a draining node takes no new users
+	if draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	// only accept request from web service
 	providers, err := registry.GetProviders(registry.WebService)
 
@@ -139,8 +156,8 @@ func (sh *nodeHandler) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	regkey := r.Header.Get("regKey")
-	if regkey != utils.Regkey() {
+	if _, err := registry.Verify(r, registry.WebService); err != nil {
+		slog.WarnContext(r.Context(), "Rejected connect request", "error", err)
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
@@ -150,58 +167,73 @@ func (sh *nodeHandler) handleConnect(w http.ResponseWriter, r *http.Request) {
 	clientip := r.URL.Query().Get("clientip")
 	rateLimit := r.URL.Query().Get("rate")
 	burst := r.URL.Query().Get("burst")
+	protocol := Protocol(r.URL.Query().Get("protocol"))
+	if protocol == "" {
+		protocol = VLESS
+	}
 
 	if uuid == "" || email == "" || clientip == "" {
-		log.Println("Missing required headers: uuid, email, or clientip", uuid, email, clientip)
+		slog.WarnContext(r.Context(), "Missing required parameters: uuid, email, or clientip", log.User(uuid), "email", email, "clientip", clientip)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Received connection request from UUID: %s, Email: %s, Client IP: %s", uuid, email, clientip)
-
-	log.Printf("Current connections: %v", connections)
-	if port, ok := connections[uuid]; ok {
-		w.Header().Set("Content-Type", "application/json")
-		response := map[string]interface{}{
-			"port": strconv.Itoa(port),
-		}
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	in, ok := inboundOf(protocol)
+	if !ok {
+		slog.WarnContext(r.Context(), "Rejected connection request for a protocol not offered", log.User(uuid), "protocol", protocol)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	userInfo, err := newUser(uuid, email, protocol, in)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Rejected connection request", log.User(uuid), "protocol", protocol, "error", err)
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	xrayCtl = new(XrayController)
-	err = xrayCtl.Init(cfg)
+	slog.InfoContext(r.Context(), "Received connection request", log.User(uuid), "email", email, "clientip", clientip, "protocol", protocol)
 
-	defer xrayCtl.CmdConn.Close()
-	if err != nil {
-		log.Printf("Failed to initialize Xray controller: %s", err)
+	// each request has its own controller, as connects run concurrently
+	ctl := new(XrayController)
+	if err := ctl.Init(cfg); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to initialize Xray controller", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
+	defer ctl.CmdConn.Close()
 
-	userInfo := &UserInfo{
-		Uuid:  uuid,
-		Level: 0,
-		InTag: "test",
-		Email: email,
+	connectionsLock.Lock()
+	port, connected := connections[uuid]
+	previous := users[uuid]
+	sameClient := proxyServices[uuid] != nil && proxyServices[uuid].clientIP == clientip
+	connectionsLock.Unlock()
+	// users connected with a REALITY key the node rotated from move to the current key
+	if connected && sameClient && previous != nil && previous.Protocol == protocol && previous.InTag == userInfo.InTag {
+		writeConnectResponse(w, port, previous, in)
+		return
+	}
+	if connected {
+		// the user switches protocols, addresses or keys, so its proxy and the user of the old inbound go
+		slog.InfoContext(r.Context(), "Replacing connection", log.User(uuid), "protocol", protocol, "clientip", clientip)
+		closeConnection(uuid)
+		if previous != nil {
+			removeUser(r.Context(), ctl.HsClient, previous)
+		}
 	}
 
-	err = addVlessUser(xrayCtl.HsClient, userInfo) // TODO: user might already exists, so we should check if user exists before adding
+	err = addUser(r.Context(), ctl.HsClient, userInfo) // TODO: user might already exists, so we should check if user exists before adding
 	if err != nil {
-		removeVlessUser(xrayCtl.HsClient, userInfo)
-		err = addVlessUser(xrayCtl.HsClient, userInfo) // try to add again
+		removeUser(r.Context(), ctl.HsClient, userInfo)
+		err = addUser(r.Context(), ctl.HsClient, userInfo) // try to add again
 		if err != nil {
-			log.Printf("Failed to add user: %s", err)
+			slog.ErrorContext(r.Context(), "Failed to add user", log.User(uuid), "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 	} else {
-		log.Printf("User %s added successfully", userInfo.Email)
+		slog.InfoContext(r.Context(), "User added", log.User(uuid), "email", userInfo.Email)
 	}
 
-	var port int
 	for {
 		port = 10000 + rand.Intn(50000) // random port between 10000-60000
 		ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
@@ -231,30 +263,58 @@ func (sh *nodeHandler) handleConnect(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	go NewProxy(ctx, port, clientip, rateLimitInt, burstInt, statsStore) // start proxy service
+	go NewProxy(ctx, port, in.Address, clientip, rateLimitInt, burstInt, statsStore) // start proxy service
 
 	connectionsLock.Lock()
 	connections[uuid] = port
+	users[uuid] = userInfo
 	proxyServices[uuid] = &ProxyService{
 		cancelFunc: cancel,
+		clientIP:   clientip,
 	}
 	connectionsLock.Unlock()
 
-	w.Header().Set("Content-Type", "application/json")
+	writeConnectResponse(w, port, userInfo, in)
+}
 
-	response := map[string]interface{}{
-		"port": strconv.Itoa(port),
-	}
+// writeConnectResponse answers a connect request with the port of the proxy of user and what its
+// client needs to connect to in, the inbound of the user.
+func writeConnectResponse(w http.ResponseWriter, port int, user *UserInfo, in inbound) {
+	response := connectParams(user, in)
+	response["port"] = strconv.Itoa(port)
+
+	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 }
 
+// closeConnection stops the proxy of the user with uuid and forgets the user.
+func closeConnection(uuid string) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+
+	statsStore.Delete(connections[uuid]) // remove stats for this port
+	delete(connections, uuid)
+	delete(users, uuid)
+
+	if svc, ok := proxyServices[uuid]; ok {
+		svc.cancelFunc()
+		delete(proxyServices, uuid)
+	}
+}
+
 func (sh *nodeHandler) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	if _, err := registry.Verify(r, registry.WebService); err != nil {
+		slog.WarnContext(r.Context(), "Rejected disconnect request", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Printf("Error reading request body: %v", err)
+		slog.Error("Error reading request body", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -262,126 +322,124 @@ func (sh *nodeHandler) handleDisconnect(w http.ResponseWriter, r *http.Request)
 
 	var uuids []string
 	if err := json.Unmarshal(body, &uuids); err != nil {
-		log.Printf("Error unmarshalling JSON: %v", err)
+		slog.Error("Error unmarshalling JSON", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	if len(uuids) == 0 {
-		log.Println("Received an empty list of UUIDs")
+		slog.Warn("Received an empty list of UUIDs")
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	log.Printf("Received disconnect request for %d UUIDs", len(uuids))
-
-	connectionsLock.Lock()
-	defer connectionsLock.Unlock()
+	slog.Info("Received disconnect request", "users", len(uuids))
 
 	for _, uuid := range uuids {
-		log.Printf("Processing disconnect for UUID: %s", uuid)
-
-		port := connections[uuid]
-
-		statsStore.Delete(port) // remove stats for this port
-
-		delete(connections, uuid)
-
-		if svc, ok := proxyServices[uuid]; ok {
-			svc.cancelFunc()
-			delete(proxyServices, uuid)
-		}
+		slog.Info("Processing disconnect", log.User(uuid))
+		closeConnection(uuid)
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func StartTrafficReport() {
-	go func() {
+// StartTrafficReport reports the traffic of the connected users to the web service until ctx is done,
+// then reports what is left once more. Traffic is only counted as reported once the web service
+// accepted it, so a failed report is sent again with the next one.
+func StartTrafficReport(ctx context.Context) {
+	service.Go(ctx, func(ctx context.Context) {
 		for {
-			time.Sleep(5 * time.Second)
-
-			connectionsLock.Lock()
-			connectionsSnapshot := make(map[string]int)
-			for uuid, port := range connections {
-				connectionsSnapshot[uuid] = port
+			select {
+			case <-ctx.Done():
+				reportTraffic()
+				return
+			case <-time.After(5 * time.Second):
 			}
-			connectionsLock.Unlock()
+			reportTraffic()
+		}
+	})
+}
 
-			report := make([]map[string]interface{}, 0, len(connectionsSnapshot))
+// reportTraffic sends the traffic of the connected users since the last report to the web service.
+func reportTraffic() {
+	connectionsLock.Lock()
+	connectionsSnapshot := make(map[string]int)
+	for uuid, port := range connections {
+		connectionsSnapshot[uuid] = port
+	}
+	connectionsLock.Unlock()
 
-			// log.Printf("Connections: %v %v", connectionsSnapshot, statsStore)
+	report := make([]map[string]interface{}, 0, len(connectionsSnapshot))
+	reported := make(map[int]ConnStats, len(connectionsSnapshot))
 
-			for uuid, port := range connectionsSnapshot {
-				val, ok := statsStore.Load(port)
-				if !ok {
-					continue
-				}
-				stats := val.(*ConnStats)
+	for uuid, port := range connectionsSnapshot {
+		val, ok := statsStore.Load(port)
+		if !ok {
+			continue
+		}
+		stats := *(val.(*ConnStats))
 
-				val, ok = statsCache.Load(port)
-				var oldStats ConnStats
-				if ok {
-					oldStats = *(val.(*ConnStats))
-				} else {
-					oldStats = ConnStats{}
-				}
+		val, ok = statsCache.Load(port)
+		var oldStats ConnStats
+		if ok {
+			oldStats = *(val.(*ConnStats))
+		}
 
-				diff := (stats.Downloaded + stats.Uploaded) - (oldStats.Downloaded + oldStats.Uploaded)
+		diff := (stats.Downloaded + stats.Uploaded) - (oldStats.Downloaded + oldStats.Uploaded)
+		reported[port] = stats
 
-				statsCopy := *stats
-				statsCache.Store(port, &statsCopy)
+		report = append(report, map[string]interface{}{
+			"uuid":    uuid,
+			"traffic": diff,
+		})
+	}
+	if len(report) == 0 {
+		return
+	}
 
-				report = append(report, map[string]interface{}{
-					"uuid":    uuid,
-					"traffic": diff,
-				})
-			}
+	data, err := json.Marshal(report)
+	if err != nil {
+		slog.Error("Marshal traffic report error", "error", err)
+		return
+	}
 
-			if len(report) > 0 {
-				data, err := json.Marshal(report)
-				if err != nil {
-					log.Println("Marshal traffic report error:", err)
-					continue
-				}
-
-				providers, err := registry.GetProviders(registry.WebService)
-
-				if len(providers) == 0 {
-					log.Println("No available providers found")
-					continue
-				}
-
-				if err != nil {
-					log.Println("GetProviders error:", err)
-					continue
-				}
-
-				GIN_PORT := os.Getenv("GIN_PORT")
-				provider := providers[0] // TODO
-
-				go func(provider registry.Registration) {
-					url := fmt.Sprintf("http://%s:%s/traffic", provider.PublicIP, GIN_PORT)
-					req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
-					if err != nil {
-						log.Println("Create request error:", err)
-						return
-					}
-					req.Header.Set("Content-Type", "application/json")
-
-					client := &http.Client{}
-					resp, err := client.Do(req)
-					if err != nil {
-						log.Println("Send request error:", err)
-						return
-					}
-					defer resp.Body.Close()
-
-					if resp.StatusCode != http.StatusOK {
-						log.Println("Send request failed:", resp.Status)
-					}
-				}(provider)
-			}
-		}
-	}()
+	provider, done, err := webPicker.Pick("")
+	if err != nil {
+		slog.Warn("No available providers found", "error", err)
+		return
+	}
+	if err := sendTrafficReport(provider, data); err != nil {
+		slog.Error("Send traffic report error", "error", err)
+		done(err)
+		return
+	}
+	done(nil)
+
+	for port, stats := range reported {
+		statsCache.Store(port, &stats)
+	}
+}
+
+// sendTrafficReport posts data, a traffic report, to the /traffic endpoint of provider. It gives up
+// after 10 seconds, so a hanging web service delays the next report rather than stopping reports.
+func sendTrafficReport(provider registry.Registration, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", provider.ServiceURL+"/traffic", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	registry.Authorize(req)
+
+	resp, err := registry.HTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("web service responded with %s", resp.Status)
+	}
+	return nil
 }
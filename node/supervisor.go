@@ -0,0 +1,226 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go-distributed/service"
+	"go-distributed/utils"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// MinRestartBackoff is how long the supervisor waits before restarting Xray the first time it exits.
+	// The wait doubles with every exit in a row, up to MaxRestartBackoff.
+	MinRestartBackoff = time.Second
+	MaxRestartBackoff = time.Minute
+
+	// StableAfter is how long Xray must run before an exit counts as the first in a row again.
+	StableAfter = time.Minute
+
+	// StopTimeout is how long Xray may take to exit once asked to, before it is killed.
+	StopTimeout = 5 * time.Second
+)
+
+// xray is the state of the Xray process the supervisor runs, reported by the health check.
+var xray struct {
+	launched bool
+	running  bool
+	exitErr  error // why Xray last exited, while it is not running
+	restarts int
+	mutex    sync.Mutex
+}
+
+// restoreUsers adds the connected users to Xray after it restarted, as a restarted Xray knows none of them.
+var restoreUsers = addConnectedUsers
+
+// SuperviseXray runs Xray, the binary in XRAY_PATH with the config written by utils.ConfigXray,
+// forwards its output to the log and restarts it with backoff whenever it exits. Xray is stopped
+// once the service shuts down and no longer serves requests.
+func SuperviseXray() {
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		superviseXray(ctx, utils.XrayPath(), "run", "-c", utils.XrayConfigPath())
+	}()
+
+	service.OnShutdown(func(shutdownCtx context.Context) error {
+		stop()
+		select {
+		case <-done:
+			return nil
+		case <-shutdownCtx.Done():
+			return shutdownCtx.Err()
+		}
+	})
+}
+
+// superviseXray runs path with args until ctx is done, restarting it when it exits.
+func superviseXray(ctx context.Context, path string, args ...string) {
+	backoff := MinRestartBackoff
+	for first := true; ; first = false {
+		started := time.Now()
+		err := runXray(ctx, path, args, !first)
+
+		xray.mutex.Lock()
+		xray.running = false
+		xray.exitErr = err
+		if ctx.Err() == nil {
+			xray.restarts++
+		}
+		xray.mutex.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		xrayRestarts.Inc()
+
+		if time.Since(started) > StableAfter {
+			backoff = MinRestartBackoff
+		}
+		slog.Error("Xray exited, restarting", "error", err, "backoff", backoff)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, MaxRestartBackoff)
+	}
+}
+
+// runXray runs Xray once, until it exits or ctx is done, and returns why it exited. Once a restarted
+// Xray runs, the connected users are added to it again.
+func runXray(ctx context.Context, path string, args []string, restarted bool) error {
+	cmd := exec.Command(path, args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Launching xray", "path", path)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var output sync.WaitGroup
+	output.Add(2)
+	go forwardOutput(&output, stdout)
+	go forwardOutput(&output, stderr)
+
+	xray.mutex.Lock()
+	xray.launched = true
+	xray.running = true
+	xray.exitErr = nil
+	xray.mutex.Unlock()
+
+	restored := make(chan struct{})
+	restoreCtx, cancelRestore := context.WithCancel(ctx)
+	defer cancelRestore()
+	go func() {
+		defer close(restored)
+		if restarted {
+			if err := restoreUsers(restoreCtx); err != nil {
+				slog.Error("Failed to add the connected users to the restarted Xray", "error", err)
+			}
+		}
+	}()
+
+	exited := make(chan error, 1)
+	go func() {
+		output.Wait() // Wait closes the pipes, so read them to the end first
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-exited:
+	case <-ctx.Done():
+		cmd.Process.Signal(syscall.SIGTERM)
+		select {
+		case err = <-exited:
+		case <-time.After(StopTimeout):
+			cmd.Process.Kill()
+			err = <-exited
+		}
+		slog.Info("Xray stopped")
+	}
+	cancelRestore()
+	<-restored
+
+	if err == nil {
+		err = fmt.Errorf("xray exited")
+	}
+	return err
+}
+
+// forwardOutput logs the lines Xray writes to r, at the level Xray logged them at.
+func forwardOutput(wg *sync.WaitGroup, r io.Reader) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		level := slog.LevelInfo
+		switch {
+		case strings.Contains(line, "[Error]"):
+			level = slog.LevelError
+		case strings.Contains(line, "[Warning]"):
+			level = slog.LevelWarn
+		case strings.Contains(line, "[Debug]"):
+			level = slog.LevelDebug
+		}
+		slog.Log(context.Background(), level, line, "source", "xray")
+	}
+}
+
+// addConnectedUsers adds the connected users to Xray, retrying until its API answers or ctx is done.
+func addConnectedUsers(ctx context.Context) error {
+	connectionsLock.Lock()
+	pending := make([]*UserInfo, 0, len(users))
+	for _, user := range users {
+		pending = append(pending, user)
+	}
+	connectionsLock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	ctl := new(XrayController)
+	if err := ctl.Init(cfg); err != nil {
+		return err
+	}
+	defer ctl.CmdConn.Close()
+
+	for attempt := 0; len(pending) > 0; attempt++ {
+		var failed []*UserInfo
+		var lastErr error
+		for _, user := range pending {
+			if err := addUser(ctx, ctl.HsClient, user); err != nil {
+				failed = append(failed, user)
+				lastErr = err
+			}
+		}
+		pending = failed
+		if len(pending) == 0 {
+			break
+		}
+		if attempt == 20 {
+			return fmt.Errorf("%d users not added: %w", len(pending), lastErr)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+	slog.Info("Added the connected users to the restarted Xray")
+	return nil
+}
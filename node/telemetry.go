@@ -0,0 +1,72 @@
+package node
+
+import (
+	"go-distributed/registry/heartbeat"
+	"sync"
+	"time"
+
+	"github.com/shirou/gopsutil/v3/cpu"
+	"github.com/shirou/gopsutil/v3/mem"
+)
+
+var (
+	throughputLock  sync.Mutex
+	lastProxiedSum  int64
+	lastSampledTime time.Time
+)
+
+// CollectServerInfo samples the telemetry this node reports with its heartbeats.
+func CollectServerInfo() (heartbeat.ServerInfo, error) {
+	var info heartbeat.ServerInfo
+
+	// usage since the previous call, so sampling does not block the heartbeat
+	cpuUsage, err := cpu.Percent(0, false)
+	if err != nil {
+		return info, err
+	}
+	if len(cpuUsage) > 0 {
+		info.CPUUsage = cpuUsage[0]
+	}
+
+	memInfo, err := mem.VirtualMemory()
+	if err != nil {
+		return info, err
+	}
+	info.MemoryUsage = memInfo.UsedPercent
+
+	connectionsLock.Lock()
+	info.Connections = len(connections)
+	connectionsLock.Unlock()
+
+	info.Throughput = throughput()
+
+	used, err := monthlyTrafficUsed()
+	if err != nil {
+		return info, err
+	}
+	info.MonthlyTraffic = used
+
+	return info, nil
+}
+
+// throughput returns the bytes per second proxied over all connections since the previous call.
+func throughput() int64 {
+	var total int64
+	statsStore.Range(func(_, val any) bool {
+		stats := val.(*ConnStats)
+		total += int64(stats.Uploaded + stats.Downloaded)
+		return true
+	})
+
+	throughputLock.Lock()
+	defer throughputLock.Unlock()
+
+	now := time.Now()
+	var rate int64
+	// the counters of a disconnected user are dropped, which makes the total go down
+	if elapsed := now.Sub(lastSampledTime).Seconds(); !lastSampledTime.IsZero() && elapsed > 0 && total >= lastProxiedSum {
+		rate = int64(float64(total-lastProxiedSum) / elapsed)
+	}
+	lastProxiedSum, lastSampledTime = total, now
+	return rate
+}
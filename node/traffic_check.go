@@ -90,6 +90,19 @@ func RestoreFirewall() {
 	runCommand("iptables", "-P", "INPUT", "ACCEPT")
 }
 
+// monthlyTrafficUsed returns the bytes used by the host in the current traffic cycle.
+func monthlyTrafficUsed() (int64, error) {
+	curTraffic, err := getCurrentTrafficBytes()
+	if err != nil {
+		return 0, err
+	}
+	startTraffic := readFileInt(usageFile)
+	if startTraffic == -1 || curTraffic < startTraffic {
+		return 0, nil // not recorded by CheckTriffic yet
+	}
+	return curTraffic - startTraffic, nil
+}
+
 // CheckTriffic checks the traffic usage of host and blocks all except port 22 if usage exceeds the limit.
 func CheckTriffic() {
 	// read environment variables
@@ -2,22 +2,32 @@ package node
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"go-distributed/tracing"
+	"go-distributed/utils"
+	"log/slog"
 
 	loggerService "github.com/xtls/xray-core/app/log/command"
+	"github.com/xtls/xray-core/app/proxyman"
 	"github.com/xtls/xray-core/app/proxyman/command"
 	routingService "github.com/xtls/xray-core/app/router/command"
 	statsService "github.com/xtls/xray-core/app/stats/command"
-	"github.com/xtls/xray-core/common/protocol"
+	xnet "github.com/xtls/xray-core/common/net"
 	"github.com/xtls/xray-core/common/serial"
-	"github.com/xtls/xray-core/proxy/vless"
+	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/proxy/trojan"
+	vlessInbound "github.com/xtls/xray-core/proxy/vless/inbound"
+	"github.com/xtls/xray-core/transport/internet"
+	realityConfig "github.com/xtls/xray-core/transport/internet/reality"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 )
 
 type UserInfo struct {
-	// For VMess & Trojan
+	// For VLESS & VMess
 	Uuid string
 	// User's Level
 	Level uint32
@@ -27,8 +37,10 @@ type UserInfo struct {
 	Email string
 	// For ShadowSocks
 	CipherType string
-	// For ShadowSocks
+	// For Trojan & ShadowSocks
 	Password string
+	// Which protocol the user connects with, the protocol of the inbound
+	Protocol Protocol
 }
 
 // Xray API listener address and port
@@ -46,7 +58,8 @@ type XrayController struct {
 }
 
 func (xrayCtl *XrayController) Init(cfg *BaseConfig) (err error) {
-	xrayCtl.CmdConn, err = grpc.NewClient(fmt.Sprintf("%s:%d", cfg.APIAddress, cfg.APIPort), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	xrayCtl.CmdConn, err = grpc.NewClient(fmt.Sprintf("%s:%d", cfg.APIAddress, cfg.APIPort), grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithStatsHandler(tracing.GRPCClientHandler()))
 
 	if err != nil {
 		return err
@@ -74,7 +87,7 @@ func queryTraffic(c statsService.StatsServiceClient, ptn string, reset bool) (tr
 	}
 	// Get traffic data
 	stat := resp.GetStat()
-	fmt.Printf("Query traffic for pattern '%s': %v\n", ptn, stat)
+	slog.Debug("Queried traffic", "pattern", ptn, "stat", stat)
 	if len(stat) != 0 {
 		traffic = stat[0].Value // unit: Bytes
 	}
@@ -82,30 +95,78 @@ func queryTraffic(c statsService.StatsServiceClient, ptn string, reset bool) (tr
 	return
 }
 
-func addVlessUser(client command.HandlerServiceClient, user *UserInfo) error {
-	_, err := client.AlterInbound(context.Background(), &command.AlterInboundRequest{
-		Tag: user.InTag,
-		Operation: serial.ToTypedMessage(&command.AddUserOperation{
-			User: &protocol.User{
-				Level: user.Level,
-				Email: user.Email,
-				Account: serial.ToTypedMessage(&vless.Account{
-					Id:         user.Uuid,
-					Flow:       "xtls-rprx-vision",
-					Encryption: "none",
-				}),
-			},
-		}),
-	})
+// inboundHandler returns in, an inbound of the Xray config, as the HandlerService adds it. Only the
+// inbounds of a REALITY key, VLESS and Trojan, are added at runtime.
+func inboundHandler(in utils.XrayInbound) (*core.InboundHandlerConfig, error) {
+	var proxy *serial.TypedMessage
+	switch Protocol(in.Protocol) {
+	case VLESS:
+		proxy = serial.ToTypedMessage(&vlessInbound.Config{Decryption: "none"})
+	case Trojan:
+		proxy = serial.ToTypedMessage(&trojan.ServerConfig{})
+	default:
+		return nil, fmt.Errorf("cannot add %s inbound %s at runtime", in.Protocol, in.Tag)
+	}
+
+	listen := in.Listen
+	if listen == "" {
+		listen = "0.0.0.0"
+	}
+	receiver := &proxyman.ReceiverConfig{
+		PortList:       &xnet.PortList{Range: []*xnet.PortRange{xnet.SinglePortRange(xnet.Port(in.Port))}},
+		Listen:         xnet.NewIPOrDomain(xnet.ParseAddress(listen)),
+		StreamSettings: &internet.StreamConfig{ProtocolName: "tcp"},
+	}
+	if in.Sniffing != nil {
+		receiver.SniffingSettings = &proxyman.SniffingConfig{Enabled: in.Sniffing.Enabled, DestinationOverride: in.Sniffing.DestOverride}
+	}
+	if in.StreamSettings != nil && in.StreamSettings.RealitySettings != nil {
+		settings := in.StreamSettings.RealitySettings
+		privateKey, err := base64.RawURLEncoding.DecodeString(settings.PrivateKey)
+		if err != nil || len(privateKey) != 32 {
+			return nil, fmt.Errorf("invalid REALITY private key of inbound %s", in.Tag)
+		}
+		config := &realityConfig.Config{
+			Dest:        settings.Dest,
+			Type:        "tcp",
+			Xver:        uint64(settings.Xver),
+			ServerNames: settings.ServerNames,
+			PrivateKey:  privateKey,
+		}
+		// as Xray reads them, short IDs are padded to 8 bytes
+		for _, id := range settings.ShortIDs {
+			shortID := make([]byte, 8)
+			if len(id) > 16 {
+				return nil, fmt.Errorf("invalid short ID %q of inbound %s", id, in.Tag)
+			}
+			if _, err := hex.Decode(shortID, []byte(id)); err != nil {
+				return nil, fmt.Errorf("invalid short ID %q of inbound %s", id, in.Tag)
+			}
+			config.ShortIds = append(config.ShortIds, shortID)
+		}
+		receiver.StreamSettings.SecurityType = serial.GetMessageType(config)
+		receiver.StreamSettings.SecuritySettings = []*serial.TypedMessage{serial.ToTypedMessage(config)}
+	}
+
+	return &core.InboundHandlerConfig{
+		Tag:              in.Tag,
+		ReceiverSettings: serial.ToTypedMessage(receiver),
+		ProxySettings:    proxy,
+	}, nil
+}
+
+// addInbound adds in to the running Xray.
+func addInbound(ctx context.Context, client command.HandlerServiceClient, in utils.XrayInbound) error {
+	handler, err := inboundHandler(in)
+	if err != nil {
+		return err
+	}
+	_, err = client.AddInbound(ctx, &command.AddInboundRequest{Inbound: handler})
 	return err
 }
 
-func removeVlessUser(client command.HandlerServiceClient, user *UserInfo) error {
-	_, err := client.AlterInbound(context.Background(), &command.AlterInboundRequest{
-		Tag: user.InTag,
-		Operation: serial.ToTypedMessage(&command.RemoveUserOperation{
-			Email: user.Email,
-		}),
-	})
+// removeInbound removes the inbound with tag, and its users, from the running Xray.
+func removeInbound(ctx context.Context, client command.HandlerServiceClient, tag string) error {
+	_, err := client.RemoveInbound(ctx, &command.RemoveInboundRequest{Tag: tag})
 	return err
 }
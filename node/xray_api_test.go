@@ -1,6 +1,7 @@
 package node
 
 import (
+	"context"
 	"testing"
 )
 
@@ -42,14 +43,12 @@ func TestAddUser(t *testing.T) {
 		t.Errorf("Failed %s", err)
 	}
 
-	user := &UserInfo{
-		Uuid:  "123e4567-e89b-12d3-a456-426614174000",
-		Level: 0,
-		InTag: "test",
-		Email: "TestAddUser",
+	user, err := newUser("123e4567-e89b-12d3-a456-426614174000", "TestAddUser", VLESS, inbounds[VLESS])
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	err = addVlessUser(xrayCtl.HsClient, user)
+	err = addUser(context.Background(), xrayCtl.HsClient, user)
 	if err != nil {
 		t.Errorf("Failed to add user: %s", err)
 	} else {
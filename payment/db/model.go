@@ -13,4 +13,5 @@ type Order struct {
 	CreatedAt    time.Time `db:"created_at" json:"created_at"`       // created time
 	Callback     string    `db:"callback" json:"callback"`           // callback url
 	Method       string    `db:"method" json:"method"`               // payment method, e.g., TRX
+	TraceParent  string    `db:"trace_parent" json:"-"`              // trace of the request creating the order, continued by its callback
 }
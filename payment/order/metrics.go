@@ -0,0 +1,27 @@
+package order
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// payment_orders_total{status}: orders that entered a status: "pending" when created, then
+	// "paid", "callback_failed" or "expired".
+	ordersByStatus = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "payment_orders_total",
+		Help: "Orders that entered a status.",
+	}, []string{"status"})
+
+	// payment_trongrid_polls_total: queries of the TronGrid API for incoming transactions.
+	trongridPolls = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "payment_trongrid_polls_total",
+		Help: "Queries of the TronGrid API for incoming transactions.",
+	})
+
+	// payment_trongrid_poll_errors_total: queries of the TronGrid API that failed.
+	trongridPollErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "payment_trongrid_poll_errors_total",
+		Help: "Queries of the TronGrid API that failed.",
+	})
+)
@@ -0,0 +1,46 @@
+package order
+
+import (
+	"go-distributed/payment/db"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestOrderMetrics(t *testing.T) {
+	status := http.StatusInternalServerError
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer web.Close()
+
+	paid := testutil.ToFloat64(ordersByStatus.WithLabelValues("paid"))
+	failed := testutil.ToFloat64(ordersByStatus.WithLabelValues("callback_failed"))
+
+	defer func(save func(id, status string)) { saveStatus = save }(saveStatus)
+	saveStatus = func(id, status string) {}
+
+	// the web service fails the callback of the first order and accepts the one of the second
+	first := &db.Order{ID: "TestOrderMetrics-1", Status: "pending", Callback: web.URL + "/payment/callback", CreatedAt: time.Now()}
+	payOrder(first)
+	if first.Status != "callback_failed" {
+		t.Fatalf("expected the failed callback to be recorded, got %s", first.Status)
+	}
+	status = http.StatusOK
+	second := &db.Order{ID: "TestOrderMetrics-2", Status: "pending", Callback: web.URL + "/payment/callback", CreatedAt: time.Now()}
+	payOrder(second)
+	if second.Status != "paid" {
+		t.Fatalf("expected the order to be paid, got %s", second.Status)
+	}
+
+	// both orders entered the paid status
+	if got := testutil.ToFloat64(ordersByStatus.WithLabelValues("paid")) - paid; got != 2 {
+		t.Errorf("expected 2 more paid orders, got %v", got)
+	}
+	if got := testutil.ToFloat64(ordersByStatus.WithLabelValues("callback_failed")) - failed; got != 1 {
+		t.Errorf("expected 1 more failed callback, got %v", got)
+	}
+}
@@ -4,8 +4,10 @@
 package order
 
 import (
+	"context"
 	"errors"
 	"go-distributed/payment/db"
+	"go-distributed/tracing"
 	"go-distributed/utils"
 	"time"
 )
@@ -20,14 +22,6 @@ var orderMap = make(map[string]*db.Order) // Order ID → Order
 
 func init() {
 	utils.LoadEnv()
-
-	db.Connect()
-	db.Sync()
-
-	err := RestoreStateFromDB()
-	if err != nil {
-		panic(err)
-	}
 }
 
 // find minimal actual amount for the given amount
@@ -37,7 +31,7 @@ func mapAmountToActualAmount(amount int64) (int64, error) {
 	return actualAmount, nil
 }
 
-func CreateOrder(id string, amount int64, callback, method, currency string) (db.Order, error) {
+func CreateOrder(ctx context.Context, id string, amount int64, callback, method, currency string) (db.Order, error) {
 	if method != "TRX" {
 		return db.Order{}, errors.New("unsupported payment method")
 	}
@@ -64,6 +58,7 @@ func CreateOrder(id string, amount int64, callback, method, currency string) (db
 		CreatedAt:    time.Now(),
 		Callback:     callback,
 		Method:       method,
+		TraceParent:  tracing.Parent(ctx),
 	}
 
 	result := db.DB.Create(&order)
@@ -72,6 +67,7 @@ func CreateOrder(id string, amount int64, callback, method, currency string) (db
 	}
 
 	orderMap[id] = &order
+	ordersByStatus.WithLabelValues(order.Status).Inc()
 	ActualAmountToID[int64(actualAmount)] = id // map actual amount to order id
 
 	return order, nil
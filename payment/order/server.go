@@ -1,10 +1,15 @@
 package order
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"go-distributed/log"
 	"go-distributed/payment/db"
+	"go-distributed/registry"
+	"go-distributed/service"
+	"log/slog"
 	"net/http"
 	"strconv"
 	"time"
@@ -19,22 +24,36 @@ func RegisterHandlers() {
 	handler := new(payHandler)
 	http.Handle("/api/payment/order/create", handler)
 	http.Handle("/api/payment/order/status", handler)
+}
 
-	go func() {
-		// UpdateOrderStatus every 5 seconds
+// StartTasks updates the order status every 5 seconds and removes timed out orders every 20
+// seconds until ctx is done.
+func StartTasks(ctx context.Context) {
+	service.Go(ctx, func(ctx context.Context) {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
 		for {
-			UpdateOrderStatus()
-			time.Sleep(5 * time.Second)
+			UpdateOrderStatus(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
 		}
-	}()
+	})
 
-	go func() {
-		// RemoveTimeoutOrders every 20 seconds
+	service.Go(ctx, func(ctx context.Context) {
+		ticker := time.NewTicker(20 * time.Second)
+		defer ticker.Stop()
 		for {
 			RemoveTimeoutOrders()
-			time.Sleep(20 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
 		}
-	}()
+	})
 }
 
 func (ph *payHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -59,6 +78,13 @@ func (ph *payHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (ph *payHandler) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
+	// orders are created by the web service on behalf of its users
+	if _, err := registry.Verify(r, registry.WebService); err != nil {
+		slog.WarnContext(r.Context(), "Rejected order request", "error", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
 	id := r.URL.Query().Get("order_id")
 	amount := r.URL.Query().Get("amount")
 	callback := r.URL.Query().Get("callback")
@@ -70,7 +96,7 @@ func (ph *payHandler) handleCreateOrder(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "Invalid amount", http.StatusBadRequest)
 		return
 	}
-	order, err := CreateOrder(id, amountInt, callback, method, currency)
+	order, err := CreateOrder(r.Context(), id, amountInt, callback, method, currency)
 
 	if err != nil {
 		http.Error(w, "Failed to create order", http.StatusInternalServerError)
@@ -85,7 +111,7 @@ func (ph *payHandler) handleCreateOrder(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	w.Write(jsonData)
-	fmt.Println("Order created:", order.ID, order.Amount, order.Callback)
+	slog.InfoContext(r.Context(), "Order created", log.Order(order.ID), "amount", order.Amount, "callback", order.Callback)
 
 }
 
@@ -116,9 +142,10 @@ func (ph *payHandler) handleGetOrderStatus(w http.ResponseWriter, r *http.Reques
 		return
 	}
 	w.Write(jsonData)
-	fmt.Println("Order status requested:", order.ID, order.Status)
+	slog.InfoContext(r.Context(), "Order status requested", log.Order(order.ID), "status", order.Status)
 }
 
+// GenerateTronAddress prints a new wallet key and its address to standard output, for operators setting up a wallet.
 func GenerateTronAddress() {
 	privateKey, err := crypto.GenerateKey()
 	if err != nil {
@@ -3,15 +3,18 @@
 package order
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"go-distributed/log"
 	"go-distributed/payment/db"
-	"go-distributed/utils"
+	"go-distributed/registry"
+	"go-distributed/tracing"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"time"
-
-	"log"
 )
 
 const paymentTimeout = 15 * time.Minute
@@ -19,7 +22,8 @@ const apiUrl = "https://api.shasta.trongrid.io/v1/accounts/%s/transactions" // t
 
 var trongridApiKey = os.Getenv("TRONGRID_API_KEY")
 
-func UpdateOrderStatus() {
+// UpdateOrderStatus marks the pending orders paid whose transactions arrived. Cancelling ctx aborts the query.
+func UpdateOrderStatus(ctx context.Context) {
 	// update order status from TronGrid api
 	minTimestamp := time.Now().Add(-paymentTimeout).Unix() * 1000
 	limit := 200 // number of transactions per page, default 20, max 200
@@ -31,23 +35,26 @@ func UpdateOrderStatus() {
 			urlWithParams += "&next=" + next
 		}
 
-		req, err := http.NewRequest("GET", urlWithParams, nil)
+		req, err := http.NewRequestWithContext(ctx, "GET", urlWithParams, nil)
 		if err != nil {
-			fmt.Println("Error creating request:", err)
+			slog.Error("Error creating request", "error", err)
 			return
 		}
 		if trongridApiKey != "" {
 			req.Header.Set("TRON-PRO-API-KEY", trongridApiKey)
 		}
 
+		trongridPolls.Inc()
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			fmt.Println("Error getting order status:", err)
+			trongridPollErrors.Inc()
+			slog.Error("Error getting order status", "error", err)
 			return
 		}
 		if resp.StatusCode != http.StatusOK {
 			resp.Body.Close()
-			fmt.Println("Error getting order status:", resp.Status)
+			trongridPollErrors.Inc()
+			slog.Error("Error getting order status", "status", resp.Status)
 			return
 		}
 
@@ -73,42 +80,21 @@ func UpdateOrderStatus() {
 
 			orderID, ok := ActualAmountToID[amount]
 			if !ok {
-				log.Println("Order ID not found for amount:", amount)
+				slog.Warn("Order ID not found for amount", "amount", amount)
 				continue
 			}
 
 			order, ok := orderMap[orderID]
 			if !ok {
-				log.Println("Order not found:", orderID)
+				slog.Warn("Order not found", log.Order(orderID))
 				continue
 			}
 
-			fmt.Println("Order found:", order)
+			slog.Debug("Order found", log.Order(order.ID), "status", order.Status)
 			if order.Status == "pending" {
-				order.Status = "paid"
 				intervalSet.Remove(order.ActualAmount)
 				delete(ActualAmountToID, amount)
-				db.DB.Model(&db.Order{}).Where("id = ?", order.ID).Update("status", "paid")
-
-				if order.Callback != "" {
-					regkey := utils.Regkey()
-					callbackUrl := fmt.Sprintf("%s?order_id=%s&regkey=%s", order.Callback, order.ID, regkey)
-					callbackResp, err := http.Post(callbackUrl, "application/json", nil)
-					if err != nil {
-						log.Println("Error calling callback URL:", err)
-						order.Status = "callback_failed"
-						db.DB.Model(&db.Order{}).Where("id = ?", order.ID).Update("status", "callback_failed")
-						continue
-					}
-					if callbackResp.StatusCode != http.StatusOK {
-						log.Println("Callback URL returned non-200 status:", callbackResp.StatusCode)
-						order.Status = "callback_failed"
-						db.DB.Model(&db.Order{}).Where("id = ?", order.ID).Update("status", "callback_failed")
-						callbackResp.Body.Close()
-						continue
-					}
-					callbackResp.Body.Close()
-				}
+				payOrder(order)
 			}
 		}
 
@@ -119,15 +105,47 @@ func UpdateOrderStatus() {
 	}
 }
 
+// payOrder marks order as paid and calls its callback. If the callback fails, the order is marked
+// callback_failed, for RetryCallbackFailedOrders to call it again.
+func payOrder(order *db.Order) {
+	setStatus(order, "paid")
+
+	if order.Callback == "" {
+		return
+	}
+	callbackResp, err := sendCallback(order)
+	if err != nil {
+		slog.Error("Error calling callback URL", log.Order(order.ID), "error", err)
+		setStatus(order, "callback_failed")
+		return
+	}
+	defer callbackResp.Body.Close()
+	if callbackResp.StatusCode != http.StatusOK {
+		slog.Error("Callback URL returned non-200 status", log.Order(order.ID), "status", callbackResp.StatusCode)
+		setStatus(order, "callback_failed")
+	}
+}
+
+// saveStatus stores status as the status of the order with id. Tests replace it to run without a database.
+var saveStatus = func(id, status string) {
+	db.DB.Model(&db.Order{}).Where("id = ?", id).Update("status", status)
+}
+
+// setStatus moves order to status, counts it in payment_orders_total and stores it.
+func setStatus(order *db.Order, status string) {
+	order.Status = status
+	ordersByStatus.WithLabelValues(status).Inc()
+	saveStatus(order.ID, status)
+}
+
 func RemoveTimeoutOrders() {
 	for id, order := range orderMap {
 		if time.Since(order.CreatedAt) > paymentTimeout {
 			delete(orderMap, id)
 			delete(ActualAmountToID, int64(order.ActualAmount))
-			log.Println("Order timeout:", id)
+			slog.Info("Order timeout", log.Order(id))
 			if order.Status == "pending" {
-				order.Status = "expired"
-				db.DB.Model(&db.Order{}).Where("id = ?", order.ID).Update("status", "expired")
+				setStatus(order, "expired")
 			}
 		}
 	}
@@ -137,23 +155,35 @@ func RetryCallbackFailedOrders() {
 	for id, order := range orderMap {
 		if order.Status == "callback_failed" {
 			if order.Callback != "" {
-				regkey := utils.Regkey()
-				callbackUrl := fmt.Sprintf("%s?order_id=%s&regkey=%s", order.Callback, order.ID, regkey)
-				resp, err := http.Get(callbackUrl)
+				resp, err := sendCallback(order)
 				if err != nil {
-					log.Println("Error calling callback URL:", err)
+					slog.Error("Error calling callback URL", log.Order(order.ID), "error", err)
 					continue
 				}
 				if resp.StatusCode != http.StatusOK {
-					log.Println("Callback URL returned non-200 status:", resp.StatusCode)
+					slog.Error("Callback URL returned non-200 status", log.Order(order.ID), "status", resp.StatusCode)
 					resp.Body.Close()
 					continue
 				}
 				resp.Body.Close()
+				// the order entered the paid status already, before its callback failed
 				order.Status = "paid"
-				db.DB.Model(&db.Order{}).Where("id = ?", order.ID).Update("status", "paid")
-				log.Println("Callback retried successfully for order:", id)
+				saveStatus(order.ID, order.Status)
+				slog.Info("Callback retried successfully", log.Order(id))
 			}
 		}
 	}
 }
+
+// sendCallback notifies the web service that order is paid, authenticated with the token of the payment service.
+func sendCallback(order *db.Order) (*http.Response, error) {
+	callbackUrl := fmt.Sprintf("%s?order_id=%s", order.Callback, url.QueryEscape(order.ID))
+	// the callback continues the trace of the request creating the order
+	ctx := tracing.WithParent(context.Background(), order.TraceParent)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	registry.Authorize(req)
+	return registry.HTTPClient().Do(req)
+}
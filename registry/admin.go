@@ -0,0 +1,273 @@
+package registry
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"go-distributed/registry/auth"
+	"go-distributed/utils"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const adminPath = "/services/admin"
+
+// Outcome is the result of the last of repeated attempts on a service, e.g. pushing it patches or probing its health.
+type Outcome struct {
+	Time     time.Time
+	Error    string `json:",omitempty"`
+	Failures int    // consecutive failed attempts
+}
+
+// outcomes tracks the Outcome of an attempt for each service.
+type outcomes struct {
+	status map[string]Outcome // by ServiceID
+	now    func() time.Time
+	mutex  sync.Mutex
+}
+
+func newOutcomes(now func() time.Time) *outcomes {
+	return &outcomes{status: make(map[string]Outcome), now: now}
+}
+
+func (o *outcomes) record(serviceID string, err error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	status := Outcome{Time: o.now()}
+	if err != nil {
+		status.Error = err.Error()
+		status.Failures = o.status[serviceID].Failures + 1
+	}
+	o.status[serviceID] = status
+}
+
+func (o *outcomes) forget(removed []Registration) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	for _, reg := range removed {
+		delete(o.status, reg.ServiceID)
+	}
+}
+
+func (o *outcomes) get(serviceID string) (Outcome, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	status, ok := o.status[serviceID]
+	return status, ok
+}
+
+// ServiceStatus is a registration as listed by the admin API.
+type ServiceStatus struct {
+	Registration
+	LastHeartbeat       time.Time
+	HeartbeatAgeSeconds float64
+	// LastPatch is nil if no patch was pushed to the service since the registry started
+	LastPatch *Outcome `json:",omitempty"`
+	// LastProbe is nil if the service has no health check or was not probed yet
+	LastProbe *Outcome `json:",omitempty"`
+}
+
+// UseAdminKey enables the admin API for requests carrying key as bearer token. It must be called before serving.
+func (s RegistryService) UseAdminKey(key string) {
+	s.reg.adminKey = key
+}
+
+// handleAdmin serves the admin API:
+//
+//	GET  /services/admin          lists all registrations
+//	POST /services/admin/evict    removes the registration with the ServiceID in the body
+//	POST /services/admin/drain    marks the registration as draining
+//	POST /services/admin/repush   pushes the current providers of its required services to the service again
+//	POST /services/admin/regkey   returns the registration key of the ServiceName in the body
+func (r *registry) handleAdmin(w http.ResponseWriter, req *http.Request) {
+	if r.adminKey == "" {
+		http.Error(w, "Admin API is not enabled", http.StatusNotFound)
+		return
+	}
+	token, ok := bearer(req)
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(r.adminKey)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// heartbeats and patch deliveries are only known to the leader
+	if !r.isLeader() {
+		r.redirectToLeader(w, req)
+		return
+	}
+
+	if req.URL.Path == adminPath {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.statuses())
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	serviceID, err := io.ReadAll(req.Body)
+	if err != nil || len(serviceID) == 0 {
+		http.Error(w, "Invalid ServiceID", http.StatusBadRequest)
+		return
+	}
+	if req.URL.Path == adminPath+"/regkey" {
+		// the body is a ServiceName rather than a ServiceID
+		if string(serviceID) == auth.Registry {
+			http.Error(w, "Service name is reserved", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(auth.RegistrationKey(utils.Regkey(), string(serviceID))))
+		return
+	}
+	reg, ok := r.lookup(string(serviceID))
+	if !ok {
+		http.Error(w, "Service not registered", http.StatusNotFound)
+		return
+	}
+
+	switch strings.TrimPrefix(req.URL.Path, adminPath) {
+	case "/evict":
+		log.Printf("Evicting service %s at URL: %s", reg.ServiceName, reg.ServiceURL)
+		err = r.remove(reg.key(), reg.ServiceURL)
+	case "/drain":
+		err = r.drain(reg.ServiceID)
+	case "/repush":
+		err = r.sendRequiredServices(reg)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// statuses lists all registrations ordered by namespace and service name, with their heartbeat and patch delivery status.
+func (r *registry) statuses() []ServiceStatus {
+	r.mutex.RLock()
+	var all []Registration
+	for _, registrations := range r.registrationsMap {
+		all = append(all, r.withInfo(registrations)...)
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Namespace != all[j].Namespace {
+			return all[i].Namespace < all[j].Namespace
+		}
+		if all[i].ServiceName != all[j].ServiceName {
+			return all[i].ServiceName < all[j].ServiceName
+		}
+		return all[i].ServiceURL < all[j].ServiceURL
+	})
+
+	r.heartbeatServer.Mutex.RLock()
+	defer r.heartbeatServer.Mutex.RUnlock()
+
+	now := r.now()
+	statuses := make([]ServiceStatus, 0, len(all))
+	for _, reg := range all {
+		status := ServiceStatus{Registration: reg, LastHeartbeat: r.heartbeatServer.LastHeartBeat[reg.ServiceID]}
+		status.HeartbeatAgeSeconds = now.Sub(status.LastHeartbeat).Seconds()
+		if delivery, ok := r.deliveries.get(reg.ServiceID); ok {
+			status.LastPatch = &delivery
+		}
+		if probe, ok := r.probes.get(reg.ServiceID); ok {
+			status.LastProbe = &probe
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// Admin is a client of the admin API of the registry, authorized by the admin key of the registry.
+type Admin struct {
+	Key string
+}
+
+// Services lists all registrations known to the registry.
+func (a Admin) Services() ([]ServiceStatus, error) {
+	res, err := a.do(http.MethodGet, "", "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var statuses []ServiceStatus
+	if err := json.NewDecoder(res.Body).Decode(&statuses); err != nil {
+		return nil, err
+	}
+	return statuses, nil
+}
+
+// Evict removes the registration with serviceID. A service that is still running registers again.
+func (a Admin) Evict(serviceID string) error {
+	return a.post("/evict", serviceID)
+}
+
+// Drain marks the registration with serviceID as draining.
+func (a Admin) Drain(serviceID string) error {
+	return a.post("/drain", serviceID)
+}
+
+// Repush pushes the current providers of its required services to the service with serviceID.
+func (a Admin) Repush(serviceID string) error {
+	return a.post("/repush", serviceID)
+}
+
+// RegistrationKey returns the key services register as serviceName with.
+func (a Admin) RegistrationKey(serviceName ServiceName) (string, error) {
+	res, err := a.do(http.MethodPost, "/regkey", string(serviceName))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	key, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+func (a Admin) post(path, serviceID string) error {
+	res, err := a.do(http.MethodPost, path, serviceID)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func (a Admin) do(method, path, body string) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	header.Set("Authorization", "Bearer "+a.Key)
+
+	res, err := endpoints.do(method, adminPath+path, []byte(body), header)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("registry responded with status code %v: %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return res, nil
+}
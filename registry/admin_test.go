@@ -0,0 +1,148 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-distributed/registry/auth"
+	"go-distributed/registry/heartbeat"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdmin(t *testing.T) {
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	service.UseAdminKey("secret")
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	// the web service accepts patches, the shell service cannot be reached
+	updates := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer updates.Close()
+	web := Registration{ServiceName: WebService, ServiceURL: "http://10.0.0.2:80", ServiceUpdateURL: updates.URL, RequiredServices: []ServiceName{NodeService}}
+	shell := Registration{ServiceName: ShellService, ServiceURL: "http://10.0.0.3:80", ServiceUpdateURL: "http://127.0.0.1:1/services", RequiredServices: []ServiceName{NodeService}}
+	node := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80", Tags: []string{"premium"}}
+	for _, reg := range []*Registration{&web, &shell, &node} {
+		if err := RegisterRequest(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := (Admin{Key: "wrong"}).Services(); err == nil {
+		t.Fatal("expected a wrong admin key to be rejected")
+	}
+
+	admin := Admin{Key: "secret"}
+	if err := admin.Repush(web.ServiceID); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Repush(shell.ServiceID); err == nil {
+		t.Error("expected re-pushing to an unreachable service to fail")
+	}
+
+	statuses, err := admin.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := map[string]ServiceStatus{}
+	for _, s := range statuses {
+		byID[s.ServiceID] = s
+	}
+	if len(byID) != 3 {
+		t.Fatalf("expected 3 registrations, got %+v", statuses)
+	}
+	if s := byID[node.ServiceID]; s.LastHeartbeat.IsZero() || s.HeartbeatAgeSeconds > 5 || len(s.Tags) != 1 || s.LastPatch != nil {
+		t.Errorf("unexpected node status %+v", s)
+	}
+	if s := byID[web.ServiceID]; s.LastPatch == nil || s.LastPatch.Error != "" {
+		t.Errorf("expected a delivered patch to the web service, got %+v", s.LastPatch)
+	}
+	if s := byID[shell.ServiceID]; s.LastPatch == nil || s.LastPatch.Error == "" || s.LastPatch.Failures < 1 {
+		t.Errorf("expected failed patches to the shell service, got %+v", s.LastPatch)
+	}
+
+	if err := admin.Drain(node.ServiceID); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Evict(shell.ServiceID); err != nil {
+		t.Fatal(err)
+	}
+	statuses, err = admin.Services()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 {
+		t.Fatalf("expected the shell service to be evicted, got %+v", statuses)
+	}
+	for _, s := range statuses {
+		if s.ServiceID == node.ServiceID && !s.Draining {
+			t.Error("expected the node to be draining")
+		}
+	}
+	if err := admin.Evict(shell.ServiceID); err == nil {
+		t.Error("expected evicting an unknown service to fail")
+	}
+}
+
+func TestRegistrationKeys(t *testing.T) {
+	t.Setenv("regkey", "registry secret")
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	service.UseAdminKey("secret")
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	admin := Admin{Key: "secret"}
+	nodeKey, err := admin.RegistrationKey(NodeService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	webKey, err := admin.RegistrationKey(WebService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeKey == webKey || nodeKey == "registry secret" {
+		t.Fatalf("expected a key of its own for each service name, got %s and %s", nodeKey, webKey)
+	}
+	if _, err := admin.RegistrationKey(auth.Registry); err == nil {
+		t.Error("expected no key for the name the registry signs as")
+	}
+
+	register := func(name ServiceName, key string) int {
+		t.Helper()
+		body, _ := json.Marshal(Registration{ServiceName: name, ServiceURL: "http://10.0.0.1:80"})
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/services", bytes.NewReader(body))
+		req.Header.Set("regkey", key)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// a node holding its own key cannot get the token of the web service
+	if status := register(WebService, nodeKey); status != http.StatusUnauthorized {
+		t.Errorf("expected a node key to be refused for the web service, got %v", status)
+	}
+	if status := register(WebService, "registry secret"); status != http.StatusUnauthorized {
+		t.Errorf("expected the registry secret to be refused as a key, got %v", status)
+	}
+	if status := register(auth.Registry, auth.RegistrationKey("registry secret", auth.Registry)); status != http.StatusForbidden {
+		t.Errorf("expected registering as the registry to be refused, got %v", status)
+	}
+	if status := register(NodeService, nodeKey); status != http.StatusOK {
+		t.Errorf("expected a node to register with its key, got %v", status)
+	}
+}
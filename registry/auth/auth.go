@@ -0,0 +1,251 @@
+// Package auth issues and verifies the credentials services use to authenticate to each other.
+// The registry signs a token for every registration with Ed25519; everyone else verifies tokens
+// with the public keys the registry publishes, so no shared secret is needed past registration.
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// TokenTTL is how long a service token is valid. Services renew their token well before it expires.
+var TokenTTL = time.Hour
+
+// Registry is the ServiceName in the tokens the registry signs its own requests with, e.g. patches.
+const Registry = "Registry"
+
+// RegistrationKey returns the key a service registers as serviceName with, derived from secret, the regkey
+// of the registry. Each service name has its own key, so a service can only register under its own name.
+// Without a secret there is no key, and registration is open.
+func RegistrationKey(secret, serviceName string) string {
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("register:" + serviceName))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Claims identify the service a token was issued to.
+type Claims struct {
+	ServiceName string `json:"svc"`
+	ServiceID   string `json:"sid,omitempty"`
+	// BodyHash binds a short-lived token to the body of a single request
+	BodyHash string `json:"bh,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// BodyHash returns the hash of a request body as carried in Claims.BodyHash.
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+type signingKey struct {
+	id  string
+	key ed25519.PrivateKey
+}
+
+// Keyring holds the signing keys of the registry. The first key signs, the others still verify,
+// so keys can be rotated by putting a new key first and dropping the old one once the tokens it
+// signed have expired.
+type Keyring struct {
+	path    string
+	modTime time.Time
+	keys    []signingKey
+	mutex   sync.RWMutex
+}
+
+// LoadKeyring reads the keys in path, one per line as "<key id> <base64 32-byte seed>", e.g. a seed
+// from `openssl rand -base64 32`. Without a path a key is generated, which lives as long as the process.
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if path == "" {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		k.keys = []signingKey{{id: fmt.Sprintf("ephemeral-%d", time.Now().Unix()), key: ed25519.NewKeyFromSeed(seed)}}
+		return k, nil
+	}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadOrCreateKeyring loads the keys in path like LoadKeyring, first writing a new key there if the file
+// does not exist, so a standalone registry keeps signing with the same key across restarts.
+func LoadOrCreateKeyring(path string) (*Keyring, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		line := fmt.Sprintf("k%d %s\n", time.Now().Unix(), base64.StdEncoding.EncodeToString(seed))
+		if err := os.WriteFile(path, []byte(line), 0600); err != nil {
+			return nil, err
+		}
+		log.Printf("Created signing key in %s", path)
+	} else if err != nil {
+		return nil, err
+	}
+	return LoadKeyring(path)
+}
+
+// Reload reads the key file again if it changed.
+func (k *Keyring) Reload() error {
+	if k.path == "" {
+		return nil
+	}
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+
+	k.mutex.RLock()
+	unchanged := info.ModTime().Equal(k.modTime)
+	k.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseKeys(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", k.path, err)
+	}
+
+	k.mutex.Lock()
+	k.keys = keys
+	k.modTime = info.ModTime()
+	k.mutex.Unlock()
+	log.Printf("Loaded %d signing keys, signing with %s", len(keys), keys[0].id)
+	return nil
+}
+
+// Watch reloads the key file every interval until stop is closed.
+func (k *Keyring) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := k.Reload(); err != nil {
+				log.Println("Failed to reload signing keys:", err)
+			}
+		}
+	}
+}
+
+func parseKeys(data []byte) ([]signingKey, error) {
+	var keys []signingKey
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("expected \"<key id> <seed>\", got %q", line)
+		}
+		seed, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("key %s: seed must be %d base64 encoded bytes", fields[0], ed25519.SeedSize)
+		}
+		keys = append(keys, signingKey{id: fields[0], key: ed25519.NewKeyFromSeed(seed)})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signing keys")
+	}
+	return keys, nil
+}
+
+// Sign returns a token for claims signed with the current key. The token expires after ttl.
+func (k *Keyring) Sign(claims Claims, ttl time.Duration) (string, error) {
+	k.mutex.RLock()
+	current := k.keys[0]
+	k.mutex.RUnlock()
+
+	now := time.Now()
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = current.id
+	return token.SignedString(current.key)
+}
+
+// Expiry returns when token expires, without verifying it. Services use it to renew their own token in time.
+func Expiry(token string) (time.Time, error) {
+	var claims Claims
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return time.Time{}, err
+	}
+	if claims.ExpiresAt == nil {
+		return time.Time{}, fmt.Errorf("token does not expire")
+	}
+	return claims.ExpiresAt.Time, nil
+}
+
+// KeySet returns the public keys of the keyring.
+func (k *Keyring) KeySet() KeySet {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+
+	set := make(KeySet, len(k.keys))
+	for _, key := range k.keys {
+		set[key.id] = key.key.Public().(ed25519.PublicKey)
+	}
+	return set
+}
+
+// KeySet maps key ids to the public keys verifying the tokens they signed.
+// It marshals to JSON as base64 encoded keys.
+type KeySet map[string]ed25519.PublicKey
+
+// ErrUnknownKey is returned by Verify for a token signed by a key missing from the key set,
+// which usually means the key set has to be fetched again after a rotation.
+var ErrUnknownKey = fmt.Errorf("token signed by an unknown key")
+
+// Verify checks the signature and expiry of token and returns its claims.
+func (s KeySet) Verify(token string) (*Claims, error) {
+	var claims Claims
+	_, err := jwt.ParseWithClaims(token, &claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := s[kid]
+		if !ok {
+			return nil, ErrUnknownKey
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodEdDSA.Alg()}), jwt.WithLeeway(time.Minute), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func keyLine(t *testing.T, id string) string {
+	seed := make([]byte, 32)
+	if _, err := rand.Read(seed); err != nil {
+		t.Fatal(err)
+	}
+	return id + " " + base64.StdEncoding.EncodeToString(seed) + "\n"
+}
+
+func TestKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	oldKey, newKey := keyLine(t, "old"), keyLine(t, "new")
+	if err := os.WriteFile(path, []byte(oldKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, err := k.Sign(Claims{ServiceName: "NodeService", ServiceID: "node-1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// put the new key first, the old one still verifies the tokens it signed
+	if err := os.WriteFile(path, []byte(newKey+oldKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if err := k.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := k.KeySet().Verify(oldToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.ServiceName != "NodeService" || claims.ServiceID != "node-1" {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	newToken, _ := k.Sign(Claims{ServiceName: "NodeService"}, time.Hour)
+	if _, err := k.KeySet().Verify(newToken); err != nil {
+		t.Fatal(err)
+	}
+
+	// once the old key is dropped its tokens are rejected
+	if err := os.WriteFile(path, []byte(newKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	if err := k.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.KeySet().Verify(oldToken); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	k, err := LoadKeyring("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, _ := k.Sign(Claims{ServiceName: "WebService"}, -2*time.Minute)
+	if _, err := k.KeySet().Verify(expired); err == nil {
+		t.Error("expected an expired token to be rejected")
+	}
+
+	other, _ := LoadKeyring("")
+	forged, _ := other.Sign(Claims{ServiceName: "WebService"}, time.Hour)
+	// same key id, different key
+	forgedSet := KeySet{}
+	for id := range other.KeySet() {
+		for _, key := range k.KeySet() {
+			forgedSet[id] = key
+		}
+	}
+	if _, err := forgedSet.Verify(forged); err == nil {
+		t.Error("expected a token with a bad signature to be rejected")
+	}
+}
+
+func TestLoadOrCreateKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "signing.keys")
+	k, err := LoadOrCreateKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := k.Sign(Claims{ServiceName: "NodeService"}, time.Hour)
+
+	// a restart signs with the same key, so the tokens it issued stay valid
+	restarted, err := LoadOrCreateKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restarted.KeySet().Verify(token); err != nil {
+		t.Errorf("expected the key to survive restarts, got %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the key file to be readable by the registry only, got %v %v", info, err)
+	}
+}
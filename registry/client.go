@@ -8,6 +8,7 @@ import (
 	"go-distributed/utils"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"sync"
@@ -17,33 +18,38 @@ import (
 func RegisterRequest(r *Registration) error {
 	buf := new(bytes.Buffer)
 	enc := json.NewEncoder(buf)
+	// r may be self, which Drain and SetMetadata change under selfMutex
+	selfMutex.Lock()
 	err := enc.Encode(r)
+	selfMutex.Unlock()
 
 	if err != nil {
 		return err
 	}
 
-	res, err := http.NewRequest(http.MethodPost, ServerURL, buf)
-	if err != nil {
-		return err
-	}
-
-	regkey := utils.Regkey()
-	res.Header.Add("Content-Type", "application/json")
-	res.Header.Add("regkey", regkey)
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("regkey", utils.Regkey())
 
-	log.Println("Registering service at " + ServerURL)
+	log.Printf("Registering service at %v", Endpoints())
 	for {
-		resp, err := http.DefaultClient.Do(res)
+		resp, err := endpoints.do(http.MethodPost, "/services", buf.Bytes(), header)
 		if err == nil && resp.StatusCode == http.StatusOK {
 			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
 			if err != nil {
 				return err
 			}
+			selfMutex.Lock()
 			r.ServiceID = string(body)
-			log.Printf("Service registered with ID: %s\n", r.ServiceID)
+			selfMutex.Unlock()
+			creds.setToken(resp.Header.Get(tokenHeader))
+			log.Printf("Service registered with ID: %s\n", body)
 			break
 		}
+		if err == nil {
+			resp.Body.Close()
+		}
 		log.Println("Failed to register service. Retry after 3 seconds...")
 		time.Sleep(3 * time.Second)
 	}
@@ -51,6 +57,16 @@ func RegisterRequest(r *Registration) error {
 	return nil
 }
 
+// CollectServerInfo, when set before RegisterService, is called for every heartbeat and its result
+// reported to the registry as the telemetry of the service.
+var CollectServerInfo func() (heartbeat.ServerInfo, error)
+
+// deregistered is closed once the service deregistered itself, which ends its heartbeats.
+var (
+	deregistered     = make(chan struct{})
+	deregisteredOnce sync.Once
+)
+
 func RegisterService(r *Registration) error {
 	serviceUpdatedURL, err := url.Parse(r.ServiceUpdateURL)
 	if err != nil {
@@ -61,40 +77,94 @@ func RegisterService(r *Registration) error {
 	log.Println("Service URL: ", r.ServiceURL)
 	http.Handle(serviceUpdatedURL.Path, &serviceUpdateHandler{})
 
+	if r.Namespace == "" {
+		r.Namespace = Namespace
+	}
+	for key, value := range Metadata {
+		if _, ok := r.Metadata[key]; !ok {
+			if r.Metadata == nil {
+				r.Metadata = map[string]string{}
+			}
+			r.Metadata[key] = value
+		}
+	}
+	selfMutex.Lock()
+	self = r
+	selfMutex.Unlock()
+
 	err = RegisterRequest(r)
 	if err != nil {
 		log.Println("Failed to register service: ", err)
 	}
+	if err := renewCertificate(r); err != nil {
+		log.Println("Failed to get certificate: ", err)
+	}
+
+	// keep the cached providers of the required services in sync with the registry
+	required := resolve(r.RequiredServices, r.Namespace)
+	go Prov.watch(required)
+	go Prov.antiEntropy(required)
 
-	interval := 3 * time.Second
+	interval, _ := r.heartbeatPolicy()
 
-	registryHeartbeatURL := "http://" + ServerIP + ":" + ServerPort + "/heartbeat/"
+	// heartbeats fail over between the registry replicas like every other registry request
+	var registryHeartbeatURLs []string
+	for _, endpoint := range Endpoints() {
+		registryHeartbeatURLs = append(registryHeartbeatURLs, endpoint+"/heartbeat/")
+	}
 
-	hb := heartbeat.BasicHeartbeat{
-		ServiceID: r.ServiceID,
-		URL:       registryHeartbeatURL,
+	hb := &heartbeat.InfoHeartbeat{
+		BasicHeartbeat: heartbeat.BasicHeartbeat{
+			ServiceID: r.ServiceID,
+			URLs:      registryHeartbeatURLs,
+		},
+		Collect: CollectServerInfo,
+	}
+	// services reporting telemetry send info heartbeats, the others basic ones
+	var strategy heartbeat.HeartbeatStrategy = &hb.BasicHeartbeat
+	if CollectServerInfo != nil {
+		strategy = hb
 	}
 
 	go func() {
 		for {
 			// log.Println("Sending heartbeat to registry service at " + registryHeartbeatURL)
-			err = hb.SendHeartbeat()
+			start := time.Now()
+			err = strategy.SendHeartbeat()
+			heartbeatDuration.Observe(time.Since(start).Seconds())
 			if err != nil {
+				heartbeatFailures.Inc()
 				log.Printf("Failed to send heartbeat: %v\n", err)
 				// register service again if returns 401 Unauthorized
 				log.Println("error " + err.Error())
 				if err.Error() == "Service not authorized" {
-					time.Sleep(interval)
+					select {
+					case <-deregistered:
+						return
+					case <-time.After(interval):
+					}
 					log.Println("Re-registering service...")
-					Prov.services = make(map[ServiceName][]Registration) // clear all cached providers
+					Prov.requestResync() // the registry lost our registration, so the cache may be stale too
 					err = RegisterRequest(r)
 					if err != nil {
 						log.Printf("Failed to re-register service: %v\n", err)
 					}
 					hb.ServiceID = r.ServiceID
 				}
+			} else {
+				drainedByRegistry(hb.Draining)
+			}
+			if err := renewToken(); err != nil {
+				log.Printf("Failed to renew token: %v\n", err)
+			}
+			if err := renewCertificate(r); err != nil {
+				log.Printf("Failed to renew certificate: %v\n", err)
+			}
+			select {
+			case <-deregistered:
+				return
+			case <-time.After(interval):
 			}
-			time.Sleep(interval)
 			// log.Printf("Sent heartbeat to registry service at %s\n", registryHeartbeatURL)
 		}
 	}()
@@ -105,42 +175,63 @@ func RegisterService(r *Registration) error {
 type serviceUpdateHandler struct{}
 
 func (s *serviceUpdateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// only accept request from registry service
-	if r.Header.Get("regkey") != utils.Regkey() {
-		w.WriteHeader(http.StatusUnauthorized)
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
 	}
 
-	if r.Method != http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// only accept patches signed by the registry service
+	if err := verifyBody(r, body); err != nil {
+		log.Println("Rejected patch:", err)
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	dec := json.NewDecoder(r.Body)
 	var p patch
-	err := dec.Decode(&p)
+	err = json.Unmarshal(body, &p)
 	if err != nil {
 		log.Println(err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	fmt.Println("Received patch: ", p)
+	slog.Debug("Received patch", "added", len(p.Added), "removed", len(p.Removed))
 	Prov.Update(p)
 }
 
-func ShutdownService(url string) error {
-	req, err := http.NewRequest(http.MethodDelete, ServerURL, bytes.NewBuffer([]byte(url)))
-	if err != nil {
-		return err
+// ServiceID returns the ID the registry assigned to this process, or "" before it registered.
+func ServiceID() string {
+	selfMutex.Lock()
+	defer selfMutex.Unlock()
+	if self != nil {
+		return self.ServiceID
+	}
+	return ""
+}
+
+func ShutdownService(serviceName ServiceName, serviceURL string) error {
+	// stop the heartbeats first, so they do not register the service again
+	selfMutex.Lock()
+	if self != nil && self.ServiceURL == serviceURL {
+		deregisteredOnce.Do(func() { close(deregistered) })
 	}
+	selfMutex.Unlock()
 
-	req.Header.Add("Content-Type", "text/plain")
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	header.Set("Authorization", "Bearer "+Token())
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := endpoints.do(http.MethodDelete, "/services?serviceName="+url.QueryEscape(string(serviceName)), []byte(serviceURL), header)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != http.StatusOK {
 		return fmt.Errorf("failed to deregister service. Registry service responded with status code %v", res.StatusCode)
@@ -151,53 +242,82 @@ func ShutdownService(url string) error {
 
 type providers struct {
 	services map[ServiceName][]Registration
+	resync   chan struct{}
 	mutex    *sync.RWMutex
 }
 
+// Update applies a patch to the cache. Patches may arrive more than once, from the registry push
+// and from the watch, so registrations are keyed by ServiceID and applying a patch is idempotent.
+// Besides under their own name, registrations are cached under every required reference with a
+// selector they match.
 func (p *providers) Update(patch patch) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
 	for _, reg := range patch.Added {
-		if _, ok := p.services[reg.ServiceName]; !ok {
-			p.services[reg.ServiceName] = make([]Registration, 0)
+		for ref := range p.services {
+			if key, selector, err := splitSelector(ref); err == nil && len(selector) > 0 && key == reg.key() && selector.Matches(reg) {
+				p.services[ref] = append(without(p.services[ref], reg.ServiceID), reg)
+			}
 		}
-		p.services[reg.ServiceName] = append(p.services[reg.ServiceName], reg)
+		p.services[reg.key()] = append(without(p.services[reg.key()], reg.ServiceID), reg)
 	}
 
 	for _, reg := range patch.Removed {
 		log.Println("Removing service: ", reg.ServiceName, reg.ServiceID)
-		if _, ok := p.services[reg.ServiceName]; !ok {
-			continue
-		}
-		for i, r := range p.services[reg.ServiceName] {
-			log.Println("Compare service ID: ", r.ServiceID, reg.ServiceID)
-			if r.ServiceID == reg.ServiceID {
-				p.services[reg.ServiceName] = append(p.services[reg.ServiceName][:i], p.services[reg.ServiceName][i+1:]...)
-				break
+		for ref, regs := range p.services {
+			if key, _, _ := splitSelector(ref); key == reg.key() {
+				p.services[ref] = without(regs, reg.ServiceID)
 			}
 		}
 	}
 }
 
+// without returns regs without the registration with serviceID.
+func without(regs []Registration, serviceID string) []Registration {
+	kept := make([]Registration, 0, len(regs)+1)
+	for _, r := range regs {
+		if r.ServiceID != serviceID {
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
 func (p *providers) get(name ServiceName) ([]Registration, error) {
 
 	regs, ok := p.services[name]
-	if !ok {
+	if !ok || len(regs) == 0 {
 		return nil, fmt.Errorf("service %v not found", name)
 	}
 
 	return regs, nil
 }
 
+// GetProviders returns the cached providers of name, which is resolved in the namespace of this service.
 func GetProviders(name ServiceName) ([]Registration, error) {
+	key := name.In(localNamespace())
 	Prov.mutex.RLock()
 	defer Prov.mutex.RUnlock()
 
-	return Prov.get(name)
+	return Prov.get(key)
+}
+
+// FetchProviders queries the registry for the providers of name, bypassing the cache. Unlike the
+// cached providers, the result carries the latest telemetry of each provider.
+func FetchProviders(name ServiceName) ([]Registration, error) {
+	regs, _, err := fetch(name.In(localNamespace()), true)
+	if err != nil {
+		return nil, err
+	}
+	if len(regs) == 0 {
+		return nil, fmt.Errorf("service %v not found", name)
+	}
+	return regs, nil
 }
 
 var Prov = providers{
 	services: make(map[ServiceName][]Registration),
+	resync:   make(chan struct{}, 1),
 	mutex:    new(sync.RWMutex),
 }
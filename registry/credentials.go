@@ -0,0 +1,233 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-distributed/registry/auth"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tokenHeader = "X-Registry-Token"
+
+// patchTokenTTL bounds how long a signed patch can be replayed.
+const patchTokenTTL = time.Minute
+
+// issueToken signs the credentials of a registration.
+func (r *registry) issueToken(reg Registration) (string, error) {
+	return r.keyring.Sign(auth.Claims{ServiceName: string(reg.ServiceName), ServiceID: reg.ServiceID}, auth.TokenTTL)
+}
+
+// authenticate verifies the bearer token of req against the keys of the registry.
+func (r *registry) authenticate(req *http.Request) (*auth.Claims, error) {
+	token, ok := bearer(req)
+	if !ok {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+	return r.keyring.KeySet().Verify(token)
+}
+
+func (r *registry) handleKeys(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(r.keyring.KeySet())
+}
+
+// handleToken renews the token of a service that is still registered.
+func (r *registry) handleToken(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	reg, ok := r.lookup(claims.ServiceID)
+	if !ok {
+		http.Error(w, "Service not registered", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := r.issueToken(reg)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(tokenHeader, token)
+	w.WriteHeader(http.StatusOK)
+}
+
+// lookup returns the registration with serviceID.
+func (r *registry) lookup(serviceID string) (Registration, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for _, registrations := range r.registrationsMap {
+		for _, registration := range registrations {
+			if registration.ServiceID == serviceID {
+				return registration, true
+			}
+		}
+	}
+	return Registration{}, false
+}
+
+func bearer(req *http.Request) (string, bool) {
+	return strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+}
+
+// credentials are the token of this service and the keys verifying the tokens of the others.
+type credentials struct {
+	token       string
+	expires     time.Time
+	mutex       sync.Mutex
+	keys        auth.KeySet
+	keysFetched time.Time
+	keysMutex   sync.Mutex
+}
+
+var creds credentials
+
+// keysRefreshInterval is how often the key set is fetched again.
+var keysRefreshInterval = 5 * time.Minute
+
+// minKeysRefetchInterval limits the fetches triggered by tokens signed with an unknown key.
+const minKeysRefetchInterval = 10 * time.Second
+
+func (c *credentials) setToken(token string) {
+	expires, err := auth.Expiry(token)
+	if err != nil {
+		log.Println("Registry issued an unreadable token:", err)
+		return
+	}
+
+	c.mutex.Lock()
+	c.token = token
+	c.expires = expires
+	c.mutex.Unlock()
+}
+
+// Token returns the token the registry issued to this service.
+func Token() string {
+	creds.mutex.Lock()
+	defer creds.mutex.Unlock()
+	return creds.token
+}
+
+// Authorize adds the token of this service to req.
+func Authorize(req *http.Request) {
+	if token := Token(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// renewToken fetches a new token once the current one is halfway to expiry.
+func renewToken() error {
+	creds.mutex.Lock()
+	token, expires := creds.token, creds.expires
+	creds.mutex.Unlock()
+
+	if token == "" || time.Until(expires) > auth.TokenTTL/2 {
+		return nil
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+token)
+	res, err := endpoints.do(http.MethodPost, "/services/token", nil, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to renew token. Registry service responded with status code %v", res.StatusCode)
+	}
+	creds.setToken(res.Header.Get(tokenHeader))
+	return nil
+}
+
+// keySet returns the public keys of the registry, fetching them if they are stale or refresh is set.
+func keySet(refresh bool) (auth.KeySet, error) {
+	creds.keysMutex.Lock()
+	defer creds.keysMutex.Unlock()
+
+	age := time.Since(creds.keysFetched)
+	if creds.keys != nil && age < keysRefreshInterval && (!refresh || age < minKeysRefetchInterval) {
+		return creds.keys, nil
+	}
+
+	res, err := endpoints.do(http.MethodGet, "/services/keys", nil, nil)
+	if err != nil {
+		if creds.keys != nil {
+			return creds.keys, nil
+		}
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var keys auth.KeySet
+	if err := json.NewDecoder(res.Body).Decode(&keys); err != nil {
+		return nil, err
+	}
+	creds.keys = keys
+	creds.keysFetched = time.Now()
+	return keys, nil
+}
+
+// Verify authenticates a request signed by another service and returns its claims. The token must have
+// been issued to one of from.
+func Verify(req *http.Request, from ...ServiceName) (*auth.Claims, error) {
+	token, ok := bearer(req)
+	if !ok {
+		return nil, fmt.Errorf("missing bearer token")
+	}
+
+	keys, err := keySet(false)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := keys.Verify(token)
+	if errors.Is(err, auth.ErrUnknownKey) {
+		// the registry may have rotated its keys
+		if keys, err = keySet(true); err != nil {
+			return nil, err
+		}
+		claims, err = keys.Verify(token)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range from {
+		if ServiceName(claims.ServiceName) == name {
+			return claims, nil
+		}
+	}
+	return nil, fmt.Errorf("token of %s is not accepted here", claims.ServiceName)
+}
+
+// verifyBody authenticates a request from the registry whose token is bound to body.
+func verifyBody(req *http.Request, body []byte) error {
+	claims, err := Verify(req, ServiceName(auth.Registry))
+	if err != nil {
+		return err
+	}
+	if claims.BodyHash != auth.BodyHash(body) {
+		return fmt.Errorf("token does not match the request body")
+	}
+	return nil
+}
+
+// bodyToken returns a short-lived registry token bound to body.
+func (r *registry) bodyToken(body []byte) (string, error) {
+	return r.keyring.Sign(auth.Claims{ServiceName: auth.Registry, BodyHash: auth.BodyHash(body)}, patchTokenTTL)
+}
@@ -0,0 +1,167 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Anti-entropy: every service periodically compares a digest of its cached providers with the
+// digest the registry computes from GET /services/digest?serviceName=X, and fetches the full list
+// of a service through GET /services?serviceName=X when they differ.
+
+var antiEntropyInterval = 30 * time.Second
+
+type digestResponse struct {
+	Revision uint64                 `json:"revision"`
+	Digests  map[ServiceName]string `json:"digests"`
+}
+
+// digest returns a hash of the set of registrations, independent of their order.
+func digest(regs []Registration) string {
+	keys := make([]string, 0, len(regs))
+	for _, r := range regs {
+		key := r.ServiceID + "\x00" + r.ServiceURL
+		if r.Draining {
+			key += "\x00draining"
+		}
+		if !r.Healthy() {
+			key += "\x00" + string(r.Health)
+		}
+		for _, k := range slices.Sorted(maps.Keys(r.Metadata)) {
+			key += "\x00" + k + "=" + r.Metadata[k]
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(k))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (r *registry) handleDigest(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	names := req.URL.Query()["serviceName"]
+	if len(names) == 0 {
+		http.Error(w, "Service name is required", http.StatusBadRequest)
+		return
+	}
+
+	r.mutex.RLock()
+	resp := digestResponse{Revision: r.index, Digests: make(map[ServiceName]string)}
+	for _, name := range names {
+		key, selector, err := splitSelector(ServiceName(name).In(req.URL.Query().Get("namespace")))
+		if err != nil {
+			continue
+		}
+		resp.Digests[ServiceName(name)] = digest(selector.filter(r.registrationsMap[key]))
+	}
+	r.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Println(err)
+	}
+}
+
+// SyncStats counts the anti-entropy checks of this service's provider cache.
+type SyncStats struct {
+	Checks  uint64 // digest exchanges with the registry
+	Drifts  uint64 // service names whose cached providers differed from the registry
+	Resyncs uint64 // full lists fetched to repair a drift
+	Errors  uint64 // failed digest exchanges or fetches
+}
+
+var syncStats struct {
+	checks, drifts, resyncs, errors atomic.Uint64
+}
+
+// GetSyncStats returns how often the provider cache was checked and found to have drifted.
+func GetSyncStats() SyncStats {
+	return SyncStats{
+		Checks:  syncStats.checks.Load(),
+		Drifts:  syncStats.drifts.Load(),
+		Resyncs: syncStats.resyncs.Load(),
+		Errors:  syncStats.errors.Load(),
+	}
+}
+
+// antiEntropy periodically verifies the cached providers of names against the registry.
+func (p *providers) antiEntropy(names []ServiceName) {
+	if len(names) == 0 {
+		return
+	}
+
+	for {
+		time.Sleep(antiEntropyInterval)
+
+		if err := p.checkDigests(names); err != nil {
+			syncStats.errors.Add(1)
+			log.Println("Failed to verify cached providers:", err)
+		}
+	}
+}
+
+// checkDigests compares the cached providers of names with the registry and fetches the
+// full lists of the ones that differ.
+func (p *providers) checkDigests(names []ServiceName) error {
+	query := url.Values{}
+	for _, name := range names {
+		query.Add("serviceName", string(name))
+	}
+
+	resp, err := endpoints.do(http.MethodGet, "/services/digest?"+query.Encode(), nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("registry responded with status code %v", resp.StatusCode)
+	}
+
+	var remote digestResponse
+	if err := json.NewDecoder(resp.Body).Decode(&remote); err != nil {
+		return err
+	}
+	syncStats.checks.Add(1)
+
+	var drifted []ServiceName
+	p.mutex.RLock()
+	for _, name := range names {
+		if digest(p.services[name]) != remote.Digests[name] {
+			drifted = append(drifted, name)
+		}
+	}
+	p.mutex.RUnlock()
+
+	if len(drifted) == 0 {
+		return nil
+	}
+
+	syncStats.drifts.Add(uint64(len(drifted)))
+	log.Printf("Cached providers of %v differ from the registry at revision %d, fetching them again", drifted, remote.Revision)
+
+	if _, err := p.fetchAll(drifted); err != nil {
+		return err
+	}
+	syncStats.resyncs.Add(uint64(len(drifted)))
+	return nil
+}
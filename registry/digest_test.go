@@ -0,0 +1,50 @@
+package registry
+
+import (
+	"go-distributed/registry/heartbeat"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestAntiEntropyRepairsDrift(t *testing.T) {
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	node := Registration{ServiceName: NodeService, ServiceURL: "http://127.0.0.1:1", ServiceID: "node-1"}
+	if err := service.reg.add(node); err != nil {
+		t.Fatal(err)
+	}
+
+	// a cache that missed the registration and holds a duplicate of a stale one
+	stale := Registration{ServiceName: NodeService, ServiceURL: "http://127.0.0.1:2", ServiceID: "node-0"}
+	p := providers{services: make(map[ServiceName][]Registration), resync: make(chan struct{}, 1), mutex: new(sync.RWMutex)}
+	p.Update(patch{Added: []Registration{stale}})
+	p.Update(patch{Added: []Registration{stale}})
+	if regs, _ := p.get(NodeService); len(regs) != 1 {
+		t.Fatalf("expected duplicate patches to be applied once, got %v", regs)
+	}
+
+	before := GetSyncStats()
+	if err := p.checkDigests([]ServiceName{NodeService}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkDigests([]ServiceName{NodeService}); err != nil {
+		t.Fatal(err)
+	}
+	after := GetSyncStats()
+
+	if after.Checks-before.Checks != 2 || after.Drifts-before.Drifts != 1 || after.Resyncs-before.Resyncs != 1 {
+		t.Errorf("expected 2 checks with 1 drift repaired, got %+v -> %+v", before, after)
+	}
+	if regs, _ := p.get(NodeService); len(regs) != 1 || regs[0].ServiceID != "node-1" {
+		t.Errorf("expected the cache to match the registry, got %v", regs)
+	}
+}
@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// drain marks the registration with serviceID as draining. It stays listed, flagged, until it is removed.
+func (r *registry) drain(serviceID string) error {
+	registration, err := r.update(serviceID, func(registration *Registration) error {
+		registration.Draining = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Service %s at URL %s is draining", registration.ServiceName, registration.ServiceURL)
+	return nil
+}
+
+// update applies change to the registration with serviceID and pushes the result to its consumers,
+// unless change fails.
+// Updates are serialized from the read to the commit, so concurrent changes to a registration, e.g. a
+// drain and a metadata patch, are not lost. mutex cannot be held instead, as applying the commit takes it.
+func (r *registry) update(serviceID string, change func(*Registration) error) (Registration, error) {
+	r.updates.Lock()
+	defer r.updates.Unlock()
+
+	registration, ok := r.lookup(serviceID)
+	if !ok {
+		return Registration{}, fmt.Errorf("service %s not found", serviceID)
+	}
+	if err := change(&registration); err != nil {
+		return Registration{}, err
+	}
+
+	if _, err := r.commit(Event{Op: opUpdate, Registration: registration, Time: r.now()}); err != nil {
+		return Registration{}, err
+	}
+
+	// clients replace the cached registration with the same ServiceID
+	r.notify(patch{
+		Added: []Registration{registration},
+	})
+	return registration, nil
+}
+
+func (r *registry) handleDrain(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	serviceID, err := io.ReadAll(req.Body)
+	if err != nil || len(serviceID) == 0 {
+		http.Error(w, "Invalid ServiceID", http.StatusBadRequest)
+		return
+	}
+	// a service may only drain itself
+	if claims.ServiceID != string(serviceID) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := r.drain(string(serviceID)); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+var (
+	self      *Registration // the registration of this process, set by RegisterService
+	selfMutex sync.Mutex
+)
+
+// OnDrain is called when the registry lists this service as draining though the service did not drain
+// itself, e.g. after regctl drain. Nodes set it to start their own drain.
+var OnDrain func()
+
+// drainedByRegistry marks this service as draining once its heartbeats report that the registry lists it
+// so, and calls OnDrain.
+func drainedByRegistry(draining bool) {
+	if !draining {
+		return
+	}
+	selfMutex.Lock()
+	drained := self != nil && !self.Draining
+	if drained {
+		self.Draining = true
+	}
+	selfMutex.Unlock()
+
+	if drained {
+		log.Println("Registry lists this service as draining")
+		if OnDrain != nil {
+			OnDrain()
+		}
+	}
+}
+
+// Drain marks the registration of this service as draining, so that clients stop giving it new work.
+// The service keeps sending heartbeats, and registers as draining if it has to register again.
+func Drain() error {
+	selfMutex.Lock()
+	r := self
+	var serviceID string
+	if r != nil {
+		r.Draining = true
+		serviceID = r.ServiceID
+	}
+	selfMutex.Unlock()
+	if r == nil {
+		return fmt.Errorf("service is not registered")
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain")
+	header.Set("Authorization", "Bearer "+Token())
+
+	res, err := endpoints.do(http.MethodPost, "/services/drain", []byte(serviceID), header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to drain service. Registry service responded with status code %v", res.StatusCode)
+	}
+	return nil
+}
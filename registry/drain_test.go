@@ -0,0 +1,162 @@
+package registry
+
+import (
+	"fmt"
+	"go-distributed/registry/heartbeat"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDrain(t *testing.T) {
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	node := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80"}
+	if err := RegisterRequest(&node); err != nil {
+		t.Fatal(err)
+	}
+	before := digest(service.reg.registrationsMap[NodeService])
+
+	selfMutex.Lock()
+	self = &node
+	selfMutex.Unlock()
+	defer func() {
+		selfMutex.Lock()
+		self = nil
+		selfMutex.Unlock()
+	}()
+
+	if err := Drain(); err != nil {
+		t.Fatal(err)
+	}
+
+	regs, err := FetchProviders(NodeService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regs) != 1 || !regs[0].Draining || regs[0].ServiceID != node.ServiceID {
+		t.Fatalf("expected the node to be listed as draining, got %+v", regs)
+	}
+	if !service.reg.IsServiceRegistered(node.ServiceID) {
+		t.Error("expected a draining node to keep sending heartbeats")
+	}
+	if digest(regs) == before {
+		t.Error("expected draining to change the digest, so anti-entropy repairs a missed drain")
+	}
+}
+
+func TestDrainedByRegistry(t *testing.T) {
+	HBServer := heartbeat.NewHeartBeatServer()
+	service, err := NewRegistryService(HBServer, memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/heartbeat/", HBServer)
+	mux.Handle("/services", service)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	node := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80"}
+	if err := RegisterRequest(&node); err != nil {
+		t.Fatal(err)
+	}
+	selfMutex.Lock()
+	self = &node
+	selfMutex.Unlock()
+	drains := 0
+	OnDrain = func() { drains++ }
+	defer func() {
+		selfMutex.Lock()
+		self = nil
+		selfMutex.Unlock()
+		OnDrain = nil
+	}()
+
+	hb := &heartbeat.BasicHeartbeat{ServiceID: node.ServiceID, URLs: []string{server.URL + "/heartbeat/"}}
+	if err := hb.SendHeartbeat(); err != nil || hb.Draining {
+		t.Fatalf("expected the heartbeat of a registered node to pass, got %v and draining %v", err, hb.Draining)
+	}
+
+	// an operator drains the node, which learns of it with its next heartbeats
+	if err := service.reg.drain(node.ServiceID); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := hb.SendHeartbeat(); err != nil || !hb.Draining {
+			t.Fatalf("expected the heartbeat to report the drain, got %v and draining %v", err, hb.Draining)
+		}
+		drainedByRegistry(hb.Draining)
+	}
+	if drains != 1 {
+		t.Errorf("expected the service to drain once, got %d", drains)
+	}
+	selfMutex.Lock()
+	draining := self.Draining
+	selfMutex.Unlock()
+	if !draining {
+		t.Error("expected the service to register as draining if it has to register again")
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	node := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80", ServiceID: "node-1"}
+	if err := service.reg.add(node); err != nil {
+		t.Fatal(err)
+	}
+
+	// every change is kept, none is overwritten by an update that read the registration before it
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := service.reg.update(node.ServiceID, func(registration *Registration) error {
+				time.Sleep(time.Millisecond) // let the other updates read the registration meanwhile
+				metadata := maps.Clone(registration.Metadata)
+				if metadata == nil {
+					metadata = map[string]string{}
+				}
+				metadata[fmt.Sprint("key", i)] = "value"
+				registration.Metadata = metadata
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := service.reg.drain(node.ServiceID); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	registration, _ := service.reg.lookup(node.ServiceID)
+	if len(registration.Metadata) != 20 || !registration.Draining {
+		t.Errorf("expected every concurrent change to be kept, got %+v", registration)
+	}
+}
@@ -0,0 +1,142 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// requestTimeout bounds each request to a registry replica, reading the response included, so a
+// replica that accepts the connection but never answers is failed over like one that is down.
+var requestTimeout = 10 * time.Second
+
+// endpointList holds the base URLs of the registry replicas. Requests go to the replica that
+// answered last and fail over to the next one when it is unreachable or unavailable.
+type endpointList struct {
+	urls    []string
+	current int
+	mutex   sync.Mutex
+}
+
+var endpoints = &endpointList{}
+
+// registryClient keeps the headers of a request when a follower redirects it to the leader,
+// including the Authorization header net/http drops on redirects to another host.
+var registryClient = &http.Client{
+	Transport: serviceTransport,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return fmt.Errorf("stopped after 10 redirects")
+		}
+		for k, v := range via[0].Header {
+			if _, ok := req.Header[k]; !ok {
+				req.Header[k] = v
+			}
+		}
+		return nil
+	},
+}
+
+// SetEndpoints sets the registry replicas used by this service, given as host:port or base URL.
+func SetEndpoints(urls ...string) {
+	normalized := make([]string, 0, len(urls))
+	for _, u := range urls {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			if TLSEnabled() {
+				u = "https://" + u
+			} else {
+				u = "http://" + u
+			}
+		}
+		normalized = append(normalized, strings.TrimSuffix(u, "/"))
+	}
+
+	endpoints.mutex.Lock()
+	defer endpoints.mutex.Unlock()
+
+	endpoints.urls = normalized
+	endpoints.current = 0
+}
+
+// Endpoints returns the registry replicas, starting with the one that answered last.
+func Endpoints() []string {
+	endpoints.mutex.Lock()
+	defer endpoints.mutex.Unlock()
+
+	return append(append([]string(nil), endpoints.urls[endpoints.current:]...), endpoints.urls[:endpoints.current]...)
+}
+
+// do sends a request to path on the registry replicas in turn until one answers without a server error.
+func (l *endpointList) do(method, path string, body []byte, header http.Header) (*http.Response, error) {
+	return l.doWithin(requestTimeout, method, path, body, header)
+}
+
+// doWithin is do with each request bounded by timeout rather than requestTimeout.
+func (l *endpointList) doWithin(timeout time.Duration, method, path string, body []byte, header http.Header) (*http.Response, error) {
+	l.mutex.Lock()
+	urls := l.urls
+	start := l.current
+	l.mutex.Unlock()
+
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no registry endpoints configured")
+	}
+
+	var lastErr error
+	for i := range urls {
+		idx := (start + i) % len(urls)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		req, err := http.NewRequestWithContext(ctx, method, urls[idx]+path, bytes.NewReader(body))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		resp, err := registryClient.Do(req)
+		if err != nil {
+			cancel()
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			resp.Body.Close()
+			cancel()
+			lastErr = fmt.Errorf("registry %s responded with status code %v", urls[idx], resp.StatusCode)
+			continue
+		}
+
+		l.mutex.Lock()
+		l.current = idx
+		l.mutex.Unlock()
+		// the caller reads the body within the deadline, which ends once it closes the body
+		resp.Body = cancelBody{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// cancelBody cancels the context of a request when its response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
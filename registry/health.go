@@ -0,0 +1,138 @@
+package registry
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Health is the liveness of a registration as judged by the registry from its heartbeats and health checks.
+type Health string
+
+const (
+	Healthy Health = "healthy"
+	// Suspect services missed heartbeats. They stay registered until their TTL expires, but should
+	// not be given new work.
+	Suspect Health = "suspect"
+	// Unhealthy services send heartbeats but fail their health check. They stay registered and
+	// should not be given new work until the health check passes again.
+	Unhealthy Health = "unhealthy"
+)
+
+var (
+	DefaultHeartbeatInterval = 3 * time.Second
+	DefaultHeartbeatTTL      = 20 * time.Second
+	MinHeartbeatInterval     = 500 * time.Millisecond
+	// SweepInterval is how often the registry checks the heartbeats of all services.
+	SweepInterval = time.Second
+)
+
+// heartbeatPolicy returns how often r sends heartbeats and how long the registry keeps r without one.
+func (r Registration) heartbeatPolicy() (interval, ttl time.Duration) {
+	interval, ttl = r.HeartbeatInterval, r.HeartbeatTTL
+	if interval == 0 {
+		interval = DefaultHeartbeatInterval
+	}
+	if ttl == 0 {
+		ttl = max(DefaultHeartbeatTTL, 2*interval)
+	}
+	return interval, ttl
+}
+
+// suspectAfter returns how old the last heartbeat of r may be before r is suspect: two missed
+// heartbeats, but at most half its TTL.
+func (r Registration) suspectAfter() time.Duration {
+	interval, ttl := r.heartbeatPolicy()
+	return min(2*interval, ttl/2)
+}
+
+// validatePolicy rejects heartbeat policies the registry cannot enforce.
+func (r Registration) validatePolicy() error {
+	if r.HeartbeatInterval < 0 || r.HeartbeatTTL < 0 {
+		return fmt.Errorf("negative heartbeat interval or TTL")
+	}
+	interval, ttl := r.heartbeatPolicy()
+	if interval < MinHeartbeatInterval {
+		return fmt.Errorf("heartbeat interval must be at least %v", MinHeartbeatInterval)
+	}
+	if ttl < 2*interval {
+		return fmt.Errorf("heartbeat TTL must be at least twice the heartbeat interval")
+	}
+	return nil
+}
+
+// Healthy reports whether the registry judges r healthy. Registrations stored before the registry
+// tracked health have none and count as healthy.
+func (r Registration) Healthy() bool {
+	return r.Health == "" || r.Health == Healthy
+}
+
+// Available reports whether r should be given new work, i.e. it is healthy and not draining.
+func (r Registration) Available() bool {
+	return !r.Draining && r.Healthy()
+}
+
+// sweep evicts services whose last heartbeat is older than their TTL and updates the health of the
+// others: services missing heartbeats are suspect, services failing their health check unhealthy.
+// It starts the health checks that are due.
+func (reg *registry) sweep() {
+	reg.mutex.RLock()
+	var registrations []Registration
+	for _, regs := range reg.registrationsMap {
+		registrations = append(registrations, regs...)
+	}
+	reg.mutex.RUnlock()
+
+	lastHeartBeat := make(map[string]time.Time, len(registrations))
+	reg.heartbeatServer.Mutex.RLock()
+	for _, registration := range registrations {
+		lastHeartBeat[registration.ServiceID] = reg.heartbeatServer.LastHeartBeat[registration.ServiceID]
+	}
+	reg.heartbeatServer.Mutex.RUnlock()
+
+	now := reg.now()
+	for _, registration := range registrations {
+		age := now.Sub(lastHeartBeat[registration.ServiceID])
+		_, ttl := registration.heartbeatPolicy()
+		if age > ttl {
+			log.Printf("Removing inactive service %s at URL: %s", registration.ServiceName, registration.ServiceURL)
+			if err := reg.remove(registration.key(), registration.ServiceURL); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+
+		health := Healthy
+		if age > registration.suspectAfter() {
+			health = Suspect
+		} else if reg.probes.failing(registration) {
+			health = Unhealthy
+		}
+		if health == registration.Health || (health == Healthy && registration.Healthy()) {
+			continue
+		}
+
+		switch health {
+		case Suspect:
+			log.Printf("Service %s at URL %s missed heartbeats, last one %v ago", registration.ServiceName, registration.ServiceURL, age.Round(time.Millisecond))
+		case Unhealthy:
+			status, _ := reg.probes.get(registration.ServiceID)
+			log.Printf("Service %s at URL %s failed its health check: %s", registration.ServiceName, registration.ServiceURL, status.Error)
+		default:
+			log.Printf("Service %s at URL %s is healthy again", registration.ServiceName, registration.ServiceURL)
+		}
+		if err := reg.setHealth(registration.ServiceID, health); err != nil {
+			log.Println(err)
+		}
+	}
+
+	reg.probeDue(registrations)
+}
+
+func (r *registry) setHealth(serviceID string, health Health) error {
+	_, err := r.update(serviceID, func(registration *Registration) error {
+		registration.Health = health
+		return nil
+	})
+	return err
+}
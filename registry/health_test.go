@@ -0,0 +1,154 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-distributed/registry/heartbeat"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestHeartbeatPolicy(t *testing.T) {
+	// the test sweeps itself
+	defer func(interval time.Duration) { SweepInterval = interval }(SweepInterval)
+	SweepInterval = time.Hour
+
+	clock := &fakeClock{now: time.Now()}
+	HBServer := heartbeat.NewHeartBeatServer()
+	HBServer.Now = clock.Now
+	service, err := NewRegistryService(HBServer, memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/heartbeat/", HBServer)
+	mux.Handle("/services", service)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	fast := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80", HeartbeatInterval: time.Second, HeartbeatTTL: 10 * time.Second}
+	slow := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.2:80"}
+	for _, reg := range []*Registration{&fast, &slow} {
+		if err := RegisterRequest(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	health := func() map[string]Health {
+		t.Helper()
+		regs, err := FetchProviders(NodeService)
+		if err != nil {
+			t.Fatal(err)
+		}
+		health := map[string]Health{}
+		for _, reg := range regs {
+			health[reg.ServiceID] = reg.Health
+		}
+		return health
+	}
+
+	clock.Advance(1500 * time.Millisecond)
+	service.reg.sweep()
+	if h := health(); h[fast.ServiceID] != Healthy || h[slow.ServiceID] != Healthy {
+		t.Fatalf("expected both services to be healthy after one missed heartbeat, got %v", h)
+	}
+
+	// two missed heartbeats make the fast service suspect, the default policy tolerates more
+	clock.Advance(time.Second)
+	service.reg.sweep()
+	if h := health(); h[fast.ServiceID] != Suspect || h[slow.ServiceID] != Healthy {
+		t.Fatalf("expected only the fast service to be suspect, got %v", h)
+	}
+
+	hb := &heartbeat.BasicHeartbeat{ServiceID: fast.ServiceID, URLs: []string{server.URL + "/heartbeat/"}}
+	if err := hb.SendHeartbeat(); err != nil {
+		t.Fatal(err)
+	}
+	service.reg.sweep()
+	if h := health(); h[fast.ServiceID] != Healthy {
+		t.Fatalf("expected a heartbeat to clear the suspicion, got %v", h)
+	}
+
+	clock.Advance(10500 * time.Millisecond)
+	service.reg.sweep()
+	h := health()
+	if _, ok := h[fast.ServiceID]; ok {
+		t.Errorf("expected the fast service to be evicted after its TTL, got %v", h)
+	}
+	if h[slow.ServiceID] != Suspect {
+		t.Errorf("expected the slow service to be suspect, got %v", h)
+	}
+
+	clock.Advance(10 * time.Second)
+	service.reg.sweep()
+	if _, err := FetchProviders(NodeService); err == nil {
+		t.Error("expected the slow service to be evicted after the default TTL")
+	}
+}
+
+func TestHeartbeatPolicyValidation(t *testing.T) {
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	for _, reg := range []Registration{
+		{HeartbeatInterval: 100 * time.Millisecond},
+		{HeartbeatInterval: 5 * time.Second, HeartbeatTTL: 8 * time.Second},
+		{HeartbeatTTL: -time.Second},
+	} {
+		reg.ServiceName, reg.ServiceURL = NodeService, "http://10.0.0.1:80"
+		body, _ := json.Marshal(reg)
+		res, err := http.Post(server.URL+"/services", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected interval %v and TTL %v to be rejected, got status %v", reg.HeartbeatInterval, reg.HeartbeatTTL, res.StatusCode)
+		}
+	}
+}
+
+func TestPickerSkipsSuspects(t *testing.T) {
+	p := NewPicker(NodeService, RoundRobin)
+	p.Source = func() ([]Registration, error) {
+		return []Registration{{ServiceID: "a", Health: Suspect}, {ServiceID: "b", Health: Healthy}}, nil
+	}
+	for i := 0; i < 4; i++ {
+		reg, done, err := p.Pick("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done(nil)
+		if reg.ServiceID != "b" {
+			t.Fatalf("expected the suspect provider to be skipped, got %s", reg.ServiceID)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthCheck tells the registry how to probe a service: with a GET of Path on the ServiceURL,
+// expecting a 2xx response, or by connecting to TCPPort on the host of the ServiceURL.
+type HealthCheck struct {
+	Path     string        `json:",omitempty"`
+	TCPPort  int           `json:",omitempty"`
+	Interval time.Duration `json:",omitempty"` // 10s by default
+	Timeout  time.Duration `json:",omitempty"` // 2s by default, at most half the interval
+	// FailureThreshold is the number of failed probes in a row that make the service Unhealthy, 3 by default
+	FailureThreshold int `json:",omitempty"`
+}
+
+func (c HealthCheck) withDefaults() HealthCheck {
+	if c.Interval == 0 {
+		c.Interval = 10 * time.Second
+	}
+	if c.Timeout == 0 {
+		c.Timeout = min(2*time.Second, c.Interval/2)
+	}
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = 3
+	}
+	return c
+}
+
+// validateHealthCheck rejects health checks the registry cannot run.
+func (r Registration) validateHealthCheck() error {
+	if r.HealthCheck == nil {
+		return nil
+	}
+	c := r.HealthCheck.withDefaults()
+	if (c.Path == "") == (c.TCPPort == 0) {
+		return fmt.Errorf("health check needs either a path or a TCP port")
+	}
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("health check path must start with /")
+	}
+	if c.TCPPort < 0 || c.TCPPort > 65535 {
+		return fmt.Errorf("invalid health check port %d", c.TCPPort)
+	}
+	if c.Interval < time.Second || c.Timeout <= 0 || c.Timeout >= c.Interval || c.FailureThreshold < 0 {
+		return fmt.Errorf("health check interval must be at least 1s and longer than the timeout")
+	}
+	return nil
+}
+
+// prober runs the health checks of the services and keeps their outcomes.
+type prober struct {
+	*outcomes
+	due   map[string]time.Time // when the next probe of each service is due
+	mutex sync.Mutex
+}
+
+func (p *prober) forget(removed []Registration) {
+	p.outcomes.forget(removed)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, reg := range removed {
+		delete(p.due, reg.ServiceID)
+	}
+}
+
+// failing reports whether the health check of reg failed often enough to make it Unhealthy.
+func (p *prober) failing(reg Registration) bool {
+	if reg.HealthCheck == nil {
+		return false
+	}
+	status, ok := p.get(reg.ServiceID)
+	return ok && status.Failures >= reg.HealthCheck.withDefaults().FailureThreshold
+}
+
+// probeDue starts the health checks of registrations that are due. Their outcome is taken into
+// account by the next sweep.
+func (r *registry) probeDue(registrations []Registration) {
+	now := r.now()
+
+	r.probes.mutex.Lock()
+	defer r.probes.mutex.Unlock()
+
+	for _, reg := range registrations {
+		if reg.HealthCheck == nil || now.Before(r.probes.due[reg.ServiceID]) {
+			continue
+		}
+		check := reg.HealthCheck.withDefaults()
+		r.probes.due[reg.ServiceID] = now.Add(check.Interval)
+		go func(reg Registration) {
+			r.probes.record(reg.ServiceID, r.probe(reg.ServiceURL, check))
+		}(reg)
+	}
+}
+
+// probe runs check against the service at serviceURL.
+func (r *registry) probe(serviceURL string, check HealthCheck) error {
+	ctx, cancel := context.WithTimeout(context.Background(), check.Timeout)
+	defer cancel()
+
+	if check.TCPPort != 0 {
+		u, err := url.Parse(serviceURL)
+		if err != nil {
+			return err
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), strconv.Itoa(check.TCPPort)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, serviceURL+check.Path, nil)
+	if err != nil {
+		return err
+	}
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("health check responded with status code %v", res.StatusCode)
+	}
+	return nil
+}
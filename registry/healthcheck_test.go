@@ -0,0 +1,142 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-distributed/registry/heartbeat"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	defer func(interval time.Duration) { SweepInterval = interval }(SweepInterval)
+	SweepInterval = time.Hour
+
+	clock := &fakeClock{now: time.Now()}
+	HBServer := heartbeat.NewHeartBeatServer()
+	HBServer.Now = clock.Now
+	service, err := NewRegistryService(HBServer, memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/heartbeat/", HBServer)
+	mux.Handle("/services", service)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer target.Close()
+
+	// nothing listens on the port of the TCP check
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	web := Registration{ServiceName: WebService, ServiceURL: target.URL, HealthCheck: &HealthCheck{Path: "/healthz", Interval: time.Second, FailureThreshold: 2}}
+	log := Registration{ServiceName: LogService, ServiceURL: "http://127.0.0.1:1", HealthCheck: &HealthCheck{TCPPort: closedPort, Interval: time.Second, FailureThreshold: 1}}
+	for _, reg := range []*Registration{&web, &log} {
+		if err := RegisterRequest(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// round advances the clock past the probe interval, keeps the heartbeats fresh, runs the due
+	// probes and returns the resulting health of the services
+	round := func() map[string]Health {
+		t.Helper()
+		clock.Advance(1100 * time.Millisecond)
+		for _, reg := range []Registration{web, log} {
+			hb := &heartbeat.BasicHeartbeat{ServiceID: reg.ServiceID, URLs: []string{server.URL + "/heartbeat/"}}
+			if err := hb.SendHeartbeat(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		service.reg.sweep()
+		deadline := time.Now().Add(5 * time.Second)
+		for _, reg := range []Registration{web, log} {
+			for {
+				if probe, ok := service.reg.probes.get(reg.ServiceID); ok && probe.Time.Equal(clock.Now()) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("probe of %s did not finish", reg.ServiceName)
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		service.reg.sweep()
+
+		health := map[string]Health{}
+		for _, s := range service.reg.statuses() {
+			health[s.ServiceID] = s.Health
+		}
+		return health
+	}
+
+	if h := round(); h[web.ServiceID] != Healthy || h[log.ServiceID] != Unhealthy {
+		t.Fatalf("expected the web service healthy and the unreachable log service unhealthy, got %v", h)
+	}
+
+	status.Store(http.StatusServiceUnavailable)
+	if h := round(); h[web.ServiceID] != Healthy {
+		t.Fatalf("expected a single failed probe to be tolerated, got %v", h)
+	}
+	if h := round(); h[web.ServiceID] != Unhealthy {
+		t.Fatalf("expected the web service to be unhealthy after two failed probes, got %v", h)
+	}
+	if regs, _ := FetchProviders(WebService); len(regs) != 1 || regs[0].Available() {
+		t.Errorf("expected the unhealthy web service to be listed as unavailable, got %+v", regs)
+	}
+
+	status.Store(http.StatusOK)
+	if h := round(); h[web.ServiceID] != Healthy {
+		t.Fatalf("expected the web service to recover, got %v", h)
+	}
+}
+
+func TestHealthCheckValidation(t *testing.T) {
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	for _, check := range []HealthCheck{
+		{},
+		{Path: "/healthz", TCPPort: 443},
+		{Path: "healthz"},
+		{TCPPort: 443, Interval: 2 * time.Second, Timeout: 3 * time.Second},
+	} {
+		reg := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80", HealthCheck: &check}
+		body, _ := json.Marshal(reg)
+		res, err := http.Post(server.URL+"/services", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected health check %+v to be rejected, got status %v", check, res.StatusCode)
+		}
+	}
+}
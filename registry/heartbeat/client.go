@@ -1,73 +1,105 @@
 package heartbeat
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
-	"strings"
+	"time"
 )
 
 type BasicHeartbeat struct {
 	ServiceID string
-	URL       string
+	URLs      []string // heartbeat URLs of the registry replicas, tried in turn
+	// Draining is set when the registry answered the last heartbeat listing the service as draining
+	Draining bool
+	current  int
 }
 
 func (b *BasicHeartbeat) SendHeartbeat() error {
-	// fmt.Println("Sending heartbeat to registry")
-	res, err := http.Post(b.URL+"basic", "application/json", strings.NewReader(b.ServiceID))
+	body := []byte(b.ServiceID)
+	return b.failover(func(url string) error {
+		return b.post(url+"basic", body)
+	})
+}
+
+// failover calls send with each heartbeat URL in turn until one accepts the heartbeat.
+func (b *BasicHeartbeat) failover(send func(url string) error) error {
+	var err error
+	for i := range b.URLs {
+		idx := (b.current + i) % len(b.URLs)
+		err = send(b.URLs[idx])
+		if err == nil || err.Error() == "Service not authorized" {
+			b.current = idx
+			return err
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no registry heartbeat URL configured")
+	}
+	return err
+}
+
+// Client sends the heartbeats. The registry client replaces it when mutual TLS is enabled.
+var Client = http.DefaultClient
+
+// requestTimeout bounds a heartbeat to one replica, so a replica that never answers is failed over.
+const requestTimeout = 5 * time.Second
+
+func (b *BasicHeartbeat) post(url string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := Client.Do(req)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
 		if res.StatusCode == http.StatusUnauthorized {
-			fmt.Println("Service not authorized")
 			return fmt.Errorf("Service not authorized")
 		}
 
 		return fmt.Errorf("failed to send heartbeat. Registry service responed with status code %v", res.StatusCode)
 	}
-	// fmt.Println("Heartbeat sent")
+	b.Draining = res.Header.Get(DrainingHeader) == "true"
 	return nil
 }
 
-func NewBasicHeartbeat(url string) HeartbeatStrategy {
-	return &BasicHeartbeat{URL: url}
+func NewBasicHeartbeat(urls ...string) HeartbeatStrategy {
+	return &BasicHeartbeat{URLs: urls}
 }
 
-/*
-func GetCPUUsage() (string, error) {
-	return "10%", nil // TODO: Implement this
-}
-
-func GetMemUsage() (string, error) {
-	return "20%", nil // TODO: Implement this
+// InfoHeartbeat reports the telemetry returned by Collect with every heartbeat.
+type InfoHeartbeat struct {
+	BasicHeartbeat
+	Collect func() (ServerInfo, error)
 }
 
 func (i *InfoHeartbeat) SendHeartbeat() error {
-	CPUUsage, err := GetCPUUsage()
+	info, err := i.Collect()
 	if err != nil {
-		return err
+		// keep the registration alive even if the telemetry is unavailable
+		log.Println("Failed to collect server info:", err)
+		return i.BasicHeartbeat.SendHeartbeat()
 	}
-	MemUsage, err := GetMemUsage()
-	if err != nil {
-		return err
-	}
-	heartbeat := ServerInfo{
-		CPUUsage:    CPUUsage,
-		MemoryUsage: MemUsage,
-	}
-	var b bytes.Buffer
-	enc := json.NewEncoder(&b)
-	err = enc.Encode(heartbeat)
-	if err != nil {
-		return err
-	}
-	res, err := http.Post(i.url, "application/json", &b)
+	info.ServiceID = i.ServiceID
+
+	body, err := json.Marshal(info)
 	if err != nil {
 		return err
 	}
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("failed to send heartbeat. Registry service responed with status code %v", res.StatusCode)
-	}
-	return nil
+	return i.failover(func(url string) error {
+		return i.post(url+"info", body)
+	})
+}
+
+func NewInfoHeartbeat(collect func() (ServerInfo, error), urls ...string) HeartbeatStrategy {
+	return &InfoHeartbeat{BasicHeartbeat: BasicHeartbeat{URLs: urls}, Collect: collect}
 }
-*/
@@ -1,23 +1,27 @@
 package heartbeat
 
-import "log"
+import (
+	"log"
+	"time"
+)
 
 type HeartbeatStrategy interface {
 	SendHeartbeat() error
 }
 
-type InfoHeartbeat struct {
-	url string
-}
-
 type Heartbeat struct {
 	Strategy HeartbeatStrategy
 }
 
 type ServiceValidator interface {
 	IsServiceRegistered(serviceID string) bool
+	// IsServiceDraining reports whether the registration of serviceID is marked as draining
+	IsServiceDraining(serviceID string) bool
 }
 
+// DrainingHeader is set on the answer to the heartbeat of a service the registry lists as draining.
+const DrainingHeader = "X-Service-Draining"
+
 func (h *Heartbeat) Send() {
 	err := h.Strategy.SendHeartbeat()
 	if err != nil {
@@ -27,6 +31,11 @@ func (h *Heartbeat) Send() {
 
 // ServerInfo 代表服务器状态信息
 type ServerInfo struct {
-	CPUUsage    string `json:"cpu_usage"`
-	MemoryUsage string `json:"memory_usage"`
+	ServiceID      string    `json:"service_id"`
+	CPUUsage       float64   `json:"cpu_usage"`       // percent
+	MemoryUsage    float64   `json:"memory_usage"`    // percent
+	Connections    int       `json:"connections"`     // active proxy connections
+	Throughput     int64     `json:"throughput"`      // bytes per second over all connections
+	MonthlyTraffic int64     `json:"monthly_traffic"` // bytes used in the current traffic cycle
+	ReceivedAt     time.Time `json:"received_at"`     // set by the registry when the sample arrives
 }
@@ -1,6 +1,7 @@
 package heartbeat
 
 import (
+	"encoding/json"
 	"io"
 	"log"
 	"net/http"
@@ -15,19 +16,23 @@ type HeartBeatHandler interface {
 type HeartBeatServer struct {
 	HeartBeatTypeMap map[string]HeartBeatHandler
 	LastHeartBeat    map[string]time.Time
+	Info             map[string]ServerInfo // latest telemetry by ServiceID
 	Validator        ServiceValidator
 	Mutex            *sync.RWMutex
+	Now              func() time.Time // the clock heartbeats are recorded with, replaced in tests
 }
 
 func NewHeartBeatServer() *HeartBeatServer {
 	HeartBeatServer := &HeartBeatServer{
 		HeartBeatTypeMap: nil,
 		LastHeartBeat:    make(map[string]time.Time),
+		Info:             make(map[string]ServerInfo),
 		Mutex:            &sync.RWMutex{},
+		Now:              time.Now,
 	}
 	HeartBeatTypeMap := make(map[string]HeartBeatHandler)
 	HeartBeatTypeMap["/heartbeat/basic"] = &BasicHeartbeatHandler{BaseHeartBeatHandler{Server: HeartBeatServer}}
-	// HeartBeatTypeMap["/heartbeat/info"] = &ServerInfoHeartbeatHandler{BaseHeartBeatHandler{server: HeartBeatServer}}
+	HeartBeatTypeMap["/heartbeat/info"] = &ServerInfoHeartbeatHandler{BaseHeartBeatHandler{Server: HeartBeatServer}}
 	HeartBeatServer.HeartBeatTypeMap = HeartBeatTypeMap
 	return HeartBeatServer
 }
@@ -43,23 +48,35 @@ func (b *BaseHeartBeatHandler) HandleCommonLogic(w http.ResponseWriter, r *http.
 		log.Println("Invalid ServiceID:", ServiceID)
 		return
 	}
-	ServiceIDStr := string(ServiceID)
+	b.beat(w, string(ServiceID), nil)
+}
 
+// beat records a heartbeat of serviceID, and its telemetry if info is not nil.
+func (b *BaseHeartBeatHandler) beat(w http.ResponseWriter, serviceID string, info *ServerInfo) {
 	if b.Server.Validator == nil {
 		log.Println("No validator set for the heartbeat server")
 		http.Error(w, "No validator set for the heartbeat server", http.StatusInternalServerError)
 		return
 	}
 
-	if !b.Server.Validator.IsServiceRegistered(ServiceIDStr) {
+	if !b.Server.Validator.IsServiceRegistered(serviceID) {
 		http.Error(w, "Service not authorized", http.StatusUnauthorized)
 		return
 	}
 
+	now := b.Server.Now()
 	b.Server.Mutex.Lock()
-	b.Server.LastHeartBeat[ServiceIDStr] = time.Now()
+	b.Server.LastHeartBeat[serviceID] = now
+	if info != nil {
+		info.ReceivedAt = now
+		b.Server.Info[serviceID] = *info
+	}
 	b.Server.Mutex.Unlock()
 
+	// a service drained by the registry, e.g. by an operator, learns of it with its heartbeats
+	if b.Server.Validator.IsServiceDraining(serviceID) {
+		w.Header().Set(DrainingHeader, "true")
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -71,28 +88,19 @@ func (h *BasicHeartbeatHandler) HandleHeartbeat(w http.ResponseWriter, r *http.R
 	h.HandleCommonLogic(w, r)
 }
 
-/*
 type ServerInfoHeartbeatHandler struct {
 	BaseHeartBeatHandler
 }
 
 func (h *ServerInfoHeartbeatHandler) HandleHeartbeat(w http.ResponseWriter, r *http.Request) {
 	var info ServerInfo
-	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil || info.ServiceID == "" {
+		http.Error(w, "Invalid server info", http.StatusBadRequest)
 		return
 	}
 
-	srcAddr := r.RemoteAddr
-	h.server.mutex.Lock()
-	defer h.server.mutex.Unlock()
-
-	h.server.LastHeartBeat[srcAddr] = time.Now()
-
-	log.Printf("Received server info from %s: CPU Usage=%s, Memory Usage=%s", srcAddr, info.CPUUsage, info.MemoryUsage)
-
-	h.HandleCommonLogic(w, r)
-} */
+	h.beat(w, info.ServiceID, &info)
+}
 
 func (h *HeartBeatServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.Mutex.Lock()
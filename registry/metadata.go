@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+)
+
+// metadataUpdate is the body of POST /services/metadata.
+type metadataUpdate struct {
+	ServiceID string
+	Metadata  map[string]string
+}
+
+// errInvalidMetadata is returned by setMetadata for metadata a registration cannot have.
+var errInvalidMetadata = errors.New("invalid metadata")
+
+// setMetadata sets the keys of metadata in the metadata of the registration with serviceID, keeping
+// the others, and pushes the result to its consumers. The result is validated as a registration is.
+func (r *registry) setMetadata(serviceID string, metadata map[string]string) error {
+	registration, err := r.update(serviceID, func(registration *Registration) error {
+		// the lookup shares the map with the stored registration, so it is replaced rather than changed
+		updated := maps.Clone(registration.Metadata)
+		if updated == nil {
+			updated = map[string]string{}
+		}
+		maps.Copy(updated, metadata)
+		registration.Metadata = updated
+		if err := registration.validateMetadata(); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidMetadata, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Service %s at URL %s updated its metadata", registration.ServiceName, registration.ServiceURL)
+	return nil
+}
+
+func (r *registry) handleMetadata(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	claims, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var update metadataUpdate
+	if err := json.NewDecoder(req.Body).Decode(&update); err != nil || update.ServiceID == "" {
+		http.Error(w, "Invalid metadata update", http.StatusBadRequest)
+		return
+	}
+	// a service may only update itself
+	if claims.ServiceID != update.ServiceID {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := r.setMetadata(update.ServiceID, update.Metadata); errors.Is(err, errInvalidMetadata) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// SetMetadata sets the keys of metadata in the metadata of this service, e.g. to publish a new key.
+// The service registers with them if it has to register again.
+func SetMetadata(metadata map[string]string) error {
+	if err := (Registration{Metadata: metadata}).validateMetadata(); err != nil {
+		return err
+	}
+	selfMutex.Lock()
+	r := self
+	if r != nil {
+		updated := maps.Clone(r.Metadata)
+		if updated == nil {
+			updated = map[string]string{}
+		}
+		maps.Copy(updated, metadata)
+		r.Metadata = updated
+	}
+	selfMutex.Unlock()
+	if r == nil {
+		return fmt.Errorf("service is not registered")
+	}
+
+	body, err := json.Marshal(metadataUpdate{ServiceID: r.ServiceID, Metadata: metadata})
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("Authorization", "Bearer "+Token())
+
+	res, err := endpoints.do(http.MethodPost, "/services/metadata", body, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to update metadata. Registry service responded with status code %v", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"errors"
+	"go-distributed/registry/heartbeat"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSetMetadata(t *testing.T) {
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	node := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80", Metadata: map[string]string{"region": "eu", "key": "old"}}
+	if err := RegisterRequest(&node); err != nil {
+		t.Fatal(err)
+	}
+	before := digest(service.reg.registrationsMap[NodeService])
+
+	selfMutex.Lock()
+	self = &node
+	selfMutex.Unlock()
+	defer func() {
+		selfMutex.Lock()
+		self = nil
+		selfMutex.Unlock()
+	}()
+
+	if err := SetMetadata(map[string]string{"key": "new"}); err != nil {
+		t.Fatal(err)
+	}
+
+	regs, err := FetchProviders(NodeService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regs) != 1 || regs[0].Metadata["key"] != "new" || regs[0].Metadata["region"] != "eu" {
+		t.Fatalf("expected the key to be updated and the region kept, got %+v", regs)
+	}
+	if node.Metadata["key"] != "new" {
+		t.Error("expected the service to register with the new metadata if it has to register again")
+	}
+	if digest(regs) == before {
+		t.Error("expected the update to change the digest, so anti-entropy repairs a missed update")
+	}
+
+	// metadata selectors cannot refer to is rejected, as it is on registration
+	if err := SetMetadata(map[string]string{"tag": "netflix"}); err == nil || node.Metadata["tag"] != "" {
+		t.Errorf("expected a reserved key to be rejected, got %v and %+v", err, node.Metadata)
+	}
+	req, _ := http.NewRequest(http.MethodPost, server.URL+"/services/metadata", strings.NewReader(`{"ServiceID":"`+node.ServiceID+`","Metadata":{"a=b":"c"}}`))
+	req.Header.Set("Authorization", "Bearer "+Token())
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected %d for an invalid key, got %d", http.StatusBadRequest, res.StatusCode)
+	}
+	if err := service.reg.setMetadata(node.ServiceID, map[string]string{"tag": "x"}); !errors.Is(err, errInvalidMetadata) {
+		t.Errorf("expected the invalid metadata error, got %v", err)
+	}
+	if registration, _ := service.reg.lookup(node.ServiceID); registration.Metadata["a=b"] != "" || registration.Metadata["tag"] != "" {
+		t.Errorf("expected invalid metadata not to be saved, got %+v", registration.Metadata)
+	}
+}
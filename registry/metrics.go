@@ -0,0 +1,50 @@
+package registry
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// registry_registrations{service}: registrations held by the registry per service, keyed like
+	// the registry keys them, i.e. namespace/ServiceName outside the default namespace.
+	registrationsGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "registry_registrations",
+		Help: "Registrations held by the registry per service.",
+	}, []string{"service"})
+
+	// registry_patch_deliveries_total{result}: patches pushed to services, result is "success" or "failure".
+	patchDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "registry_patch_deliveries_total",
+		Help: "Patches pushed by the registry to services, by result.",
+	}, []string{"result"})
+
+	// registry_client_heartbeat_duration_seconds: how long heartbeats of this service to the registry take.
+	heartbeatDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "registry_client_heartbeat_duration_seconds",
+		Help:    "Duration of the heartbeats sent by this service to the registry.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// registry_client_heartbeat_failures_total: heartbeats of this service the registry did not accept.
+	heartbeatFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "registry_client_heartbeat_failures_total",
+		Help: "Heartbeats sent by this service that failed.",
+	})
+)
+
+// observeSize updates the registrations gauge of the service keyed by key. r.mutex must be held.
+func (r *registry) observeSize(key ServiceName) {
+	if n := len(r.registrationsMap[key]); n > 0 {
+		registrationsGauge.WithLabelValues(string(key)).Set(float64(n))
+	} else {
+		registrationsGauge.DeleteLabelValues(string(key))
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
@@ -0,0 +1,41 @@
+package registry
+
+import (
+	"go-distributed/registry/heartbeat"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	for i, url := range []string{"http://10.0.0.1:80", "http://10.0.0.2:80"} {
+		reg := Registration{ServiceName: NodeService, Namespace: "metrics", ServiceURL: url, ServiceID: string(rune('a' + i))}
+		if err := service.reg.add(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := testutil.ToFloat64(registrationsGauge.WithLabelValues("metrics/NodeService")); n != 2 {
+		t.Errorf("expected 2 registrations, got %v", n)
+	}
+	if err := service.reg.remove("metrics/NodeService", "http://10.0.0.1:80"); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.ToFloat64(registrationsGauge.WithLabelValues("metrics/NodeService")); n != 1 {
+		t.Errorf("expected 1 registration after the removal, got %v", n)
+	}
+
+	failures := testutil.ToFloat64(patchDeliveries.WithLabelValues("failure"))
+	unreachable := Registration{ServiceID: "unreachable", ServiceUpdateURL: "http://127.0.0.1:1/services"}
+	if err := service.reg.sendPatch(unreachable, patch{}); err == nil {
+		t.Fatal("expected the patch to an unreachable service to fail")
+	}
+	if n := testutil.ToFloat64(patchDeliveries.WithLabelValues("failure")); n != failures+1 {
+		t.Errorf("expected the failed delivery to be counted, got %v failures after %v", n, failures)
+	}
+}
@@ -0,0 +1,69 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Namespaces separate the services of environments sharing a registry, e.g. prod and staging.
+// The registry keys registrations by the qualified name namespace/ServiceName; services of the
+// default namespace keep their bare ServiceName, which is how registries before namespaces keyed them.
+// A bare name in RequiredServices or a query refers to the namespace of the caller, a qualified
+// one such as "staging/NodeService" to that namespace.
+
+// DefaultNamespace holds the services registered without a namespace.
+const DefaultNamespace = "default"
+
+// Namespace is the namespace services register in unless their registration names one, set with Registry_Namespace.
+var Namespace = DefaultNamespace
+
+// In resolves the reference n made from namespace to the name the registry keys its providers by.
+// A selector in n is kept.
+func (n ServiceName) In(namespace string) ServiceName {
+	name, selector, selected := strings.Cut(string(n), "?")
+	if ns, bare, ok := strings.Cut(name, "/"); ok {
+		namespace, name = ns, bare
+	}
+	if namespace != "" && namespace != DefaultNamespace {
+		name = namespace + "/" + name
+	}
+	if selected {
+		name += "?" + selector
+	}
+	return ServiceName(name)
+}
+
+// key returns the name the registry keys r by.
+func (r Registration) key() ServiceName {
+	return r.ServiceName.In(r.Namespace)
+}
+
+// validateNamespace rejects service names and namespaces that cannot be told apart once qualified.
+func (r Registration) validateNamespace() error {
+	if strings.Contains(string(r.ServiceName), "/") {
+		return fmt.Errorf("service name must not contain /")
+	}
+	if strings.Contains(r.Namespace, "/") {
+		return fmt.Errorf("namespace must not contain /")
+	}
+	return nil
+}
+
+// resolve returns the names the registry keys the providers of names by, resolved from namespace.
+func resolve(names []ServiceName, namespace string) []ServiceName {
+	resolved := make([]ServiceName, 0, len(names))
+	for _, name := range names {
+		resolved = append(resolved, name.In(namespace))
+	}
+	return resolved
+}
+
+// localNamespace returns the namespace this process registered in.
+func localNamespace() string {
+	selfMutex.Lock()
+	defer selfMutex.Unlock()
+	if self != nil {
+		return self.Namespace
+	}
+	return Namespace
+}
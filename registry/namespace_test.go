@@ -0,0 +1,116 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-distributed/registry/heartbeat"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServiceNameIn(t *testing.T) {
+	for _, c := range []struct {
+		name      ServiceName
+		namespace string
+		want      ServiceName
+	}{
+		{NodeService, "", NodeService},
+		{NodeService, DefaultNamespace, NodeService},
+		{NodeService, "prod", "prod/NodeService"},
+		{"staging/NodeService", "prod", "staging/NodeService"},
+		{"default/NodeService", "prod", NodeService},
+	} {
+		if got := c.name.In(c.namespace); got != c.want {
+			t.Errorf("%q in %q: expected %q, got %q", c.name, c.namespace, c.want, got)
+		}
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	server := httptest.NewServer(service)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	var mutex sync.Mutex
+	received := map[string]bool{}
+	updates := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p patch
+		json.NewDecoder(r.Body).Decode(&p)
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, reg := range p.Added {
+			received[reg.ServiceURL] = true
+		}
+	}))
+	defer updates.Close()
+
+	// the prod web service needs the prod nodes and the log service of staging
+	web := Registration{ServiceName: WebService, Namespace: "prod", ServiceURL: "http://10.0.0.1:80", ServiceUpdateURL: updates.URL,
+		RequiredServices: []ServiceName{NodeService, "staging/LogService"}}
+	prodNode := Registration{ServiceName: NodeService, Namespace: "prod", ServiceURL: "http://10.0.1.1:80"}
+	stagingNode := Registration{ServiceName: NodeService, Namespace: "staging", ServiceURL: "http://10.0.2.1:80"}
+	defaultNode := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.3.1:80"}
+	stagingLog := Registration{ServiceName: LogService, Namespace: "staging", ServiceURL: "http://10.0.2.2:80"}
+	for _, reg := range []*Registration{&web, &prodNode, &stagingNode, &defaultNode, &stagingLog} {
+		if err := RegisterRequest(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		done := received[prodNode.ServiceURL] && received[stagingLog.ServiceURL]
+		mutex.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the prod node and the staging log service to be pushed to the web service")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mutex.Lock()
+	if received[stagingNode.ServiceURL] || received[defaultNode.ServiceURL] {
+		t.Errorf("expected nodes of other namespaces not to be pushed, got %v", received)
+	}
+	mutex.Unlock()
+
+	for namespace, want := range map[string]string{"": defaultNode.ServiceURL, "staging": stagingNode.ServiceURL, "prod": prodNode.ServiceURL} {
+		res, err := http.Get(server.URL + "/services?serviceName=NodeService&namespace=" + namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var regs []Registration
+		json.NewDecoder(res.Body).Decode(&regs)
+		res.Body.Close()
+		if len(regs) != 1 || regs[0].ServiceURL != want {
+			t.Errorf("expected the node of namespace %q, got %+v", namespace, regs)
+		}
+	}
+
+	// the cache keys providers by their qualified name
+	p := providers{services: make(map[ServiceName][]Registration), resync: make(chan struct{}, 1), mutex: new(sync.RWMutex)}
+	p.Update(patch{Added: []Registration{prodNode, stagingNode}})
+	if regs, _ := p.get(NodeService.In("prod")); len(regs) != 1 || regs[0].ServiceURL != prodNode.ServiceURL {
+		t.Errorf("expected the cached prod node, got %+v", regs)
+	}
+
+	body, _ := json.Marshal(Registration{ServiceName: "prod/NodeService", ServiceURL: "http://10.0.4.1:80"})
+	res, err := http.Post(server.URL+"/services", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected a qualified service name to be rejected, got %v", res.StatusCode)
+	}
+}
@@ -0,0 +1,171 @@
+package registry
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Strategy selects how a Picker chooses among the providers of a service.
+type Strategy int
+
+const (
+	RoundRobin       Strategy = iota // cycle through the providers
+	Random                           // pick a provider at random
+	LeastOutstanding                 // pick the provider with the fewest requests in flight
+	ConsistentHash                   // always pick the same provider for the same key while it is available
+)
+
+// Picker selects a provider of a service for each request and tracks the health of the providers
+// passively: a provider failing MaxFailures requests in a row is ejected for CoolDown, then
+// admitted again. Providers the registry judges unhealthy are skipped as well. When every provider
+// is ejected or unhealthy the Picker falls back to all of them.
+type Picker struct {
+	Strategy    Strategy
+	MaxFailures int
+	CoolDown    time.Duration
+	// Source returns the current providers, by default the cached providers of the service.
+	Source func() ([]Registration, error)
+
+	now    func() time.Time
+	next   int
+	health map[string]*providerHealth // by ServiceID
+	mutex  sync.Mutex
+}
+
+type providerHealth struct {
+	failures     int
+	outstanding  int
+	ejectedUntil time.Time
+}
+
+// NewPicker returns a Picker for the providers of name.
+func NewPicker(name ServiceName, strategy Strategy) *Picker {
+	return &Picker{
+		Strategy:    strategy,
+		MaxFailures: 3,
+		CoolDown:    30 * time.Second,
+		Source: func() ([]Registration, error) {
+			return GetProviders(name)
+		},
+		now:    time.Now,
+		health: make(map[string]*providerHealth),
+	}
+}
+
+// Pick returns a provider for a request. key is only used by ConsistentHash. The caller must call
+// done with the outcome of the request, which feeds the health tracking.
+func (p *Picker) Pick(key string) (Registration, func(err error), error) {
+	regs, err := p.Source()
+	if err != nil {
+		return Registration{}, nil, err
+	}
+	if len(regs) == 0 {
+		return Registration{}, nil, fmt.Errorf("no providers available")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	candidates := p.healthy(regs)
+	if len(candidates) == 0 {
+		candidates = regs
+	}
+
+	var reg Registration
+	switch p.Strategy {
+	case Random:
+		reg = candidates[rand.Intn(len(candidates))]
+
+	case LeastOutstanding:
+		reg = candidates[0]
+		for _, c := range candidates[1:] {
+			if p.stats(c.ServiceID).outstanding < p.stats(reg.ServiceID).outstanding {
+				reg = c
+			}
+		}
+
+	case ConsistentHash:
+		// rendezvous hashing: only the keys of a provider that disappears move elsewhere
+		var best uint64
+		for _, c := range candidates {
+			h := fnv.New64a()
+			h.Write([]byte(c.ServiceID))
+			h.Write([]byte{0})
+			h.Write([]byte(key))
+			if score := h.Sum64(); score >= best {
+				best, reg = score, c
+			}
+		}
+
+	default:
+		reg = candidates[p.next%len(candidates)]
+		p.next++
+	}
+
+	s := p.stats(reg.ServiceID)
+	s.outstanding++
+
+	var once sync.Once
+	done := func(err error) {
+		once.Do(func() { p.done(reg.ServiceID, err) })
+	}
+	return reg, done, nil
+}
+
+func (p *Picker) done(serviceID string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	s := p.stats(serviceID)
+	s.outstanding--
+
+	if err == nil {
+		s.failures = 0
+		return
+	}
+
+	s.failures++
+	if s.failures >= p.MaxFailures {
+		s.ejectedUntil = p.now().Add(p.CoolDown)
+		// after the cool-down a single failure ejects the provider again
+		s.failures = p.MaxFailures - 1
+	}
+}
+
+// healthy returns the providers that are not ejected and forgets providers that are gone. p.mutex must be held.
+func (p *Picker) healthy(regs []Registration) []Registration {
+	now := p.now()
+	present := make(map[string]bool, len(regs))
+
+	var healthy []Registration
+	for _, r := range regs {
+		present[r.ServiceID] = true
+		if !r.Healthy() {
+			continue
+		}
+		if s, ok := p.health[r.ServiceID]; ok && now.Before(s.ejectedUntil) {
+			continue
+		}
+		healthy = append(healthy, r)
+	}
+
+	for id, s := range p.health {
+		if !present[id] && s.outstanding == 0 {
+			delete(p.health, id)
+		}
+	}
+	return healthy
+}
+
+// stats returns the health record of serviceID, creating it if needed. p.mutex must be held.
+func (p *Picker) stats(serviceID string) *providerHealth {
+	s, ok := p.health[serviceID]
+	if !ok {
+		s = &providerHealth{}
+		p.health[serviceID] = s
+	}
+	return s
+}
@@ -0,0 +1,114 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func fakePicker(strategy Strategy, ids ...string) (*Picker, *[]Registration, *time.Time) {
+	regs := make([]Registration, 0, len(ids))
+	for _, id := range ids {
+		regs = append(regs, Registration{ServiceName: WebService, ServiceID: id, ServiceURL: "http://" + id})
+	}
+	now := time.Unix(0, 0)
+
+	p := NewPicker(WebService, strategy)
+	p.Source = func() ([]Registration, error) { return regs, nil }
+	p.now = func() time.Time { return now }
+	return p, &regs, &now
+}
+
+func pick(t *testing.T, p *Picker, key string, err error) string {
+	t.Helper()
+	reg, done, e := p.Pick(key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	done(err)
+	return reg.ServiceID
+}
+
+func TestPickerRoundRobin(t *testing.T) {
+	p, _, _ := fakePicker(RoundRobin, "a", "b", "c")
+
+	counts := make(map[string]int)
+	for i := 0; i < 9; i++ {
+		counts[pick(t, p, "", nil)]++
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		if counts[id] != 3 {
+			t.Errorf("expected 3 picks of %s, got %v", id, counts)
+		}
+	}
+}
+
+func TestPickerEjectionAndCoolDown(t *testing.T) {
+	p, _, now := fakePicker(ConsistentHash, "a", "b")
+	failure := errors.New("connection refused")
+
+	// find the provider owning the key and fail it until it is ejected
+	owner := pick(t, p, "user-1", nil)
+	for i := 0; i < p.MaxFailures; i++ {
+		if got := pick(t, p, "user-1", failure); got != owner {
+			t.Fatalf("expected %s before ejection, got %s", owner, got)
+		}
+	}
+	if got := pick(t, p, "user-1", nil); got == owner {
+		t.Fatalf("expected %s to be ejected", owner)
+	}
+
+	*now = now.Add(p.CoolDown)
+	if got := pick(t, p, "user-1", failure); got != owner {
+		t.Fatalf("expected %s to be admitted again after the cool-down, got %s", owner, got)
+	}
+	// a single failure after re-admission ejects it again
+	if got := pick(t, p, "user-1", nil); got == owner {
+		t.Fatalf("expected %s to be ejected again", owner)
+	}
+}
+
+func TestPickerAllEjected(t *testing.T) {
+	p, _, _ := fakePicker(Random, "a")
+	for i := 0; i < p.MaxFailures; i++ {
+		pick(t, p, "", errors.New("timeout"))
+	}
+	if got := pick(t, p, "", nil); got != "a" {
+		t.Errorf("expected to fall back to the ejected provider, got %s", got)
+	}
+}
+
+func TestPickerLeastOutstanding(t *testing.T) {
+	p, _, _ := fakePicker(LeastOutstanding, "a", "b")
+
+	first, done, _ := p.Pick("")
+	second, _, _ := p.Pick("")
+	if first.ServiceID == second.ServiceID {
+		t.Fatalf("expected requests to spread, both went to %s", first.ServiceID)
+	}
+
+	done(nil)
+	if got := pick(t, p, "", nil); got != first.ServiceID {
+		t.Errorf("expected the idle provider %s, got %s", first.ServiceID, got)
+	}
+}
+
+func TestPickerConsistentHash(t *testing.T) {
+	p, regs, _ := fakePicker(ConsistentHash, "a", "b", "c", "d")
+
+	keys := []string{"u1", "u2", "u3", "u4", "u5", "u6", "u7", "u8"}
+	owners := make(map[string]string)
+	for _, k := range keys {
+		owners[k] = pick(t, p, k, nil)
+	}
+
+	// removing a provider only moves the keys it owned
+	removed := (*regs)[0].ServiceID
+	*regs = (*regs)[1:]
+	for _, k := range keys {
+		got := pick(t, p, k, nil)
+		if owners[k] != removed && got != owners[k] {
+			t.Errorf("key %s moved from %s to %s", k, owners[k], got)
+		}
+	}
+}
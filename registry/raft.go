@@ -0,0 +1,834 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go-distributed/registry/auth"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A minimal Raft implementation replicating registry events between regservice replicas.
+// Replicas talk to each other with JSON over HTTP on /raft/vote, /raft/append and /raft/snapshot,
+// authenticated with tokens signed by the keyring the replicas share and bound to the request body.
+// Once compactEntries entries were applied, they are compacted into a snapshot of the registry state,
+// which the leader sends to replicas missing the entries it replaces.
+
+type raftRole int
+
+const (
+	follower raftRole = iota
+	candidate
+	leader
+)
+
+var (
+	errNotLeader      = errors.New("registry replica is not the leader")
+	errCommitTimeout  = errors.New("timed out waiting for the registry cluster to commit")
+	heartbeatInterval = 150 * time.Millisecond
+	electionTimeout   = 1000 * time.Millisecond // randomized between 1x and 2x
+	commitTimeout     = 5 * time.Second
+	compactEntries    = uint64(1024)
+)
+
+type raftEntry struct {
+	Term  uint64 `json:"term"`
+	Event Event  `json:"event"` // Event.Index is the position of the entry in the log
+}
+
+type voteRequest struct {
+	Term         uint64 `json:"term"`
+	CandidateID  string `json:"candidate_id"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type voteResponse struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"vote_granted"`
+}
+
+type appendRequest struct {
+	Term         uint64      `json:"term"`
+	LeaderID     string      `json:"leader_id"`
+	PrevLogIndex uint64      `json:"prev_log_index"`
+	PrevLogTerm  uint64      `json:"prev_log_term"`
+	Entries      []raftEntry `json:"entries"`
+	LeaderCommit uint64      `json:"leader_commit"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// NextIndex is where the leader should continue replicating after a failed append
+	NextIndex uint64 `json:"next_index"`
+}
+
+type snapshotRequest struct {
+	Term     uint64       `json:"term"`
+	LeaderID string       `json:"leader_id"`
+	Snapshot raftSnapshot `json:"snapshot"`
+}
+
+type snapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+type applyResult struct {
+	removed []Registration
+	err     error
+}
+
+// raftFSM is the state machine the log drives, the registry.
+type raftFSM interface {
+	// applyCommitted applies a committed event and returns the registrations it replaced or removed
+	applyCommitted(Event) []Registration
+	// state returns the applied state, which is compacted into snapshots
+	state() *State
+	// restore replaces the applied state with a snapshot
+	restore(*State)
+	// resetHeartbeats is called when the replica becomes the leader
+	resetHeartbeats()
+}
+
+type raftNode struct {
+	id    string
+	peers []string
+	disk  *raftStorage // nil to keep the state in memory
+
+	raftMeta
+	entries     []raftEntry  // the log after the snapshot
+	snapshot    raftSnapshot // replaces the entries up to snapshot.Index
+	restored    *State       // a snapshot from the leader the registry has yet to restore
+	role        raftRole
+	leaderID    string
+	commitIndex uint64
+	lastApplied uint64
+	lastContact time.Time
+	lastSent    time.Time
+	timeout     time.Duration
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	inflight    map[string]bool
+	waiters     map[uint64]chan applyResult
+
+	fsm     raftFSM
+	keyring atomic.Pointer[auth.Keyring] // signs and verifies the requests between replicas
+	client  *http.Client
+	applyCh chan struct{}
+	stop    chan struct{}
+	mutex   sync.Mutex
+}
+
+func newRaftNode(cfg ClusterConfig, applied uint64, fsm raftFSM, keyring *auth.Keyring, transport http.RoundTripper) (*raftNode, error) {
+	n := &raftNode{
+		id:          cfg.Self,
+		peers:       cfg.Peers,
+		lastContact: time.Now(),
+		waiters:     make(map[uint64]chan applyResult),
+		fsm:         fsm,
+		client:      &http.Client{Timeout: electionTimeout / 2, Transport: transport},
+		applyCh:     make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+	}
+	n.keyring.Store(keyring)
+	n.resetTimeout()
+
+	if cfg.DataDir != "" {
+		var err error
+		n.disk, n.raftMeta, n.snapshot, n.entries, err = openRaftStorage(cfg.DataDir)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the registry restored from its store may be behind the snapshot, e.g. with the memory store
+	if n.snapshot.Index > applied {
+		var state State
+		if err := json.Unmarshal(n.snapshot.State, &state); err != nil {
+			return nil, fmt.Errorf("corrupt raft snapshot: %w", err)
+		}
+		fsm.restore(&state)
+		applied = n.snapshot.Index
+	}
+	// or ahead of the local log if the log was lost
+	applied = min(applied, n.lastIndex())
+	n.commitIndex, n.lastApplied = applied, applied
+
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+func (n *raftNode) lastIndex() uint64 {
+	return n.snapshot.Index + uint64(len(n.entries))
+}
+
+// termAt returns the term of the entry at index, or 0 if it is not known.
+func (n *raftNode) termAt(index uint64) uint64 {
+	if index == n.snapshot.Index {
+		return n.snapshot.Term
+	}
+	if index < n.snapshot.Index || index > n.lastIndex() {
+		return 0
+	}
+	return n.entries[index-n.snapshot.Index-1].Term
+}
+
+// entriesFrom returns a copy of the entries from index on, which must be after the snapshot.
+func (n *raftNode) entriesFrom(index uint64) []raftEntry {
+	return append([]raftEntry(nil), n.entries[index-n.snapshot.Index-1:]...)
+}
+
+func (n *raftNode) resetTimeout() {
+	n.timeout = electionTimeout + time.Duration(rand.Int63n(int64(electionTimeout)))
+}
+
+// saveMeta durably records term and vote. n.mutex must be held.
+func (n *raftNode) saveMeta() error {
+	if n.disk == nil {
+		return nil
+	}
+	return n.disk.saveMeta(n.raftMeta)
+}
+
+// appendEntries durably appends entries to the log. n.mutex must be held.
+func (n *raftNode) appendEntries(entries ...raftEntry) error {
+	if n.disk != nil {
+		if err := n.disk.append(entries); err != nil {
+			return err
+		}
+	}
+	n.entries = append(n.entries, entries...)
+	return nil
+}
+
+// truncateLog removes the entries from index on, which must be after the snapshot. n.mutex must be held.
+func (n *raftNode) truncateLog(index uint64) error {
+	keep := int(index - n.snapshot.Index - 1)
+	if n.disk != nil {
+		if err := n.disk.truncate(keep); err != nil {
+			return err
+		}
+	}
+	n.entries = n.entries[:keep]
+	return nil
+}
+
+// useSnapshot replaces the entries up to snap.Index with snap, keeping the entries after it.
+// n.mutex must be held.
+func (n *raftNode) useSnapshot(snap raftSnapshot, entries []raftEntry) error {
+	if n.disk != nil {
+		if err := n.disk.saveSnapshot(snap, entries); err != nil {
+			return err
+		}
+	}
+	n.snapshot, n.entries = snap, entries
+	return nil
+}
+
+func (n *raftNode) isLeader() bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.role == leader
+}
+
+// leader returns the base URL of the current leader, or "" if none is known.
+func (n *raftNode) leader() string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.leaderID
+}
+
+func (n *raftNode) close() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	close(n.stop)
+	if n.disk != nil {
+		n.disk.close()
+	}
+}
+
+func (n *raftNode) run() {
+	ticker := time.NewTicker(heartbeatInterval / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-ticker.C:
+		}
+
+		n.mutex.Lock()
+		switch n.role {
+		case leader:
+			if time.Since(n.lastSent) >= heartbeatInterval {
+				n.broadcast()
+			}
+		default:
+			if time.Since(n.lastContact) >= n.timeout {
+				n.startElection()
+			}
+		}
+		n.mutex.Unlock()
+	}
+}
+
+// becomeFollower steps down to follower in term. n.mutex must be held.
+func (n *raftNode) becomeFollower(term uint64) error {
+	var err error
+	if term > n.Term {
+		n.Term = term
+		n.VotedFor = ""
+		err = n.saveMeta()
+	}
+	if n.role == leader {
+		log.Printf("Registry replica %s stepping down in term %d", n.id, n.Term)
+	}
+	n.role = follower
+
+	// entries proposed by this replica may never commit now, let the callers retry elsewhere
+	for index, ch := range n.waiters {
+		ch <- applyResult{err: errNotLeader}
+		delete(n.waiters, index)
+	}
+	return err
+}
+
+// startElection votes for this replica and asks the peers for their votes. n.mutex must be held.
+func (n *raftNode) startElection() {
+	n.role = candidate
+	n.Term++
+	n.VotedFor = n.id
+	n.leaderID = ""
+	n.lastContact = time.Now()
+	n.resetTimeout()
+	if err := n.saveMeta(); err != nil {
+		log.Println("Failed to persist raft state:", err)
+		n.role = follower
+		return
+	}
+
+	term := n.Term
+	req := voteRequest{
+		Term:         term,
+		CandidateID:  n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.termAt(n.lastIndex()),
+	}
+	log.Printf("Registry replica %s starting election for term %d", n.id, term)
+
+	votes := 1
+
+	for _, peer := range n.peers {
+		go func(peer string) {
+			var resp voteResponse
+			if err := n.call(peer, "/raft/vote", req, &resp); err != nil {
+				return
+			}
+
+			n.mutex.Lock()
+			defer n.mutex.Unlock()
+
+			if resp.Term > n.Term {
+				if err := n.becomeFollower(resp.Term); err != nil {
+					log.Println("Failed to persist raft state:", err)
+				}
+				return
+			}
+			if n.role != candidate || n.Term != term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes > (len(n.peers)+1)/2 {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader takes over the cluster. n.mutex must be held.
+func (n *raftNode) becomeLeader() {
+	// entries of earlier terms are only committed together with an entry of the current term
+	noop := raftEntry{Term: n.Term, Event: Event{Index: n.lastIndex() + 1, Op: opNoop, Time: time.Now()}}
+	if err := n.appendEntries(noop); err != nil {
+		log.Println("Failed to persist raft log:", err)
+		n.role = follower
+		return
+	}
+
+	log.Printf("Registry replica %s elected leader for term %d", n.id, n.Term)
+	n.role = leader
+	n.leaderID = n.id
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.inflight = make(map[string]bool)
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex()
+	}
+	n.advanceCommit()
+	n.broadcast()
+
+	go n.fsm.resetHeartbeats()
+}
+
+// propose appends e to the log and waits until it is committed and applied.
+func (n *raftNode) propose(e Event) ([]Registration, error) {
+	n.mutex.Lock()
+	if n.role != leader {
+		n.mutex.Unlock()
+		return nil, errNotLeader
+	}
+
+	e.Index = n.lastIndex() + 1
+	if err := n.appendEntries(raftEntry{Term: n.Term, Event: e}); err != nil {
+		n.mutex.Unlock()
+		return nil, err
+	}
+
+	ch := make(chan applyResult, 1)
+	n.waiters[e.Index] = ch
+	n.advanceCommit()
+	n.broadcast()
+	n.mutex.Unlock()
+
+	select {
+	case res := <-ch:
+		return res.removed, res.err
+	case <-time.After(commitTimeout):
+		n.mutex.Lock()
+		delete(n.waiters, e.Index)
+		n.mutex.Unlock()
+		return nil, errCommitTimeout
+	}
+}
+
+// broadcast replicates the log to every peer that has no request in flight, sending the snapshot to
+// peers missing the entries it replaced. n.mutex must be held.
+func (n *raftNode) broadcast() {
+	n.lastSent = time.Now()
+	for _, peer := range n.peers {
+		if n.inflight[peer] {
+			continue
+		}
+		n.inflight[peer] = true
+
+		next := n.nextIndex[peer]
+		if next <= n.snapshot.Index {
+			go n.sendSnapshot(peer, snapshotRequest{Term: n.Term, LeaderID: n.id, Snapshot: n.snapshot})
+			continue
+		}
+		req := appendRequest{
+			Term:         n.Term,
+			LeaderID:     n.id,
+			PrevLogIndex: next - 1,
+			PrevLogTerm:  n.termAt(next - 1),
+			Entries:      n.entriesFrom(next),
+			LeaderCommit: n.commitIndex,
+		}
+		go n.replicate(peer, req)
+	}
+}
+
+func (n *raftNode) replicate(peer string, req appendRequest) {
+	var resp appendResponse
+	err := n.call(peer, "/raft/append", req, &resp)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.inflight != nil {
+		n.inflight[peer] = false
+	}
+	if err != nil {
+		return
+	}
+	if resp.Term > n.Term {
+		if err := n.becomeFollower(resp.Term); err != nil {
+			log.Println("Failed to persist raft state:", err)
+		}
+		return
+	}
+	if n.role != leader || n.Term != req.Term {
+		return
+	}
+
+	if resp.Success {
+		n.matched(peer, req.PrevLogIndex+uint64(len(req.Entries)))
+		return
+	}
+
+	if resp.NextIndex >= 1 && resp.NextIndex <= n.lastIndex()+1 {
+		n.nextIndex[peer] = resp.NextIndex
+	} else if n.nextIndex[peer] > 1 {
+		n.nextIndex[peer]--
+	}
+}
+
+func (n *raftNode) sendSnapshot(peer string, req snapshotRequest) {
+	var resp snapshotResponse
+	err := n.call(peer, "/raft/snapshot", req, &resp)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.inflight != nil {
+		n.inflight[peer] = false
+	}
+	if err != nil {
+		return
+	}
+	if resp.Term > n.Term {
+		if err := n.becomeFollower(resp.Term); err != nil {
+			log.Println("Failed to persist raft state:", err)
+		}
+		return
+	}
+	if n.role != leader || n.Term != req.Term {
+		return
+	}
+	n.matched(peer, req.Snapshot.Index)
+}
+
+// matched records that peer stores the log up to index. n.mutex must be held.
+func (n *raftNode) matched(peer string, index uint64) {
+	if index > n.matchIndex[peer] {
+		n.matchIndex[peer] = index
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	n.advanceCommit()
+}
+
+// advanceCommit commits every entry of the current term stored on a majority. n.mutex must be held.
+func (n *raftNode) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.Term {
+			break
+		}
+		replicas := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				replicas++
+			}
+		}
+		if replicas > (len(n.peers)+1)/2 {
+			n.commitIndex = index
+			n.signalApply()
+			return
+		}
+	}
+}
+
+func (n *raftNode) signalApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+// applyLoop hands snapshots and committed entries to the registry in log order.
+func (n *raftNode) applyLoop() {
+	for {
+		select {
+		case <-n.stop:
+			return
+		case <-n.applyCh:
+		}
+
+		for {
+			n.mutex.Lock()
+			if restored := n.restored; restored != nil {
+				n.restored = nil
+				n.mutex.Unlock()
+				n.fsm.restore(restored)
+				continue
+			}
+			if n.lastApplied >= n.commitIndex {
+				n.mutex.Unlock()
+				break
+			}
+			n.lastApplied++
+			e := n.entries[n.lastApplied-n.snapshot.Index-1].Event
+			n.mutex.Unlock()
+
+			removed := n.fsm.applyCommitted(e)
+
+			n.mutex.Lock()
+			if ch, ok := n.waiters[e.Index]; ok {
+				ch <- applyResult{removed: removed}
+				delete(n.waiters, e.Index)
+			}
+			n.mutex.Unlock()
+		}
+
+		n.compact()
+	}
+}
+
+// compact replaces the applied entries with a snapshot of the registry state once compactEntries of
+// them accumulated.
+func (n *raftNode) compact() {
+	n.mutex.Lock()
+	due := n.lastApplied >= n.snapshot.Index+compactEntries
+	n.mutex.Unlock()
+	if !due {
+		return
+	}
+
+	// only the apply loop applies entries, so the state is that after lastApplied
+	state := n.fsm.state()
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Println("Failed to encode raft snapshot:", err)
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	// a registry restored ahead of a lost log has no entry of the log to be the snapshot of
+	if state.Index != n.lastApplied || state.Index <= n.snapshot.Index {
+		return
+	}
+	snap := raftSnapshot{Index: state.Index, Term: n.termAt(state.Index), State: data}
+	if err := n.useSnapshot(snap, n.entriesFrom(state.Index+1)); err != nil {
+		log.Println("Failed to compact raft log:", err)
+	}
+}
+
+func (n *raftNode) call(peer, path string, req, resp interface{}) error {
+	d, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	token, err := n.keyring.Load().Sign(auth.Claims{ServiceName: auth.Registry, ServiceID: n.id, BodyHash: auth.BodyHash(d)}, patchTokenTTL)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequest(http.MethodPost, peer+path, bytes.NewReader(d))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := n.client.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("raft peer %s responded with status code %v", peer, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
+
+// authenticate checks that r comes from a peer: its token must be signed by the shared keyring, name a
+// peer and match body.
+func (n *raftNode) authenticate(r *http.Request, body []byte) error {
+	token, ok := bearer(r)
+	if !ok {
+		return fmt.Errorf("missing bearer token")
+	}
+	claims, err := n.keyring.Load().KeySet().Verify(token)
+	if err != nil {
+		return err
+	}
+	if claims.ServiceName != auth.Registry || !slices.Contains(n.peers, claims.ServiceID) {
+		return fmt.Errorf("token is not of a registry replica")
+	}
+	if claims.BodyHash != auth.BodyHash(body) {
+		return fmt.Errorf("token does not match the request body")
+	}
+	return nil
+}
+
+func (n *raftNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err := n.authenticate(r, body); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var resp interface{}
+	switch r.URL.Path {
+	case "/raft/vote":
+		var req voteRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp, err = n.handleVote(req)
+
+	case "/raft/append":
+		var req appendRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp, err = n.handleAppend(req)
+
+	case "/raft/snapshot":
+		var req snapshotRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp, err = n.handleSnapshot(req)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// a replica only answers with what it stored durably
+	if err != nil {
+		log.Println("Failed to persist raft state:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (n *raftNode) handleVote(req voteRequest) (voteResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if req.Term > n.Term {
+		if err := n.becomeFollower(req.Term); err != nil {
+			return voteResponse{}, err
+		}
+	}
+
+	// only vote for candidates whose log is at least as up-to-date as ours
+	lastTerm := n.termAt(n.lastIndex())
+	upToDate := req.LastLogTerm > lastTerm || (req.LastLogTerm == lastTerm && req.LastLogIndex >= n.lastIndex())
+
+	granted := req.Term == n.Term && (n.VotedFor == "" || n.VotedFor == req.CandidateID) && upToDate
+	if granted {
+		n.VotedFor = req.CandidateID
+		n.lastContact = time.Now()
+		if err := n.saveMeta(); err != nil {
+			return voteResponse{}, err
+		}
+	}
+
+	return voteResponse{Term: n.Term, VoteGranted: granted}, nil
+}
+
+// follow accepts the sender of a request of term as the leader. It reports false for a request of an
+// older term. n.mutex must be held.
+func (n *raftNode) follow(term uint64, leaderID string) (bool, error) {
+	if term < n.Term {
+		return false, nil
+	}
+	if term > n.Term || n.role != follower {
+		if err := n.becomeFollower(term); err != nil {
+			return false, err
+		}
+	}
+	n.leaderID = leaderID
+	n.lastContact = time.Now()
+	return true, nil
+}
+
+func (n *raftNode) handleAppend(req appendRequest) (appendResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if ok, err := n.follow(req.Term, req.LeaderID); !ok {
+		return appendResponse{Term: n.Term}, err
+	}
+
+	if req.PrevLogIndex > n.lastIndex() {
+		return appendResponse{Term: n.Term, NextIndex: n.lastIndex() + 1}, nil
+	}
+	// the entries up to the snapshot are committed, so they match those of the leader
+	if req.PrevLogIndex > n.snapshot.Index && n.termAt(req.PrevLogIndex) != req.PrevLogTerm {
+		return appendResponse{Term: n.Term, NextIndex: req.PrevLogIndex}, nil
+	}
+
+	for i, entry := range req.Entries {
+		index := entry.Event.Index
+		if index <= n.snapshot.Index || (index <= n.lastIndex() && n.termAt(index) == entry.Term) {
+			continue
+		}
+		if index <= n.lastIndex() {
+			// a conflicting suffix was never committed and is replaced by the leader's entries
+			if err := n.truncateLog(index); err != nil {
+				return appendResponse{}, err
+			}
+		}
+		if err := n.appendEntries(req.Entries[i:]...); err != nil {
+			return appendResponse{}, err
+		}
+		break
+	}
+
+	if req.LeaderCommit > n.commitIndex {
+		n.commitIndex = min(req.LeaderCommit, n.lastIndex())
+		n.signalApply()
+	}
+
+	return appendResponse{Term: n.Term, Success: true}, nil
+}
+
+// handleSnapshot replaces the log with the snapshot of the leader, which this replica is missing
+// entries of.
+func (n *raftNode) handleSnapshot(req snapshotRequest) (snapshotResponse, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if ok, err := n.follow(req.Term, req.LeaderID); !ok {
+		return snapshotResponse{Term: n.Term}, err
+	}
+
+	snap := req.Snapshot
+	if snap.Index <= n.snapshot.Index {
+		return snapshotResponse{Term: n.Term}, nil
+	}
+	var state State
+	if err := json.Unmarshal(snap.State, &state); err != nil {
+		return snapshotResponse{}, fmt.Errorf("invalid raft snapshot: %w", err)
+	}
+
+	// the entries after the snapshot are kept if the log agrees with it
+	var entries []raftEntry
+	if snap.Index < n.lastIndex() && n.termAt(snap.Index) == snap.Term {
+		entries = n.entriesFrom(snap.Index + 1)
+	}
+	if err := n.useSnapshot(snap, entries); err != nil {
+		return snapshotResponse{}, err
+	}
+
+	if snap.Index > n.lastApplied {
+		n.restored = &state
+		n.lastApplied = snap.Index
+		n.commitIndex = max(n.commitIndex, snap.Index)
+		n.signalApply()
+	}
+	return snapshotResponse{Term: n.Term}, nil
+}
@@ -0,0 +1,315 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-distributed/registry/auth"
+	"go-distributed/registry/heartbeat"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testReplica struct {
+	url     string
+	peers   []string
+	server  *httptest.Server
+	service *RegistryService
+	once    sync.Once
+}
+
+func startCluster(t *testing.T, size int) []*testReplica {
+	heartbeatInterval = 50 * time.Millisecond
+	electionTimeout = 300 * time.Millisecond
+
+	listeners := make([]net.Listener, size)
+	urls := make([]string, size)
+	for i := range listeners {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = ln
+		urls[i] = "http://" + ln.Addr().String()
+	}
+
+	replicas := make([]*testReplica, size)
+	for i := range replicas {
+		var peers []string
+		for j, u := range urls {
+			if j != i {
+				peers = append(peers, u)
+			}
+		}
+		replicas[i] = startReplica(t, listeners[i], urls[i], peers)
+	}
+	return replicas
+}
+
+// testKeyring holds the keys the replicas of the tests share to authenticate each other.
+var testKeyring = sync.OnceValue(func() *auth.Keyring {
+	keyring, err := auth.LoadKeyring("")
+	if err != nil {
+		panic(err)
+	}
+	return keyring
+})
+
+func startReplica(t *testing.T, ln net.Listener, url string, peers []string) *testReplica {
+	HBServer := heartbeat.NewHeartBeatServer()
+	service, err := NewRegistryService(HBServer, memoryStore{}, ClusterConfig{Self: url, Peers: peers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.UseKeyring(testKeyring())
+
+	mux := http.NewServeMux()
+	mux.Handle("/heartbeat/", service.LeaderOnly(HBServer))
+	mux.Handle("/services", service)
+	mux.Handle("/raft/", service.Raft())
+
+	server := httptest.NewUnstartedServer(mux)
+	server.Listener.Close()
+	server.Listener = ln
+	server.Start()
+
+	r := &testReplica{url: url, peers: peers, server: server, service: service}
+	t.Cleanup(r.stop)
+	return r
+}
+
+// restart starts a replica at the URL of r, which was stopped, without the state r had.
+func (r *testReplica) restart(t *testing.T) *testReplica {
+	ln, err := net.Listen("tcp", strings.TrimPrefix(r.url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startReplica(t, ln, r.url, r.peers)
+}
+
+func (r *testReplica) stop() {
+	r.once.Do(func() {
+		r.service.Close()
+		r.server.Close()
+	})
+}
+
+func waitForLeader(t *testing.T, replicas []*testReplica) *testReplica {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, r := range replicas {
+			if r.service.reg.isLeader() {
+				return r
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("no leader elected")
+	return nil
+}
+
+func waitForRegistration(t *testing.T, replicas []*testReplica, serviceID string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for _, r := range replicas {
+		for !r.service.reg.IsServiceRegistered(serviceID) {
+			if time.Now().After(deadline) {
+				t.Fatalf("service %s not replicated to %s", serviceID, r.url)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestClusterFailover(t *testing.T) {
+	replicas := startCluster(t, 3)
+	leader := waitForLeader(t, replicas)
+
+	var followers []*testReplica
+	for _, r := range replicas {
+		if r != leader {
+			followers = append(followers, r)
+		}
+	}
+
+	// start with a follower, which redirects writes to the leader
+	SetEndpoints(followers[0].url, leader.url, followers[1].url)
+
+	first := Registration{ServiceName: LogService, ServiceURL: "http://127.0.0.1:1"}
+	if err := RegisterRequest(&first); err != nil {
+		t.Fatal(err)
+	}
+	waitForRegistration(t, replicas, first.ServiceID)
+
+	leader.stop()
+	newLeader := waitForLeader(t, followers)
+	t.Logf("leader moved from %s to %s", leader.url, newLeader.url)
+
+	// the registration made through the old leader survives
+	waitForRegistration(t, followers, first.ServiceID)
+
+	second := Registration{ServiceName: NodeService, ServiceURL: "http://127.0.0.1:2"}
+	if err := RegisterRequest(&second); err != nil {
+		t.Fatal(err)
+	}
+	waitForRegistration(t, followers, second.ServiceID)
+
+	hb := heartbeat.BasicHeartbeat{ServiceID: second.ServiceID}
+	for _, u := range []string{leader.url, followers[0].url, followers[1].url} {
+		hb.URLs = append(hb.URLs, u+"/heartbeat/")
+	}
+	if err := hb.SendHeartbeat(); err != nil {
+		t.Errorf("heartbeat did not fail over: %v", err)
+	}
+}
+
+func TestEndpointTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { requestTimeout = timeout }(requestTimeout)
+	requestTimeout = 100 * time.Millisecond
+
+	// a replica that accepts connections but never answers
+	stuck := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-stuck:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hung.Close()
+	defer close(stuck)
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer ok.Close()
+
+	SetEndpoints(hung.URL, ok.URL)
+	resp, err := endpoints.do(http.MethodGet, "/services", nil, nil)
+	if err != nil {
+		t.Fatalf("expected the request to fail over, got %v", err)
+	}
+	resp.Body.Close()
+	if current := Endpoints()[0]; current != ok.URL {
+		t.Errorf("expected %s to answer, got %s", ok.URL, current)
+	}
+}
+
+func TestClusterTelemetry(t *testing.T) {
+	replicas := startCluster(t, 3)
+	leader := waitForLeader(t, replicas)
+	var follower *testReplica
+	for _, r := range replicas {
+		if r != leader {
+			follower = r
+			break
+		}
+	}
+	SetEndpoints(follower.url)
+
+	node := Registration{ServiceName: NodeService, ServiceURL: "http://127.0.0.1:2"}
+	if err := RegisterRequest(&node); err != nil {
+		t.Fatal(err)
+	}
+	waitForRegistration(t, replicas, node.ServiceID)
+
+	hb := heartbeat.NewInfoHeartbeat(func() (heartbeat.ServerInfo, error) {
+		return heartbeat.ServerInfo{Connections: 7}, nil
+	}, leader.url+"/heartbeat/")
+	hb.(*heartbeat.InfoHeartbeat).ServiceID = node.ServiceID
+	if err := hb.SendHeartbeat(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the telemetry the leader received is served through a follower
+	regs, err := FetchProviders(NodeService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regs) != 1 || regs[0].Info == nil || regs[0].Info.Connections != 7 {
+		t.Fatalf("expected the telemetry held by the leader, got %+v", regs)
+	}
+}
+
+func TestRaftAuthentication(t *testing.T) {
+	replicas := startCluster(t, 3)
+	leader := waitForLeader(t, replicas)
+	raft := leader.service.reg.raft
+	raft.mutex.Lock()
+	term := raft.Term
+	raft.mutex.Unlock()
+
+	// a higher term would make the replica step down if it were accepted
+	body, _ := json.Marshal(appendRequest{Term: term + 100, LeaderID: "http://attacker"})
+	stranger, _ := auth.LoadKeyring("")
+	strangerToken, _ := stranger.Sign(auth.Claims{ServiceName: auth.Registry, ServiceID: replicas[1].url, BodyHash: auth.BodyHash(body)}, time.Minute)
+	keyring := leader.service.reg.keyring
+	serviceToken, _ := keyring.Sign(auth.Claims{ServiceName: string(NodeService), ServiceID: replicas[1].url, BodyHash: auth.BodyHash(body)}, time.Minute)
+	otherBodyToken, _ := keyring.Sign(auth.Claims{ServiceName: auth.Registry, ServiceID: replicas[1].url, BodyHash: auth.BodyHash([]byte("{}"))}, time.Minute)
+
+	for name, token := range map[string]string{
+		"no token":              "",
+		"unknown key":           strangerToken,
+		"service token":         serviceToken,
+		"token of another body": otherBodyToken,
+	} {
+		req, _ := http.NewRequest(http.MethodPost, leader.url+"/raft/append", bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, res.StatusCode)
+		}
+	}
+	if !leader.service.reg.isLeader() {
+		t.Error("expected the leader to ignore unauthenticated appends")
+	}
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	// cleanups run in reverse, so the replicas are stopped before the setting is restored
+	previous := compactEntries
+	t.Cleanup(func() { compactEntries = previous })
+	compactEntries = 4
+
+	replicas := startCluster(t, 3)
+	leader := waitForLeader(t, replicas)
+	var lagging *testReplica
+	for _, r := range replicas {
+		if r != leader {
+			lagging = r
+			break
+		}
+	}
+	lagging.stop()
+
+	var ids []string
+	for i := range 10 {
+		reg := Registration{ServiceName: LogService, ServiceID: "snapshot-" + strconv.Itoa(i), ServiceURL: "http://127.0.0.1:" + strconv.Itoa(10+i)}
+		if err := leader.service.reg.add(reg); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, reg.ServiceID)
+	}
+
+	raft := leader.service.reg.raft
+	raft.mutex.Lock()
+	compacted, kept := raft.snapshot.Index, len(raft.entries)
+	raft.mutex.Unlock()
+	if compacted == 0 || kept >= int(compactEntries) {
+		t.Fatalf("expected the applied entries to be compacted, got a snapshot at %d and %d entries", compacted, kept)
+	}
+
+	// a replica that lost its state catches up from the snapshot and the entries after it
+	restarted := lagging.restart(t)
+	for _, id := range ids {
+		waitForRegistration(t, []*testReplica{restarted}, id)
+	}
+}
@@ -0,0 +1,251 @@
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	raftStateFile    = "raft-state.json"
+	raftLogFile      = "raft.log"
+	raftSnapshotFile = "raft-snapshot.json"
+)
+
+// raftMeta is the term and vote a replica must keep across restarts to stay safe.
+type raftMeta struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// raftSnapshot is the registry state after the entry at Index, which replaces the entries up to it.
+type raftSnapshot struct {
+	Index uint64          `json:"index"`
+	Term  uint64          `json:"term"`
+	State json.RawMessage `json:"state"`
+}
+
+// raftStorage keeps the state of a replica in dir: the term and vote in raftStateFile, the log in
+// raftLogFile, one entry per line, and the snapshot the log was compacted into in raftSnapshotFile.
+// Every write is synced before it returns, so a replica only answers with what survives a crash.
+type raftStorage struct {
+	dir     string
+	file    *os.File
+	offsets []int64 // where each entry of the log starts in the file
+	size    int64
+}
+
+// openRaftStorage opens the storage in dir and returns what it holds. The entries are those after the
+// snapshot; a torn entry at the end of the log, left by a crash during an append, is cut off.
+func openRaftStorage(dir string) (*raftStorage, raftMeta, raftSnapshot, []raftEntry, error) {
+	var meta raftMeta
+	var snap raftSnapshot
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, meta, snap, nil, err
+	}
+	if err := readJSON(filepath.Join(dir, raftStateFile), &meta); err != nil {
+		return nil, meta, snap, nil, fmt.Errorf("corrupt raft state: %w", err)
+	}
+	if err := readJSON(filepath.Join(dir, raftSnapshotFile), &snap); err != nil {
+		return nil, meta, snap, nil, fmt.Errorf("corrupt raft snapshot: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, raftLogFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, meta, snap, nil, err
+	}
+	s := &raftStorage{dir: dir, file: f}
+
+	var entries []raftEntry
+	compacted := false
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				log.Printf("Dropping torn raft log entry at offset %d", s.size)
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, meta, snap, nil, err
+		}
+		var entry raftEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("Dropping unreadable raft log entry at offset %d: %v", s.size, err)
+			break
+		}
+
+		// the log may still hold entries compacted into the snapshot if the replica crashed in between
+		if entry.Event.Index <= snap.Index {
+			compacted = true
+		} else if want := snap.Index + uint64(len(entries)) + 1; entry.Event.Index != want {
+			f.Close()
+			return nil, meta, snap, nil, fmt.Errorf("raft log skips from entry %d to %d", want-1, entry.Event.Index)
+		} else {
+			entries = append(entries, entry)
+			s.offsets = append(s.offsets, s.size)
+		}
+		s.size += int64(len(line))
+	}
+
+	if compacted {
+		err = s.rewrite(entries)
+	} else {
+		// appends go after the last good entry
+		err = s.truncateAt(s.size)
+	}
+	if err != nil {
+		f.Close()
+		return nil, meta, snap, nil, err
+	}
+	return s, meta, snap, entries, nil
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeFileSync replaces path with data, so a crash leaves either the old or the new file.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes the renames in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *raftStorage) saveMeta(meta raftMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(filepath.Join(s.dir, raftStateFile), data)
+}
+
+// append adds entries to the end of the log.
+func (s *raftStorage) append(entries []raftEntry) error {
+	var buf []byte
+	offsets := make([]int64, 0, len(entries))
+	for _, entry := range entries {
+		d, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, s.size+int64(len(buf)))
+		buf = append(append(buf, d...), '\n')
+	}
+
+	if _, err := s.file.WriteAt(buf, s.size); err != nil {
+		// leave no partial entry behind for the next append
+		s.truncateAt(s.size)
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		s.truncateAt(s.size)
+		return err
+	}
+	s.offsets = append(s.offsets, offsets...)
+	s.size += int64(len(buf))
+	return nil
+}
+
+// truncate keeps the first keep entries of the log.
+func (s *raftStorage) truncate(keep int) error {
+	if keep >= len(s.offsets) {
+		return nil
+	}
+	if err := s.truncateAt(s.offsets[keep]); err != nil {
+		return err
+	}
+	s.offsets = s.offsets[:keep]
+	return nil
+}
+
+func (s *raftStorage) truncateAt(size int64) error {
+	if err := s.file.Truncate(size); err != nil {
+		return err
+	}
+	s.size = size
+	return s.file.Sync()
+}
+
+// saveSnapshot stores snap and replaces the log with entries, those after it.
+func (s *raftStorage) saveSnapshot(snap raftSnapshot, entries []raftEntry) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := writeFileSync(filepath.Join(s.dir, raftSnapshotFile), data); err != nil {
+		return err
+	}
+	return s.rewrite(entries)
+}
+
+// rewrite replaces the log with entries.
+func (s *raftStorage) rewrite(entries []raftEntry) error {
+	path := filepath.Join(s.dir, raftLogFile)
+	var buf []byte
+	var offsets []int64
+	for _, entry := range entries {
+		d, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		offsets = append(offsets, int64(len(buf)))
+		buf = append(append(buf, d...), '\n')
+	}
+	if err := writeFileSync(path, buf); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file, s.offsets, s.size = f, offsets, int64(len(buf))
+	return nil
+}
+
+func (s *raftStorage) close() error {
+	return s.file.Close()
+}
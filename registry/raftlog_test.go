@@ -0,0 +1,117 @@
+package registry
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testEntries(from, to uint64) []raftEntry {
+	var entries []raftEntry
+	for i := from; i <= to; i++ {
+		entries = append(entries, raftEntry{Term: 1, Event: Event{Index: i, Op: opNoop}})
+	}
+	return entries
+}
+
+func TestRaftStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _, _, err := openRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.saveMeta(raftMeta{Term: 3, VotedFor: "http://10.0.0.2:80"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.append(testEntries(1, 5)); err != nil {
+		t.Fatal(err)
+	}
+	// a conflicting suffix is replaced
+	if err := s.truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.append([]raftEntry{{Term: 2, Event: Event{Index: 4, Op: opNoop}}}); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	// a crash during an append leaves a torn entry behind
+	f, err := os.OpenFile(filepath.Join(dir, raftLogFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"term":2,"event":{"ind`)
+	f.Close()
+
+	s, meta, _, entries, err := openRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Term != 3 || meta.VotedFor != "http://10.0.0.2:80" {
+		t.Errorf("expected the term and vote to survive restarts, got %+v", meta)
+	}
+	if len(entries) != 4 || entries[3].Term != 2 {
+		t.Fatalf("expected the entries up to the torn one, got %+v", entries)
+	}
+
+	// the next append goes after the last good entry rather than the torn one
+	if err := s.append(testEntries(5, 6)); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	s, _, _, entries, err = openRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 {
+		t.Fatalf("expected the entries appended after the torn one, got %d", len(entries))
+	}
+
+	state, _ := json.Marshal(newState())
+	if err := s.saveSnapshot(raftSnapshot{Index: 4, Term: 2, State: state}, entries[4:]); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	_, _, snap, entries, err := openRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Index != 4 || snap.Term != 2 || len(entries) != 2 || entries[0].Event.Index != 5 {
+		t.Errorf("expected the snapshot and the entries after it, got %+v and %+v", snap, entries)
+	}
+}
+
+func TestRaftStorageCompactionCrash(t *testing.T) {
+	dir := t.TempDir()
+	s, _, _, _, err := openRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.append(testEntries(1, 6)); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+
+	// the snapshot was written, but the replica crashed before the log was rewritten
+	state, _ := json.Marshal(newState())
+	data, _ := json.Marshal(raftSnapshot{Index: 4, Term: 1, State: state})
+	if err := writeFileSync(filepath.Join(dir, raftSnapshotFile), data); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _, snap, entries, err := openRaftStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.Index != 4 || len(entries) != 2 || entries[0].Event.Index != 5 {
+		t.Fatalf("expected the entries compacted into the snapshot to be dropped, got %+v", entries)
+	}
+	if err := s.append(testEntries(7, 7)); err != nil {
+		t.Fatal(err)
+	}
+	s.close()
+	if _, _, _, entries, err = openRaftStorage(dir); err != nil || len(entries) != 3 {
+		t.Errorf("expected the log to be rewritten without them, got %d entries and %v", len(entries), err)
+	}
+}
@@ -1,8 +1,12 @@
 package registry
 
 import (
+	"go-distributed/registry/heartbeat"
 	"go-distributed/utils"
+	"log"
 	"os"
+	"strings"
+	"time"
 )
 
 type Registration struct {
@@ -15,6 +19,23 @@ type Registration struct {
 	RequiredServices []ServiceName
 	ServiceUpdateURL string
 	Tags             []string
+	// Namespace separates environments sharing the registry, DefaultNamespace when empty
+	Namespace string `json:",omitempty"`
+	// Metadata are attributes selectors can match, e.g. region=eu
+	Metadata map[string]string `json:",omitempty"`
+	// HeartbeatInterval is how often the service sends heartbeats and HeartbeatTTL how long the registry
+	// keeps it without one; zero means DefaultHeartbeatInterval and DefaultHeartbeatTTL.
+	HeartbeatInterval time.Duration `json:",omitempty"`
+	HeartbeatTTL      time.Duration `json:",omitempty"`
+	// HealthCheck lets the registry probe the service in addition to receiving its heartbeats
+	HealthCheck *HealthCheck `json:",omitempty"`
+	// Health is set by the registry: services missing heartbeats are Suspect until they are evicted,
+	// services failing their health check Unhealthy
+	Health Health `json:",omitempty"`
+	// Draining services are still listed but must not be given new work
+	Draining bool `json:",omitempty"`
+	// Info is the latest telemetry reported by the service, attached by the registry when serving GET /services
+	Info *heartbeat.ServerInfo `json:",omitempty"`
 }
 
 type ServiceName string
@@ -34,7 +55,6 @@ type patch struct {
 
 var ServerIP string
 var ServerPort string
-var ServerURL string
 
 func init() {
 	utils.LoadEnv()
@@ -42,10 +62,36 @@ func init() {
 	// For registry server, the ServerIP and ServerPort should be the addr it listens on, such as localhost:3000 or [::]:80
 	ServerIP = os.Getenv("Registry_IP")
 
+	// Registry_Metadata is added to the metadata of services, e.g. "region=eu,provider=hetzner"
+	if metadata := os.Getenv("Registry_Metadata"); metadata != "" {
+		Metadata = parseMetadata(metadata)
+	}
+
+	// Registry_Namespace is the namespace services register in, e.g. "prod" or "staging"
+	if ns := os.Getenv("Registry_Namespace"); ns != "" {
+		Namespace = ns
+	}
+
 	ServerPort = os.Getenv("Registry_Port")
 	if ServerPort == "" {
 		ServerPort = "80"
 	}
 
-	ServerURL = "http://" + ServerIP + ":" + ServerPort + "/services"
+	// With mutual TLS, services trust the registry CA in Registry_CAFile and get their certificate when registering
+	if caFile := os.Getenv("Registry_CAFile"); caFile != "" {
+		caPEM, err := os.ReadFile(caFile)
+		if err == nil {
+			err = UseRegistryCA(caPEM)
+		}
+		if err != nil {
+			log.Println("Failed to enable mutual TLS:", err)
+		}
+	}
+
+	// Clients of a replicated registry list every replica in Registry_Endpoints, e.g. "10.0.0.1:80,10.0.0.2:80"
+	if endpoints := os.Getenv("Registry_Endpoints"); endpoints != "" {
+		SetEndpoints(strings.Split(endpoints, ",")...)
+	} else {
+		SetEndpoints(ServerIP + ":" + ServerPort)
+	}
 }
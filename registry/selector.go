@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A selector narrows the providers of a service. It is a comma-separated list of requirements,
+// all of which a registration must meet:
+//
+//	key=value   a value of key is value
+//	key!=value  no value of key is value
+//	key~=text   a value of key contains text, ignoring case
+//	key         key has a value
+//	!key        key has no value
+//
+// The key tag refers to the Tags of a registration, description to its Description, ipv6 to its
+// PublicIPv6 and any other key to its Metadata. GET /services takes a selector as the selector
+// query parameter; in RequiredServices it follows the service name after a question mark, e.g.
+// NodeService?region=eu,tag=netflix.
+
+// Metadata is added to the metadata of services when they register, set with Registry_Metadata.
+var Metadata map[string]string
+
+// Selector is a parsed selector. The empty Selector matches every registration.
+type Selector []requirement
+
+type requirement struct {
+	key, op, value string
+}
+
+// reservedKeys are selector keys that refer to fields of the registration rather than its metadata.
+var reservedKeys = map[string]bool{"tag": true, "description": true, "ipv6": true}
+
+// ParseSelector parses s, as described above.
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range strings.Split(s, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		var req requirement
+		switch {
+		case strings.Contains(term, "!="):
+			req.key, req.value, _ = strings.Cut(term, "!=")
+			req.op = "!="
+		case strings.Contains(term, "~="):
+			req.key, req.value, _ = strings.Cut(term, "~=")
+			req.op = "~="
+		case strings.Contains(term, "="):
+			req.key, req.value, _ = strings.Cut(term, "=")
+			req.op = "="
+		case strings.HasPrefix(term, "!"):
+			req.key, req.op = term[1:], "!"
+		default:
+			req.key, req.op = term, "exists"
+		}
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if !validKey(req.key) {
+			return nil, fmt.Errorf("invalid selector term %q", term)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+func validKey(key string) bool {
+	return key != "" && !strings.ContainsAny(key, ",=!~?/ ")
+}
+
+// Matches reports whether r meets every requirement of s.
+func (s Selector) Matches(r Registration) bool {
+	for _, req := range s {
+		if !req.matches(r.values(req.key)) {
+			return false
+		}
+	}
+	return true
+}
+
+func (req requirement) matches(values []string) bool {
+	switch req.op {
+	case "exists":
+		return len(values) > 0
+	case "!":
+		return len(values) == 0
+	case "!=":
+		for _, v := range values {
+			if v == req.value {
+				return false
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		if (req.op == "=" && v == req.value) || (req.op == "~=" && strings.Contains(strings.ToLower(v), strings.ToLower(req.value))) {
+			return true
+		}
+	}
+	return false
+}
+
+// values returns the values of the selector key for r.
+func (r Registration) values(key string) []string {
+	var v string
+	switch key {
+	case "tag":
+		return r.Tags
+	case "description":
+		v = r.Description
+	case "ipv6":
+		v = r.PublicIPv6
+	default:
+		v = r.Metadata[key]
+	}
+	if v == "" {
+		return nil
+	}
+	return []string{v}
+}
+
+// filter returns the registrations matching s.
+func (s Selector) filter(regs []Registration) []Registration {
+	if len(s) == 0 {
+		return regs
+	}
+	var matching []Registration
+	for _, r := range regs {
+		if s.Matches(r) {
+			matching = append(matching, r)
+		}
+	}
+	return matching
+}
+
+// anyMatches reports whether r matches one of selectors.
+func anyMatches(selectors []Selector, r Registration) bool {
+	for _, s := range selectors {
+		if s.Matches(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Where returns the reference to the providers of n matching selector, e.g.
+// NodeService.Where("region=eu") for NodeService?region=eu.
+func (n ServiceName) Where(selector string) ServiceName {
+	if strings.Contains(string(n), "?") {
+		return n + "," + ServiceName(selector)
+	}
+	return n + "?" + ServiceName(selector)
+}
+
+// splitSelector splits a resolved reference into the name the registry keys the service by and its selector.
+func splitSelector(ref ServiceName) (ServiceName, Selector, error) {
+	name, selector, _ := strings.Cut(string(ref), "?")
+	sel, err := ParseSelector(selector)
+	return ServiceName(name), sel, err
+}
+
+// validateMetadata rejects metadata keys selectors cannot refer to and required services with invalid selectors.
+func (r Registration) validateMetadata() error {
+	if strings.Contains(string(r.ServiceName), "?") {
+		return fmt.Errorf("service name must not contain ?")
+	}
+	for key := range r.Metadata {
+		if !validKey(key) || reservedKeys[key] {
+			return fmt.Errorf("invalid metadata key %q", key)
+		}
+	}
+	for _, name := range r.RequiredServices {
+		if _, _, err := splitSelector(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseMetadata parses comma-separated key=value pairs, as in Registry_Metadata.
+func parseMetadata(s string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(pair, "=")
+		if key = strings.TrimSpace(key); key != "" {
+			metadata[key] = strings.TrimSpace(value)
+		}
+	}
+	return metadata
+}
@@ -0,0 +1,136 @@
+package registry
+
+import (
+	"encoding/json"
+	"go-distributed/registry/heartbeat"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSelector(t *testing.T) {
+	node := Registration{
+		ServiceName: NodeService,
+		Description: "Tokyo premium",
+		PublicIPv6:  "2001:db8::1",
+		Tags:        []string{"netflix", "disney"},
+		Metadata:    map[string]string{"region": "ap", "provider": "hetzner"},
+	}
+	for selector, want := range map[string]bool{
+		"":                         true,
+		"region=ap":                true,
+		"region=eu":                false,
+		"region!=eu":               true,
+		"tag=netflix":              true,
+		"tag=hulu":                 false,
+		"tag!=disney":              false,
+		"description~=tokyo":       true,
+		"ipv6":                     true,
+		"!ipv6":                    false,
+		"!zone":                    true,
+		"region=ap, tag=netflix":   true,
+		"region=ap,provider=vultr": false,
+	} {
+		s, err := ParseSelector(selector)
+		if err != nil {
+			t.Fatalf("%q: %v", selector, err)
+		}
+		if got := s.Matches(node); got != want {
+			t.Errorf("%q: expected %v, got %v", selector, want, got)
+		}
+	}
+
+	for _, selector := range []string{"=eu", "a b=c", "!"} {
+		if _, err := ParseSelector(selector); err == nil {
+			t.Errorf("expected %q to be rejected", selector)
+		}
+	}
+}
+
+func TestSelectorQueries(t *testing.T) {
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+	server := httptest.NewServer(service)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	var mutex sync.Mutex
+	received := map[string]bool{}
+	updates := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p patch
+		json.NewDecoder(r.Body).Decode(&p)
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, reg := range p.Added {
+			received[reg.ServiceURL] = true
+		}
+	}))
+	defer updates.Close()
+
+	// the web service of the eu region only subscribes to the nodes of its region
+	web := Registration{ServiceName: WebService, ServiceURL: "http://10.0.0.1:80", ServiceUpdateURL: updates.URL,
+		RequiredServices: []ServiceName{NodeService.Where("region=eu")}}
+	eu := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.1.1:80", Tags: []string{"netflix"}, Metadata: map[string]string{"region": "eu"}}
+	us := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.2.1:80", Metadata: map[string]string{"region": "us"}}
+	for _, reg := range []*Registration{&web, &eu, &us} {
+		if err := RegisterRequest(reg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mutex.Lock()
+		done := received[eu.ServiceURL]
+		mutex.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the eu node to be pushed to the web service")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mutex.Lock()
+	if received[us.ServiceURL] {
+		t.Error("expected the us node not to be pushed to the web service of the eu region")
+	}
+	mutex.Unlock()
+
+	get := func(query url.Values) (int, []Registration) {
+		res, err := http.Get(server.URL + "/services?" + query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		var regs []Registration
+		json.NewDecoder(res.Body).Decode(&regs)
+		return res.StatusCode, regs
+	}
+	if _, regs := get(url.Values{"serviceName": {"NodeService"}, "selector": {"region=us"}}); len(regs) != 1 || regs[0].ServiceURL != us.ServiceURL {
+		t.Errorf("expected the us node, got %+v", regs)
+	}
+	if _, regs := get(url.Values{"serviceName": {"NodeService?tag=netflix"}}); len(regs) != 1 || regs[0].ServiceURL != eu.ServiceURL {
+		t.Errorf("expected the node unlocking netflix, got %+v", regs)
+	}
+	if code, _ := get(url.Values{"serviceName": {"NodeService"}, "selector": {"=eu"}}); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid selector to be rejected, got %v", code)
+	}
+
+	// the cache keeps the providers matching a required selector apart
+	p := providers{services: map[ServiceName][]Registration{"NodeService?region=eu": nil}, resync: make(chan struct{}, 1), mutex: new(sync.RWMutex)}
+	p.Update(patch{Added: []Registration{eu, us}})
+	if regs, _ := p.get("NodeService?region=eu"); len(regs) != 1 || regs[0].ServiceURL != eu.ServiceURL {
+		t.Errorf("expected the cached eu node, got %+v", regs)
+	}
+	p.Update(patch{Removed: []Registration{eu}})
+	if regs, _ := p.get("NodeService?region=eu"); len(regs) != 0 {
+		t.Errorf("expected the removed eu node to be gone, got %+v", regs)
+	}
+}
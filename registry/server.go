@@ -2,62 +2,252 @@ package registry
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"go-distributed/registry/auth"
 	"go-distributed/registry/heartbeat"
 	"go-distributed/utils"
 	"io"
 	"log"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// snapshotInterval is how often the registry compacts its write-ahead log into a snapshot.
+const snapshotInterval = 20 * time.Second
+
+// patchTimeout is how long the registry waits for a service to accept a patch.
+const patchTimeout = 10 * time.Second
+
 type registry struct {
 	registrationsMap map[ServiceName][]Registration
+	index            uint64 // index of the last applied event
 	heartbeatServer  *heartbeat.HeartBeatServer
+	keyring          *auth.Keyring // signs the credentials of the services
+	ca               *auth.CA      // issues the certificates of the services, nil without mutual TLS
+	certHosts        *certHosts    // the hosts certificates are issued for, set with ca
+	transport        *switchTransport
+	client           *http.Client // for requests of the registry to services and other replicas
+	deliveries       *outcomes    // outcome of the last patch pushed to each service
+	probes           *prober      // health checks of the services
+	adminKey         string       // authorizes the admin API, disabled when empty
+	store            Store
+	raft             *raftNode     // nil when the registry runs standalone
+	history          []Event       // the most recent events, served to watchers
+	changed          chan struct{} // closed and replaced whenever an event is applied
 	mutex            *sync.RWMutex
+	updates          *sync.Mutex // held by update from reading a registration to committing its change
+	stop             chan struct{}
+	now              func() time.Time
 }
 
 func (r *registry) add(reg Registration) error {
-	// Check duplicate service with the same URL. If so, remove the old registration
-	if len(r.registrationsMap[reg.ServiceName]) > 0 {
-		for i := range r.registrationsMap[reg.ServiceName] {
-			if string(r.registrationsMap[reg.ServiceName][i].ServiceURL) == string(reg.ServiceURL) {
-				log.Printf("Service with URL %s already registered. Removing old registration.", reg.ServiceURL)
-				r.notify(patch{
-					Removed: []Registration{r.registrationsMap[reg.ServiceName][i]},
-				})
-				r.registrationsMap[reg.ServiceName] = append(r.registrationsMap[reg.ServiceName][:i], r.registrationsMap[reg.ServiceName][i+1:]...)
-			}
-		}
+	// Registrations with the same URL are replaced by the new one
+	replaced, err := r.commit(Event{Op: opAdd, Registration: reg, Time: r.now()})
+	if err != nil {
+		return err
 	}
 
-	r.mutex.Lock()
-	r.registrationsMap[reg.ServiceName] = append(r.registrationsMap[reg.ServiceName], reg)
-	r.mutex.Unlock()
+	if len(replaced) > 0 {
+		log.Printf("Service with URL %s already registered. Removing old registration.", reg.ServiceURL)
+		r.notify(patch{
+			Removed: replaced,
+		})
+	}
 
-	err := r.sendRequiredServices(reg)
+	err = r.sendRequiredServices(reg)
 	r.notify(patch{
 		Added: []Registration{reg},
 	})
 	return err
 }
 
-func (r *registry) remove(serviceName ServiceName, url string) error {
-	for i := range r.registrationsMap[serviceName] {
-		if string(r.registrationsMap[serviceName][i].ServiceURL) == url {
-			r.notify(patch{
-				Removed: []Registration{r.registrationsMap[serviceName][i]},
-			})
-			r.mutex.Lock()
-			r.registrationsMap[serviceName] = append(r.registrationsMap[serviceName][:i], r.registrationsMap[serviceName][i+1:]...)
-			r.mutex.Unlock()
-			fmt.Println("Removed service at URL: ", url)
-			return nil
+// remove deregisters the service at url among the providers keyed by key.
+func (r *registry) remove(key ServiceName, url string) error {
+	r.mutex.RLock()
+	var e *Event
+	for _, registration := range r.registrationsMap[key] {
+		if registration.ServiceURL == url {
+			e = &Event{Op: opRemove, Registration: registration, Time: r.now()}
+			break
 		}
 	}
-	return fmt.Errorf("service at URL %s not found", url)
+	r.mutex.RUnlock()
+
+	if e == nil {
+		return fmt.Errorf("service at URL %s not found", url)
+	}
+
+	removed, err := r.commit(*e)
+	if err != nil {
+		return err
+	}
+	if len(removed) == 0 {
+		return fmt.Errorf("service at URL %s not found", url)
+	}
+
+	r.notify(patch{
+		Removed: removed,
+	})
+	r.deliveries.forget(removed)
+	r.probes.forget(removed)
+	slog.Info("Removed service", "url", url)
+	return nil
+}
+
+// commit makes e durable and applies it. In a cluster the event is replicated through the raft log
+// and applied once a majority of replicas stored it.
+func (r *registry) commit(e Event) ([]Registration, error) {
+	if r.raft != nil {
+		return r.raft.propose(e)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	e.Index = r.index + 1
+	// Record the event before applying it, so an acknowledged registration survives a crash
+	if err := r.store.Append(e); err != nil {
+		return nil, err
+	}
+	return r.apply(e), nil
+}
+
+// applyCommitted applies an event committed by the raft log. Events already contained in the
+// restored state are skipped.
+func (r *registry) applyCommitted(e Event) []Registration {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if e.Index <= r.index {
+		return nil
+	}
+	// a committed event must be applied even if it cannot be persisted locally, the raft log still holds it
+	if err := r.store.Append(e); err != nil {
+		log.Println("Failed to persist registry event:", err)
+	}
+	return r.apply(e)
+}
+
+// apply mutates the registrations and heartbeat times with e. r.mutex must be held.
+func (r *registry) apply(e Event) []Registration {
+	r.heartbeatServer.Mutex.Lock()
+	defer r.heartbeatServer.Mutex.Unlock()
+
+	s := State{Registrations: r.registrationsMap, LastHeartBeat: r.heartbeatServer.LastHeartBeat}
+	removed := s.apply(e)
+	for _, registration := range removed {
+		delete(r.heartbeatServer.Info, registration.ServiceID)
+	}
+	r.index = e.Index
+	r.record(e)
+	r.observeSize(e.Registration.key())
+	return removed
+}
+
+// isLeader reports whether this replica accepts writes.
+func (r *registry) isLeader() bool {
+	return r.raft == nil || r.raft.isLeader()
+}
+
+// resetHeartbeats gives every registration a fresh heartbeat. It is called when this replica
+// becomes the leader, because heartbeats are only sent to the leader.
+func (r *registry) resetHeartbeats() {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	r.heartbeatServer.Mutex.Lock()
+	defer r.heartbeatServer.Mutex.Unlock()
+
+	now := r.now()
+	for _, registrations := range r.registrationsMap {
+		for _, registration := range registrations {
+			r.heartbeatServer.LastHeartBeat[registration.ServiceID] = now
+		}
+	}
+}
+
+// snapshot persists the current state and compacts the write-ahead log.
+func (r *registry) snapshot() error {
+	// hold the read lock until the log is truncated, so no event is appended in between
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.store.Snapshot(r.stateLocked())
+}
+
+// state returns a copy of the current state.
+func (r *registry) state() *State {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.stateLocked()
+}
+
+// stateLocked returns a copy of the current state. r.mutex must be held.
+func (r *registry) stateLocked() *State {
+	s := newState()
+	s.Index = r.index
+	for k, v := range r.registrationsMap {
+		s.Registrations[k] = append([]Registration(nil), v...)
+	}
+
+	r.heartbeatServer.Mutex.RLock()
+	for k, v := range r.heartbeatServer.LastHeartBeat {
+		s.LastHeartBeat[k] = v
+	}
+	r.heartbeatServer.Mutex.RUnlock()
+	return s
+}
+
+// restore replaces the state with s, a snapshot of the raft log replacing entries this replica missed.
+func (r *registry) restore(s *State) {
+	if s.Registrations == nil {
+		s.Registrations = make(map[ServiceName][]Registration)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := r.store.Snapshot(s); err != nil {
+		log.Println("Failed to persist registry snapshot:", err)
+	}
+
+	r.heartbeatServer.Mutex.Lock()
+	for id := range r.heartbeatServer.LastHeartBeat {
+		delete(r.heartbeatServer.LastHeartBeat, id)
+	}
+	for id, t := range s.LastHeartBeat {
+		r.heartbeatServer.LastHeartBeat[id] = t
+	}
+	for id := range r.heartbeatServer.Info {
+		if _, ok := s.LastHeartBeat[id]; !ok {
+			delete(r.heartbeatServer.Info, id)
+		}
+	}
+	r.heartbeatServer.Mutex.Unlock()
+
+	previous := r.registrationsMap
+	r.registrationsMap = s.Registrations
+	r.index = s.Index
+	for key := range previous {
+		r.observeSize(key)
+	}
+	for key := range r.registrationsMap {
+		r.observeSize(key)
+	}
+
+	// watchers cannot follow the jump and fetch the registrations again
+	r.history = nil
+	close(r.changed)
+	r.changed = make(chan struct{})
+	log.Printf("Restored the registry from a raft snapshot at index %d", s.Index)
 }
 
 func (r registry) notify(fullPatch patch) {
@@ -70,20 +260,25 @@ func (r registry) notify(fullPatch patch) {
 				for _, reqService := range reg.RequiredServices {
 					p := patch{Added: []Registration{}, Removed: []Registration{}}
 					sendUpdate := false
+					// required services are resolved in the namespace of the dependent
+					key, selector, err := splitSelector(reqService.In(reg.Namespace))
+					if err != nil {
+						continue
+					}
 					for _, added := range fullPatch.Added {
-						if added.ServiceName == reqService {
+						if added.key() == key && selector.Matches(added) {
 							p.Added = append(p.Added, added)
 							sendUpdate = true
 						}
 					}
 					for _, removed := range fullPatch.Removed {
-						if removed.ServiceName == reqService {
+						if removed.key() == key && selector.Matches(removed) {
 							p.Removed = append(p.Removed, removed)
 							sendUpdate = true
 						}
 					}
 					if sendUpdate {
-						err := r.sendPatch(reg.ServiceUpdateURL, p)
+						err := r.sendPatch(reg, p)
 						if err != nil {
 							log.Println(err)
 							return
@@ -102,9 +297,11 @@ func (r registry) sendRequiredServices(reg Registration) error {
 
 	// Create a patch with the current registrations for the required services
 	for _, serviceName := range reg.RequiredServices {
-		if services, ok := r.registrationsMap[serviceName]; ok {
-			p.Added = append(p.Added, services...)
+		key, selector, err := splitSelector(serviceName.In(reg.Namespace))
+		if err != nil {
+			continue
 		}
+		p.Added = append(p.Added, selector.filter(r.registrationsMap[key])...)
 	}
 
 	if len(p.Added) == 0 && len(p.Removed) == 0 {
@@ -112,35 +309,50 @@ func (r registry) sendRequiredServices(reg Registration) error {
 		return nil
 	}
 
-	err := r.sendPatch(reg.ServiceUpdateURL, p)
+	err := r.sendPatch(reg, p)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (r registry) sendPatch(url string, p patch) error {
+// sendPatch pushes p to the update URL of the service to and records the outcome.
+func (r registry) sendPatch(to Registration, p patch) (err error) {
+	defer func() {
+		r.deliveries.record(to.ServiceID, err)
+		patchDeliveries.WithLabelValues(result(err)).Inc()
+	}()
+	url := to.ServiceUpdateURL
+
 	d, err := json.Marshal(p)
 	if err != nil {
 		return err
 	}
 
-	// Send the patch to the service with regkey
+	// Sign the patch, so the service can tell it comes from the registry
+	token, err := r.bodyToken(d)
+	if err != nil {
+		return err
+	}
+
+	// A service that accepts the connection but never answers must not hold up the patches to others
+	ctx, cancel := context.WithTimeout(context.Background(), patchTimeout)
+	defer cancel()
 	buf := bytes.NewBuffer(d)
-	res, err := http.NewRequest(http.MethodPost, url, buf)
+	res, err := http.NewRequestWithContext(ctx, http.MethodPost, url, buf)
 	if err != nil {
 		return err
 	}
 
-	regkey := utils.Regkey()
 	res.Header.Add("Content-Type", "application/json")
-	res.Header.Add("regkey", regkey)
+	res.Header.Add("Authorization", "Bearer "+token)
 
 	log.Println("Sending patch to: ", url)
-	resp, err := http.DefaultClient.Do(res)
+	resp, err := r.client.Do(res)
 	if err != nil {
 		return err
 	}
+	resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("failed to send patch. Registry service responded with status code %v", resp.StatusCode)
@@ -151,14 +363,47 @@ func (r registry) sendPatch(url string, p patch) error {
 	return nil
 }
 
-var reg = registry{
-	registrationsMap: make(map[ServiceName][]Registration), // Initialize the map to store registrations
-	mutex:            new(sync.RWMutex),
+type RegistryService struct {
+	reg *registry
 }
 
-type RegistryService struct{}
-
 func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reg := s.reg
+
+	// Writes are only accepted by the leader of a cluster
+	if r.Method != http.MethodGet && !reg.isLeader() {
+		reg.redirectToLeader(w, r)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/services/watch":
+		reg.handleWatch(w, r)
+		return
+	case "/services/digest":
+		reg.handleDigest(w, r)
+		return
+	case "/services/drain":
+		reg.handleDrain(w, r)
+		return
+	case "/services/metadata":
+		reg.handleMetadata(w, r)
+		return
+	case "/services/keys":
+		reg.handleKeys(w, r)
+		return
+	case "/services/token":
+		reg.handleToken(w, r)
+		return
+	case "/services/certificate":
+		reg.handleCertificate(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, adminPath) {
+		reg.handleAdmin(w, r)
+		return
+	}
+
 	switch r.Method {
 
 	case http.MethodGet:
@@ -167,16 +412,36 @@ func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			// If no service name is provided, return error
 			w.WriteHeader(http.StatusBadRequest)
 			w.Write([]byte("Service name is required"))
+			return
+		}
+
+		// a bare service name is looked up in the namespace given by the query, the default one without,
+		// and the registrations can be narrowed by a selector in the service name or the query
+		ref := ServiceName(serviceName).In(r.URL.Query().Get("namespace"))
+		if s := r.URL.Query().Get("selector"); s != "" {
+			ref = ref.Where(s)
+		}
+		key, selector, err := splitSelector(ref)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// only the leader receives heartbeats, so requests for telemetry are served by it
+		if r.URL.Query().Get("telemetry") == "true" && !reg.isLeader() {
+			reg.redirectToLeader(w, r)
+			return
 		}
 
 		// Return the list of registrations for the requested service name
 		reg.mutex.RLock()
 		defer reg.mutex.RUnlock()
 
+		// watchers resume from this revision after fetching the full list
+		w.Header().Set(revisionHeader, strconv.FormatUint(reg.index, 10))
 		w.Header().Set("Content-Type", "application/json")
-		if services, ok := reg.registrationsMap[ServiceName(serviceName)]; ok {
+		if services := selector.filter(reg.registrationsMap[key]); len(services) > 0 {
 			// Marshal the registrations to JSON and return
-			d, err := json.Marshal(services)
+			d, err := json.Marshal(reg.withInfo(services))
 			if err != nil {
 				log.Println(err)
 				w.WriteHeader(http.StatusInternalServerError)
@@ -192,11 +457,7 @@ func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 
 	case http.MethodPost:
-		// Check if the node is authorized
-		if utils.Regkey() != r.Header.Get("regkey") {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
+		regkey := r.Header.Get("regkey")
 
 		// Decode the request
 		dec := json.NewDecoder(r.Body)
@@ -209,25 +470,51 @@ func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// The registration key is only needed to register, afterwards services use the token they are
+		// issued. Each service name has its own key, and no service may sign as the registry.
+		if r.ServiceName == auth.Registry {
+			http.Error(w, "Service name is reserved", http.StatusForbidden)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(auth.RegistrationKey(utils.Regkey(), string(r.ServiceName))), []byte(regkey)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
 		if r.ServiceName == "" || r.ServiceURL == "" {
 			log.Println("Service name or URL is empty")
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+		if err := r.validateNamespace(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.validateMetadata(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.validateHealthCheck(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := r.validatePolicy(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		log.Printf("Adding service %s with URL: %s", r.ServiceName, r.ServiceURL)
 
 		// generate uuid as ServiceID
 		r.ServiceID = utils.GenerateUUID()
-
-		// update last heartbeat for the service
-		if r.ServiceID != "" {
-			reg.heartbeatServer.Mutex.Lock()
-			reg.heartbeatServer.LastHeartBeat[r.ServiceID] = time.Now()
-			reg.heartbeatServer.Mutex.Unlock()
+		// telemetry only arrives with heartbeats and is not persisted
+		r.Info = nil
+		r.Health = Healthy
+		if r.Namespace == "" {
+			r.Namespace = DefaultNamespace
 		}
 
-		// Add the service to the registry
+		// Add the service to the registry, which also records its first heartbeat
 		err = reg.add(r)
 		if err != nil {
 			log.Println(err)
@@ -235,6 +522,14 @@ func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		token, err := reg.issueToken(r)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set(tokenHeader, token)
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(r.ServiceID))
 
@@ -252,8 +547,21 @@ func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
+
+		// a service may only deregister itself
+		claims, err := reg.authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		registration, ok := reg.lookup(claims.ServiceID)
+		if !ok || registration.ServiceURL != url || string(registration.ServiceName) != serviceName {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
 		log.Printf("Removing service %s at URL: %s", serviceName, url)
-		err = reg.remove(ServiceName(serviceName), url)
+		err = reg.remove(registration.key(), url)
 		if err != nil {
 			log.Println(err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -265,6 +573,11 @@ func (s RegistryService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (r *registry) IsServiceDraining(serviceID string) bool {
+	registration, ok := r.lookup(serviceID)
+	return ok && registration.Draining
+}
+
 func (r *registry) IsServiceRegistered(serviceID string) bool {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
@@ -281,48 +594,150 @@ func (r *registry) IsServiceRegistered(serviceID string) bool {
 	return false
 }
 
-// remove inactive services from the registry
-func removeInactiveServices() {
-	var snapshot map[ServiceName][]Registration
-	var lastHeartBeat map[string]time.Time
+// withInfo returns a copy of registrations with the latest telemetry of each service attached.
+// Telemetry is held by the replica receiving the heartbeats, so followers of a cluster serve none;
+// GET /services?telemetry=true is redirected to the leader.
+func (r *registry) withInfo(registrations []Registration) []Registration {
+	r.heartbeatServer.Mutex.RLock()
+	defer r.heartbeatServer.Mutex.RUnlock()
+
+	out := make([]Registration, len(registrations))
+	for i, registration := range registrations {
+		if info, ok := r.heartbeatServer.Info[registration.ServiceID]; ok {
+			registration.Info = &info
+		}
+		out[i] = registration
+	}
+	return out
+}
 
-	reg.mutex.RLock()
-	snapshot = make(map[ServiceName][]Registration)
-	for k, v := range reg.registrationsMap {
-		snapshot[k] = make([]Registration, len(v))
-		copy(snapshot[k], v)
+// LeaderOnly wraps h so that requests reaching a follower replica are redirected to the leader.
+// Heartbeats are wrapped this way, as only the leader expires inactive services.
+func (s RegistryService) LeaderOnly(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.reg.isLeader() {
+			s.reg.redirectToLeader(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Raft returns the handler for replication requests between replicas, or nil when running standalone.
+func (s RegistryService) Raft() http.Handler {
+	if s.reg.raft == nil {
+		return nil
 	}
-	reg.mutex.RUnlock()
+	return s.reg.raft
+}
 
-	reg.heartbeatServer.Mutex.RLock()
-	lastHeartBeat = make(map[string]time.Time)
-	for k, v := range reg.heartbeatServer.LastHeartBeat {
-		lastHeartBeat[k] = v
+// UseKeyring makes the registry sign credentials with the keys of k, which also authenticate the
+// replicas of a cluster to each other. It must be called before serving.
+func (s RegistryService) UseKeyring(k *auth.Keyring) {
+	s.reg.keyring = k
+	if s.reg.raft != nil {
+		s.reg.raft.keyring.Store(k)
 	}
-	reg.heartbeatServer.Mutex.RUnlock()
+}
 
-	for serviceName, registrations := range snapshot {
-		for _, registration := range registrations {
-			fmt.Println("Checking service: ", serviceName, " at URL: ", registration.ServiceURL, " last heartbeat: ", lastHeartBeat[registration.ServiceID])
-			if time.Since(lastHeartBeat[registration.ServiceID]) > 20*time.Second {
-				log.Printf("Removing inactive service %s at URL: %s", serviceName, registration.ServiceURL)
-				if err := reg.remove(ServiceName(serviceName), registration.ServiceURL); err != nil {
-					log.Println(err)
-				}
-			}
-		}
+// Close stops the background loops of the registry.
+func (s RegistryService) Close() {
+	close(s.reg.stop)
+	if s.reg.raft != nil {
+		s.reg.raft.close()
+	}
+}
+
+func (r *registry) redirectToLeader(w http.ResponseWriter, req *http.Request) {
+	leader := r.raft.leader()
+	if leader == "" {
+		http.Error(w, "No registry leader elected", http.StatusServiceUnavailable)
+		return
 	}
+	// 307 keeps the method and body, so clients transparently retry against the leader
+	http.Redirect(w, req, leader+req.URL.RequestURI(), http.StatusTemporaryRedirect)
 }
 
-func NewRegistryService(HBServer *heartbeat.HeartBeatServer) *RegistryService {
-	reg.heartbeatServer = HBServer
-	reg.heartbeatServer.Validator = &reg
+// ClusterConfig lists the replicas of a registry cluster. Self is the base URL of this replica,
+// e.g. http://10.0.0.1:80, and Peers the base URLs of the others. Without peers the registry runs standalone.
+type ClusterConfig struct {
+	Self    string
+	Peers   []string
+	DataDir string // where the replication log is kept; in memory when empty
+}
+
+// NewRegistryService restores the registry from store and starts the periodic removal of inactive services.
+func NewRegistryService(HBServer *heartbeat.HeartBeatServer, store Store, cluster ClusterConfig) (*RegistryService, error) {
+	state, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	// a generated key until UseKeyring is called, e.g. in tests
+	keyring, err := auth.LoadKeyring("")
+	if err != nil {
+		return nil, err
+	}
 
+	transport := &switchTransport{}
+	reg := &registry{
+		registrationsMap: state.Registrations,
+		index:            state.Index,
+		heartbeatServer:  HBServer,
+		keyring:          keyring,
+		transport:        transport,
+		client:           &http.Client{Transport: transport},
+		deliveries:       newOutcomes(HBServer.Now),
+		probes:           &prober{outcomes: newOutcomes(HBServer.Now), due: make(map[string]time.Time)},
+		store:            store,
+		changed:          make(chan struct{}),
+		mutex:            new(sync.RWMutex),
+		updates:          new(sync.Mutex),
+		stop:             make(chan struct{}),
+		now:              HBServer.Now,
+	}
+	HBServer.Validator = reg
+	for key := range reg.registrationsMap {
+		reg.observeSize(key)
+	}
+
+	HBServer.Mutex.Lock()
+	for id, t := range state.LastHeartBeat {
+		HBServer.LastHeartBeat[id] = t
+	}
+	HBServer.Mutex.Unlock()
+
+	if len(cluster.Peers) > 0 {
+		reg.raft, err = newRaftNode(cluster, state.Index, reg, keyring, transport)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Registry replica %s joining cluster with peers %v", cluster.Self, cluster.Peers)
+	} else {
+		// services that were already stale when regservice stopped are pruned right away
+		reg.sweep()
+	}
+
+	sweep := time.NewTicker(SweepInterval)
 	go func() {
-		for range time.Tick(20 * time.Second) {
-			log.Println("Checking inactive services...")
-			removeInactiveServices()
+		defer sweep.Stop()
+		snapshot := time.NewTicker(snapshotInterval)
+		defer snapshot.Stop()
+		for {
+			select {
+			case <-reg.stop:
+				return
+			case <-sweep.C:
+				// only the leader receives heartbeats, so only the leader judges services by them
+				if reg.isLeader() {
+					reg.sweep()
+				}
+			case <-snapshot.C:
+				if err := reg.snapshot(); err != nil {
+					log.Println("Failed to snapshot registry:", err)
+				}
+			}
 		}
 	}()
-	return &RegistryService{}
+	return &RegistryService{reg: reg}, nil
 }
@@ -0,0 +1,282 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	opAdd    = "add"
+	opRemove = "remove"
+	opUpdate = "update" // replaces the registration with the same ServiceID, e.g. to mark it draining
+	opNoop   = "noop"   // appended by a new raft leader to commit entries of earlier terms
+)
+
+// Event is a single registry mutation as recorded in the write-ahead log.
+type Event struct {
+	Index        uint64       `json:"index"` // position of the event in the registry history
+	Op           string       `json:"op"`    // opAdd, opRemove, opUpdate or opNoop
+	Registration Registration `json:"registration"`
+	Time         time.Time    `json:"time"`
+}
+
+// State is the full registry state as persisted by a Store.
+type State struct {
+	Index         uint64                         `json:"index"` // index of the last applied event
+	Registrations map[ServiceName][]Registration `json:"registrations"`
+	LastHeartBeat map[string]time.Time           `json:"last_heartbeat"`
+	SavedAt       time.Time                      `json:"saved_at"`
+}
+
+func newState() *State {
+	return &State{
+		Registrations: make(map[ServiceName][]Registration),
+		LastHeartBeat: make(map[string]time.Time),
+	}
+}
+
+// apply mutates the state with e and returns the registrations it replaced or removed.
+func (s *State) apply(e Event) []Registration {
+	if e.Index > s.Index {
+		s.Index = e.Index
+	}
+	if e.Op == opNoop {
+		return nil
+	}
+
+	var removed []Registration
+	name := e.Registration.key()
+	kept := make([]Registration, 0, len(s.Registrations[name])+1)
+
+	for _, r := range s.Registrations[name] {
+		// an added service replaces any older registration at the same URL
+		if (e.Op == opAdd && r.ServiceURL == e.Registration.ServiceURL) ||
+			(e.Op == opRemove && r.ServiceID == e.Registration.ServiceID) {
+			removed = append(removed, r)
+			delete(s.LastHeartBeat, r.ServiceID)
+			continue
+		}
+		if e.Op == opUpdate && r.ServiceID == e.Registration.ServiceID {
+			r = e.Registration
+		}
+		kept = append(kept, r)
+	}
+
+	if e.Op == opAdd {
+		kept = append(kept, e.Registration)
+		s.LastHeartBeat[e.Registration.ServiceID] = e.Time
+	}
+
+	if len(kept) == 0 {
+		delete(s.Registrations, name)
+	} else {
+		s.Registrations[name] = kept
+	}
+
+	return removed
+}
+
+// Store persists registry state so that registrations and their ServiceIDs survive a restart of regservice.
+type Store interface {
+	// Load returns the persisted state. Heartbeat times are rebased to the time of loading,
+	// so that the downtime of regservice does not count against the services.
+	Load() (*State, error)
+	// Append durably records e before it is applied.
+	Append(e Event) error
+	// Snapshot replaces the persisted state with s and truncates the log.
+	Snapshot(s *State) error
+	Close() error
+}
+
+// OpenStore returns the store selected by kind: "file" (the default) keeps a snapshot and
+// write-ahead log in dir, "memory" keeps nothing across restarts.
+func OpenStore(kind, dir string) (Store, error) {
+	switch kind {
+	case "", "file":
+		if dir == "" {
+			dir = "regdata"
+		}
+		return OpenFileStore(dir)
+	case "memory":
+		return memoryStore{}, nil
+	default:
+		return nil, fmt.Errorf("unknown registry store %q", kind)
+	}
+}
+
+type memoryStore struct{}
+
+func (memoryStore) Load() (*State, error) { return newState(), nil }
+func (memoryStore) Append(Event) error    { return nil }
+func (memoryStore) Snapshot(*State) error { return nil }
+func (memoryStore) Close() error          { return nil }
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "wal.log"
+)
+
+type fileStore struct {
+	dir   string
+	wal   *os.File
+	mutex sync.Mutex
+}
+
+// OpenFileStore opens or creates an on-disk store in dir.
+func OpenFileStore(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileStore{dir: dir, wal: wal}, nil
+}
+
+func (fs *fileStore) Load() (*State, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	now := time.Now()
+	state := newState()
+
+	data, err := os.ReadFile(filepath.Join(fs.dir, snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, fmt.Errorf("corrupt registry snapshot: %w", err)
+		}
+		for id, t := range state.LastHeartBeat {
+			state.LastHeartBeat[id] = now.Add(-state.SavedAt.Sub(t))
+		}
+	}
+
+	events, size, err := fs.readLog()
+	if err != nil {
+		return nil, err
+	}
+	// appends go after the last good record rather than after what was dropped
+	if info, err := fs.wal.Stat(); err != nil {
+		return nil, err
+	} else if info.Size() > size {
+		if err := fs.wal.Truncate(size); err != nil {
+			return nil, err
+		}
+		if err := fs.wal.Sync(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(events) > 0 {
+		last := events[len(events)-1].Time
+		for _, e := range events {
+			e.Time = now.Add(-last.Sub(e.Time))
+			state.apply(e)
+		}
+	}
+
+	log.Printf("Restored %d service names from snapshot and %d log records in %s", len(state.Registrations), len(events), fs.dir)
+
+	state.SavedAt = now
+	return state, nil
+}
+
+// readLog returns the events in the write-ahead log and the size of the log up to the last of
+// them. A torn record at the end of the log, left by a crash during Append, is dropped.
+func (fs *fileStore) readLog() ([]Event, int64, error) {
+	data, err := os.ReadFile(filepath.Join(fs.dir, walFile))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var events []Event
+	var size int64
+	for len(data) > 0 {
+		line, rest, complete := bytes.Cut(data, []byte{'\n'})
+		if !complete {
+			log.Printf("Dropping torn registry log record at offset %d", size)
+			break
+		}
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.Printf("Dropping unreadable registry log record at offset %d: %v", size, err)
+			break
+		}
+		events = append(events, e)
+		size += int64(len(line)) + 1
+		data = rest
+	}
+
+	return events, size, nil
+}
+
+func (fs *fileStore) Append(e Event) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if _, err := fs.wal.Write(append(d, '\n')); err != nil {
+		return err
+	}
+	return fs.wal.Sync()
+}
+
+func (fs *fileStore) Snapshot(s *State) error {
+	s.SavedAt = time.Now()
+	d, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	// write the snapshot to a temporary file and rename it, so a crash never leaves a partial snapshot
+	tmp := filepath.Join(fs.dir, snapshotFile+".tmp")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(d); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(fs.dir, snapshotFile)); err != nil {
+		return err
+	}
+
+	// every event in the log is now part of the snapshot
+	if err := fs.wal.Truncate(0); err != nil {
+		return err
+	}
+	return fs.wal.Sync()
+}
+
+func (fs *fileStore) Close() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.wal.Close()
+}
@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	store, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80", ServiceID: "node-1"}
+	web := Registration{ServiceName: WebService, ServiceURL: "http://10.0.0.2:80", ServiceID: "web-1"}
+	restarted := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80", ServiceID: "node-2"}
+
+	now := time.Now()
+	for _, e := range []Event{
+		{Op: opAdd, Registration: node, Time: now},
+		{Op: opAdd, Registration: web, Time: now},
+	} {
+		if err := store.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Snapshot(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restarted node at the same URL replaces the old registration, then the web service leaves
+	for _, e := range []Event{
+		{Op: opAdd, Registration: restarted, Time: now.Add(time.Second)},
+		{Op: opRemove, Registration: web, Time: now.Add(2 * time.Second)},
+	} {
+		if err := store.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	// simulate a crash in the middle of an append
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"add","registration":{"ServiceName":"Node`)
+	f.Close()
+
+	store, err = OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	state, err = store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := state.Registrations[NodeService]
+	if len(nodes) != 1 || nodes[0].ServiceID != "node-2" {
+		t.Errorf("expected only node-2 to be registered, got %v", nodes)
+	}
+	if _, ok := state.Registrations[WebService]; ok {
+		t.Errorf("expected web service to be removed, got %v", state.Registrations[WebService])
+	}
+	if _, ok := state.LastHeartBeat["node-1"]; ok {
+		t.Error("expected heartbeat of replaced registration to be dropped")
+	}
+	if age := time.Since(state.LastHeartBeat["node-2"]); age > 2*time.Second {
+		t.Errorf("expected heartbeat to be rebased to load time, got age %v", age)
+	}
+	// the torn record is cut off, so the next append is not glued to it
+	web.ServiceID = "web-2"
+	if err := store.Append(Event{Op: opAdd, Registration: web, Time: now.Add(3 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	store, err = OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if state, err = store.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if webs := state.Registrations[WebService]; len(webs) != 1 || webs[0].ServiceID != "web-2" {
+		t.Errorf("expected the record appended after the torn one to be replayed, got %v", webs)
+	}
+}
@@ -0,0 +1,62 @@
+package registry
+
+import (
+	"go-distributed/registry/heartbeat"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestInfoHeartbeat(t *testing.T) {
+	HBServer := heartbeat.NewHeartBeatServer()
+	service, err := NewRegistryService(HBServer, memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/heartbeat/", HBServer)
+	mux.Handle("/services", service)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	node := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80"}
+	if err := RegisterRequest(&node); err != nil {
+		t.Fatal(err)
+	}
+
+	regs, err := FetchProviders(NodeService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regs[0].Info != nil {
+		t.Fatalf("expected no telemetry before the first info heartbeat, got %+v", regs[0].Info)
+	}
+
+	hb := heartbeat.NewInfoHeartbeat(func() (heartbeat.ServerInfo, error) {
+		return heartbeat.ServerInfo{CPUUsage: 42.5, Connections: 7, Throughput: 1 << 20}, nil
+	}, server.URL+"/heartbeat/")
+	hb.(*heartbeat.InfoHeartbeat).ServiceID = node.ServiceID
+	if err := hb.SendHeartbeat(); err != nil {
+		t.Fatal(err)
+	}
+
+	regs, err = FetchProviders(NodeService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := regs[0].Info
+	if info == nil || info.CPUUsage != 42.5 || info.Connections != 7 || info.Throughput != 1<<20 || info.ReceivedAt.IsZero() {
+		t.Fatalf("expected the reported telemetry, got %+v", info)
+	}
+
+	// the telemetry goes away with the registration
+	if err := service.reg.remove(NodeService, node.ServiceURL); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := HBServer.Info[node.ServiceID]; ok {
+		t.Error("expected the telemetry of a removed service to be dropped")
+	}
+}
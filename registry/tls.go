@@ -0,0 +1,400 @@
+package registry
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"go-distributed/registry/auth"
+	"go-distributed/registry/heartbeat"
+	"go-distributed/tracing"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertTTL is the lifetime of the certificates the registry issues. Services renew them at half-life.
+var CertTTL = 12 * time.Hour
+
+// switchTransport forwards requests to the current transport, so mutual TLS can be enabled after
+// the clients using it were created.
+type switchTransport struct {
+	current atomic.Pointer[http.Transport]
+}
+
+func (t *switchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tr := t.current.Load(); tr != nil {
+		return tr.RoundTrip(req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// tlsTransport returns a transport presenting the certificate returned by getCert and trusting roots.
+func tlsTransport(roots *x509.CertPool, getCert func() *tls.Certificate) *http.Transport {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert := getCert(); cert != nil {
+				return cert, nil
+			}
+			// no certificate yet, e.g. while registering
+			return &tls.Certificate{}, nil
+		},
+	}
+	return tr
+}
+
+// identity is the TLS identity of this service: its key, the certificate the registry issued for it
+// and the CA certificate of the registry.
+var identity struct {
+	roots   *x509.CertPool
+	key     *ecdsa.PrivateKey
+	cert    atomic.Pointer[tls.Certificate]
+	enabled atomic.Bool
+	mutex   sync.Mutex // serializes certificate requests
+}
+
+var (
+	serviceTransport = &switchTransport{}
+	httpClient       = &http.Client{Transport: tracing.Transport(serviceTransport)}
+)
+
+// UseRegistryCA enables mutual TLS for this service. caPEM is the certificate of the registry CA, which
+// signs the certificates of all services. It is read from the file in Registry_CAFile on startup.
+func UseRegistryCA(caPEM []byte) error {
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no CA certificate found")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	identity.mutex.Lock()
+	identity.roots = roots
+	identity.key = key
+	identity.cert.Store(nil)
+	identity.mutex.Unlock()
+
+	serviceTransport.current.Store(tlsTransport(roots, identity.cert.Load))
+	heartbeat.Client = httpClient
+	identity.enabled.Store(true)
+	return nil
+}
+
+// TLSEnabled reports whether services talk to each other over mutual TLS.
+func TLSEnabled() bool {
+	return identity.enabled.Load()
+}
+
+// ServiceURL returns the base URL of a service listening on host and port, with https when mutual TLS is enabled.
+func ServiceURL(host, port string) string {
+	scheme := "http"
+	if TLSEnabled() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, port))
+}
+
+// HTTPClient returns the client for requests to other services. With mutual TLS it presents the
+// certificate of this service and only trusts services with a certificate of the registry CA.
+func HTTPClient() *http.Client {
+	return httpClient
+}
+
+// ServerTLSConfig returns the TLS configuration of a service server, which requires clients to present
+// a certificate of the registry CA. The server certificate is available once the service registered.
+func ServerTLSConfig() *tls.Config {
+	identity.mutex.Lock()
+	roots := identity.roots
+	identity.mutex.Unlock()
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  roots,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if cert := identity.cert.Load(); cert != nil {
+				return cert, nil
+			}
+			return nil, fmt.Errorf("no certificate issued yet")
+		},
+	}
+}
+
+// renewCertificate requests a certificate for r if it has none or its certificate is past half-life.
+func renewCertificate(r *Registration) error {
+	if !TLSEnabled() {
+		return nil
+	}
+	if cert := identity.cert.Load(); cert != nil && time.Until(cert.Leaf.NotAfter) > CertTTL/2 {
+		return nil
+	}
+	return requestCertificate(r)
+}
+
+// requestCertificate has the registry sign a certificate for the key of this service.
+func requestCertificate(r *Registration) error {
+	identity.mutex.Lock()
+	defer identity.mutex.Unlock()
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: string(r.ServiceName)},
+	}, identity.key)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-pem-file")
+	header.Set("Authorization", "Bearer "+Token())
+	body := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+
+	res, err := endpoints.do(http.MethodPost, "/services/certificate", body, header)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to get certificate. Registry service responded with status code %v", res.StatusCode)
+	}
+
+	certPEM, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	cert, err := auth.KeyPair(certPEM, identity.key)
+	if err != nil {
+		return err
+	}
+	identity.cert.Store(cert)
+	log.Printf("Certificate issued for %s, valid until %v", r.ServiceName, cert.Leaf.NotAfter)
+	return nil
+}
+
+// handleCertificate signs a certificate request of a registered service. The certificate is only
+// valid for the hosts of the registration the registry checked, whatever the request asks for.
+func (r *registry) handleCertificate(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.ca == nil {
+		http.Error(w, "Mutual TLS is not enabled", http.StatusNotFound)
+		return
+	}
+
+	claims, err := r.authenticate(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	reg, ok := r.lookup(claims.ServiceID)
+	if !ok {
+		http.Error(w, "Service not registered", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	block, _ := pem.Decode(body)
+	if block == nil {
+		http.Error(w, "Certificate request is not PEM encoded", http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err == nil {
+		err = csr.CheckSignature()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hosts, err := r.certHosts.check(req.Context(), reg, req.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	certPEM, err := r.ca.Issue(csr.PublicKey, string(reg.ServiceName), hosts, CertTTL)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(certPEM)
+}
+
+// registrationHosts returns the hosts a service is reached at.
+func registrationHosts(reg Registration) []string {
+	var hosts []string
+	for _, raw := range []string{reg.ServiceURL, reg.ServiceUpdateURL} {
+		if u, err := url.Parse(raw); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+	return append(hosts, reg.PublicIP, reg.PublicIPv6)
+}
+
+// lookupHost resolves the host names of registrations, replaced in tests.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// certHosts decides which hosts of a registration its certificate is valid for. Services declare their
+// hosts themselves, so a host is only issued if it is, or resolves to, the address the certificate
+// request comes from, and if it is neither a host of the registry nor held by another registration.
+type certHosts struct {
+	reserved map[string]bool       // hosts of the registry
+	holders  map[string]certHolder // the registration last issued a certificate for each host
+	lookup   func(serviceID string) (Registration, bool)
+	mutex    sync.Mutex
+}
+
+type certHolder struct {
+	serviceID string
+	addr      string // the address it requested the certificate from
+}
+
+// newCertHosts reserves registryHosts for the registry. Loopback hosts are left to the services
+// sharing the machine of the registry, as only they can reach it there.
+func newCertHosts(registryHosts []string, lookup func(serviceID string) (Registration, bool)) *certHosts {
+	c := &certHosts{reserved: make(map[string]bool), holders: make(map[string]certHolder), lookup: lookup}
+	for _, host := range registryHosts {
+		if !isLoopback(host) {
+			c.reserved[strings.ToLower(host)] = true
+		}
+	}
+	return c
+}
+
+// check returns the hosts of reg a certificate requested from remoteAddr may be valid for, and records
+// reg as their holder. Services sharing an address, e.g. a machine, may share its hosts.
+func (c *certHosts) check(ctx context.Context, reg Registration, remoteAddr string) ([]string, error) {
+	addr, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var resolved []string
+	for _, host := range registrationHosts(reg) {
+		host = strings.ToLower(host)
+		if host == "" || slices.Contains(resolved, host) {
+			continue
+		}
+		if resolvesTo(ctx, host, addr) {
+			resolved = append(resolved, host)
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var hosts []string
+	for _, host := range resolved {
+		if c.reserved[host] {
+			log.Printf("Not issuing host %s, a host of the registry, to service %s", host, reg.ServiceID)
+			continue
+		}
+		if holder, ok := c.holders[host]; ok && holder.serviceID != reg.ServiceID && holder.addr != addr {
+			if _, registered := c.lookup(holder.serviceID); registered {
+				log.Printf("Not issuing host %s to service %s, service %s holds it", host, reg.ServiceID, holder.serviceID)
+				continue
+			}
+		}
+		hosts = append(hosts, host)
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no host of the registration resolves to %s", addr)
+	}
+	for _, host := range hosts {
+		c.holders[host] = certHolder{serviceID: reg.ServiceID, addr: addr}
+	}
+	return hosts, nil
+}
+
+// resolvesTo reports whether host is the IP address addr or a name resolving to it.
+func resolvesTo(ctx context.Context, host, addr string) bool {
+	ip := net.ParseIP(addr)
+	if hostIP := net.ParseIP(host); hostIP != nil {
+		return hostIP.Equal(ip)
+	}
+	ips, err := lookupHost(ctx, host)
+	if err != nil {
+		return false
+	}
+	for _, resolved := range ips {
+		if net.ParseIP(resolved).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLoopback(host string) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	}
+	return strings.EqualFold(host, "localhost")
+}
+
+// UseCA enables mutual TLS on the registry: ca issues the certificates of the services and of the
+// registry itself, valid for hosts, which services get no certificate for. It returns the TLS configuration of the registry server, which
+// accepts clients without a certificate, as services only get one after registering.
+// It must be called before serving.
+func (s RegistryService) UseCA(ca *auth.CA, hosts []string) *tls.Config {
+	r := s.reg
+	r.ca = ca
+	r.certHosts = newCertHosts(hosts, r.lookup)
+
+	var (
+		cert  atomic.Pointer[tls.Certificate]
+		mutex sync.Mutex
+	)
+	// the registry issues its own certificate, and a new one at half-life
+	current := func() *tls.Certificate {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if c := cert.Load(); c != nil && time.Until(c.Leaf.NotAfter) > CertTTL/2 {
+			return c
+		}
+		c, err := ca.IssueTLS(auth.Registry, hosts, CertTTL)
+		if err != nil {
+			log.Println("Failed to issue registry certificate:", err)
+			return cert.Load()
+		}
+		cert.Store(c)
+		return c
+	}
+
+	r.transport.current.Store(tlsTransport(ca.Pool(), current))
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  ca.Pool(),
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if c := current(); c != nil {
+				return c, nil
+			}
+			return nil, fmt.Errorf("no registry certificate")
+		},
+	}
+}
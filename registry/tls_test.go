@@ -0,0 +1,161 @@
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"go-distributed/registry/auth"
+	"go-distributed/registry/heartbeat"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTLS serves handler with config on a loopback port. Unlike httptest.Server.StartTLS it does
+// not add a certificate of its own, which would take precedence over config.GetCertificate.
+func serveTLS(t *testing.T, handler http.Handler, config *tls.Config) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: handler}
+	go srv.Serve(tls.NewListener(l, config))
+	t.Cleanup(func() { srv.Close() })
+	return "https://" + l.Addr().String()
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := auth.LoadOrCreateCA(filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	registryURL := serveTLS(t, service, service.UseCA(ca, []string{"127.0.0.1"}))
+
+	if err := UseRegistryCA(ca.CertPEM()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		identity.enabled.Store(false)
+		identity.cert.Store(nil)
+		serviceTransport.current.Store(nil)
+		heartbeat.Client = http.DefaultClient
+	}()
+	SetEndpoints(registryURL)
+
+	patched := make(chan struct{}, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/services", func(w http.ResponseWriter, r *http.Request) {
+		(&serviceUpdateHandler{}).ServeHTTP(w, r)
+		select {
+		case patched <- struct{}{}:
+		default:
+		}
+	})
+	webURL := serveTLS(t, mux, ServerTLSConfig())
+
+	reg := Registration{
+		ServiceName:      WebService,
+		ServiceURL:       webURL,
+		ServiceUpdateURL: webURL + "/services",
+		RequiredServices: []ServiceName{NodeService},
+	}
+	if err := RegisterRequest(&reg); err != nil {
+		t.Fatal(err)
+	}
+	if err := renewCertificate(&reg); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := HTTPClient().Get(webURL + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	// trusting the CA is not enough, the server requires a client certificate
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.Pool()}}}
+	if res, err := anonymous.Get(webURL + "/ping"); err == nil {
+		res.Body.Close()
+		t.Error("expected a client without certificate to be rejected")
+	}
+
+	// the registry presents its own certificate when pushing patches
+	node := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80"}
+	if err := RegisterRequest(&node); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-patched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a patch over mutual TLS")
+	}
+	providers, err := GetProviders(NodeService)
+	if err != nil || len(providers) != 1 || providers[0].ServiceID != node.ServiceID {
+		t.Errorf("expected the patch to add the node, got %+v, %v", providers, err)
+	}
+}
+
+func TestCertificateHosts(t *testing.T) {
+	defer func(lookup func(context.Context, string) ([]string, error)) { lookupHost = lookup }(lookupHost)
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		switch host {
+		case "web.internal":
+			return []string{"127.0.0.1", "10.0.0.5"}, nil
+		case "registry.internal":
+			return []string{"127.0.0.1"}, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+
+	registered := map[string]bool{}
+	c := newCertHosts([]string{"localhost", "127.0.0.1", "registry.internal", "10.0.0.1"}, func(serviceID string) (Registration, bool) {
+		return Registration{}, registered[serviceID]
+	})
+
+	web := Registration{
+		ServiceID:        "web",
+		ServiceURL:       "https://web.internal:443",
+		ServiceUpdateURL: "https://registry.internal/services", // a host of the registry
+		PublicIP:         "203.0.113.9",                        // not the address the request comes from
+	}
+	registered["web"] = true
+	hosts, err := c.check(context.Background(), web, "127.0.0.1:50000")
+	if err != nil || strings.Join(hosts, ",") != "web.internal" {
+		t.Fatalf("expected only the checked host of the registration, got %v, %v", hosts, err)
+	}
+
+	// a service on the same machine shares its hosts
+	payment := Registration{ServiceID: "payment", ServiceURL: "https://web.internal:8080", PublicIP: "127.0.0.1"}
+	registered["payment"] = true
+	hosts, err = c.check(context.Background(), payment, "127.0.0.1:50001")
+	if err != nil || strings.Join(hosts, ",") != "web.internal,127.0.0.1" {
+		t.Errorf("expected a service on the same machine to share the hosts, got %v, %v", hosts, err)
+	}
+
+	// another machine the name resolves to cannot take it while its holder is registered
+	impostor := Registration{ServiceID: "impostor", ServiceURL: "https://web.internal:443"}
+	if hosts, err := c.check(context.Background(), impostor, "10.0.0.5:50000"); err == nil {
+		t.Errorf("expected a host held by another registration to be refused, got %v", hosts)
+	}
+	delete(registered, "payment")
+	if hosts, err := c.check(context.Background(), impostor, "10.0.0.5:50000"); err != nil || strings.Join(hosts, ",") != "web.internal" {
+		t.Errorf("expected the host to be issued once its holder is gone, got %v, %v", hosts, err)
+	}
+
+	// the hosts of the registry are never issued
+	if hosts, err := c.check(context.Background(), Registration{ServiceID: "node", ServiceURL: "http://10.0.0.1:80"}, "10.0.0.1:50000"); err == nil {
+		t.Errorf("expected a host of the registry to be refused, got %v", hosts)
+	}
+}
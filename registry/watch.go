@@ -0,0 +1,303 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Every applied event bumps the registry revision, which is the index of the event. Clients fetch
+// the full list of a service with GET /services, which reports the revision in revisionHeader, and
+// then long-poll GET /services/watch?serviceName=X&since=<revision> for the events after it.
+// When the requested revision is no longer in the history the watch answers 410 Gone and the client
+// must fetch the full list again.
+
+const (
+	revisionHeader   = "X-Registry-Revision"
+	watchHistorySize = 1024
+	maxWatchTimeout  = 60 * time.Second
+)
+
+var watchTimeout = 30 * time.Second
+
+type watchResponse struct {
+	Revision uint64  `json:"revision"`
+	Events   []Event `json:"events"`
+}
+
+// record keeps e in the watch history and wakes up the watchers. r.mutex must be held.
+func (r *registry) record(e Event) {
+	r.history = append(r.history, e)
+	if len(r.history) > watchHistorySize {
+		r.history = append([]Event(nil), r.history[len(r.history)-watchHistorySize:]...)
+	}
+
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// eventsSince returns the events after since for the given service names, keyed by the name the
+// registry keys them by with the selectors they were requested with, and the current revision.
+// ok is false when the events after since are no longer known. r.mutex must be held.
+func (r *registry) eventsSince(since uint64, names map[ServiceName][]Selector) (events []Event, revision uint64, ok bool) {
+	oldest := r.index + 1
+	if len(r.history) > 0 {
+		oldest = r.history[0].Index
+	}
+	// a client ahead of the registry has seen a history that was lost, e.g. with the memory store
+	if since > r.index || since+1 < oldest {
+		return nil, r.index, false
+	}
+
+	for _, e := range r.history {
+		if e.Index > since && e.Op != opNoop && anyMatches(names[e.Registration.key()], e.Registration) {
+			events = append(events, e)
+		}
+	}
+	return events, r.index, true
+}
+
+func (r *registry) handleWatch(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := req.URL.Query()
+	names := make(map[ServiceName][]Selector)
+	for _, name := range query["serviceName"] {
+		key, selector, err := splitSelector(ServiceName(name).In(query.Get("namespace")))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		names[key] = append(names[key], selector)
+	}
+	if len(names) == 0 {
+		http.Error(w, "Service name is required", http.StatusBadRequest)
+		return
+	}
+
+	since, err := strconv.ParseUint(query.Get("since"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid revision", http.StatusBadRequest)
+		return
+	}
+
+	timeout := watchTimeout
+	if t, err := time.ParseDuration(query.Get("timeout")); err == nil && t > 0 && t <= maxWatchTimeout {
+		timeout = t
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		r.mutex.RLock()
+		events, revision, ok := r.eventsSince(since, names)
+		changed := r.changed
+		r.mutex.RUnlock()
+
+		if !ok {
+			w.Header().Set(revisionHeader, strconv.FormatUint(revision, 10))
+			http.Error(w, "Revision no longer available, fetch the full list again", http.StatusGone)
+			return
+		}
+
+		if len(events) == 0 {
+			select {
+			case <-changed:
+				continue
+			case <-req.Context().Done():
+				return
+			case <-deadline.C:
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(watchResponse{Revision: revision, Events: events}); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+}
+
+// requestResync makes the watcher fetch the full provider lists before its next watch.
+func (p *providers) requestResync() {
+	select {
+	case p.resync <- struct{}{}:
+	default:
+	}
+}
+
+// watch keeps the cached providers of names consistent with the registry. It fetches the full
+// lists, then follows the watch API from the revision they were fetched at, and fetches the full
+// lists again whenever the registry reports a gap.
+func (p *providers) watch(names []ServiceName) {
+	if len(names) == 0 {
+		return
+	}
+
+	query := url.Values{}
+	p.mutex.Lock()
+	for _, name := range names {
+		query.Add("serviceName", string(name))
+		// patches are cached under references with a selector once they are known
+		if _, ok := p.services[name]; !ok {
+			p.services[name] = nil
+		}
+	}
+	p.mutex.Unlock()
+
+	var since uint64
+	needResync := true
+	for {
+		select {
+		case <-p.resync:
+			needResync = true
+		default:
+		}
+
+		if needResync {
+			revision, err := p.fetchAll(names)
+			if err != nil {
+				log.Println("Failed to fetch providers:", err)
+				time.Sleep(3 * time.Second)
+				continue
+			}
+			since = revision
+			needResync = false
+		}
+
+		query.Set("since", strconv.FormatUint(since, 10))
+		// the registry holds the watch for watchTimeout, so it gets that much longer than other requests
+		resp, err := endpoints.doWithin(watchTimeout+requestTimeout, http.MethodGet, "/services/watch?"+query.Encode(), nil, nil)
+		if err != nil {
+			log.Println("Failed to watch providers:", err)
+			time.Sleep(3 * time.Second)
+			continue
+		}
+
+		var wr watchResponse
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(&wr)
+		case http.StatusGone:
+			log.Printf("Registry no longer has revision %d, fetching providers again", since)
+			needResync = true
+		default:
+			err = fmt.Errorf("registry responded with status code %v", resp.StatusCode)
+		}
+		resp.Body.Close()
+
+		if err != nil {
+			log.Println("Failed to watch providers:", err)
+			time.Sleep(3 * time.Second)
+			continue
+		}
+		if needResync {
+			continue
+		}
+
+		// a lower revision means we were moved to a registry that lost history we have seen
+		if wr.Revision < since {
+			log.Printf("Registry revision went back from %d to %d, fetching providers again", since, wr.Revision)
+			needResync = true
+			continue
+		}
+
+		for _, e := range wr.Events {
+			if e.Index > since {
+				p.applyEvent(e)
+			}
+		}
+		since = wr.Revision
+	}
+}
+
+// fetchAll replaces the cached providers of names with the lists held by the registry and returns
+// the lowest revision they were fetched at, so that watching from it misses no event.
+func (p *providers) fetchAll(names []ServiceName) (uint64, error) {
+	var revision uint64
+	for i, name := range names {
+		regs, rev, err := fetch(name, false)
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 || rev < revision {
+			revision = rev
+		}
+
+		p.mutex.Lock()
+		p.services[name] = regs
+		p.mutex.Unlock()
+	}
+
+	return revision, nil
+}
+
+// fetch returns the registrations of name and the revision of the registry they were read at. With
+// telemetry, the request is served by the leader, the replica holding the telemetry of the services.
+func fetch(name ServiceName, telemetry bool) ([]Registration, uint64, error) {
+	path := "/services?serviceName=" + url.QueryEscape(string(name))
+	if telemetry {
+		path += "&telemetry=true"
+	}
+	resp, err := endpoints.do(http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var regs []Registration
+	if err := json.NewDecoder(resp.Body).Decode(&regs); err != nil {
+		return nil, 0, err
+	}
+
+	rev, err := strconv.ParseUint(resp.Header.Get(revisionHeader), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("registry did not report a revision: %w", err)
+	}
+	return regs, rev, nil
+}
+
+// applyEvent applies a watched event to the cache as the registry applied it: an added service
+// replaces any older registration at the same URL, and an updated one moves in or out of the cached
+// selections it now matches or no longer matches. Events may be seen twice after a resync, which
+// applying them tolerates.
+func (p *providers) applyEvent(e Event) {
+	if e.Op != opAdd && e.Op != opUpdate && e.Op != opRemove {
+		return
+	}
+	reg := e.Registration
+	key := reg.key()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if e.Op == opRemove {
+		log.Println("Removing service: ", reg.ServiceName, reg.ServiceID)
+	} else if _, ok := p.services[key]; !ok {
+		p.services[key] = nil
+	}
+	for ref, regs := range p.services {
+		name, selector, err := splitSelector(ref)
+		if err != nil || name != key {
+			continue
+		}
+		kept := make([]Registration, 0, len(regs)+1)
+		for _, r := range regs {
+			if r.ServiceID == reg.ServiceID || (e.Op == opAdd && r.ServiceURL == reg.ServiceURL) {
+				continue
+			}
+			kept = append(kept, r)
+		}
+		if e.Op != opRemove && selector.Matches(reg) {
+			kept = append(kept, reg)
+		}
+		p.services[ref] = kept
+	}
+}
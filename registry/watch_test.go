@@ -0,0 +1,119 @@
+package registry
+
+import (
+	"encoding/json"
+	"go-distributed/registry/heartbeat"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	service, err := NewRegistryService(heartbeat.NewHeartBeatServer(), memoryStore{}, ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer service.Close()
+
+	server := httptest.NewServer(service)
+	defer server.Close()
+	SetEndpoints(server.URL)
+
+	p := providers{services: make(map[ServiceName][]Registration), resync: make(chan struct{}, 1), mutex: new(sync.RWMutex)}
+
+	revision, err := p.fetchAll([]ServiceName{NodeService})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		resp watchResponse
+		code int
+	}
+	watch := func(since uint64) chan result {
+		ch := make(chan result, 1)
+		go func() {
+			resp, err := http.Get(server.URL + "/services/watch?serviceName=NodeService&timeout=5s&since=" + strconv.FormatUint(since, 10))
+			if err != nil {
+				t.Error(err)
+				close(ch)
+				return
+			}
+			defer resp.Body.Close()
+			var r result
+			r.code = resp.StatusCode
+			if resp.StatusCode == http.StatusOK {
+				json.NewDecoder(resp.Body).Decode(&r.resp)
+			}
+			ch <- r
+		}()
+		return ch
+	}
+
+	pending := watch(revision)
+	time.Sleep(50 * time.Millisecond)
+
+	// an unrelated service does not wake up the watcher, the node does
+	if err := service.reg.add(Registration{ServiceName: LogService, ServiceURL: "http://127.0.0.1:1", ServiceID: "log-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.reg.add(Registration{ServiceName: NodeService, ServiceURL: "http://127.0.0.1:2", ServiceID: "node-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-pending
+	if r.code != http.StatusOK || len(r.resp.Events) != 1 || r.resp.Events[0].Registration.ServiceID != "node-1" {
+		t.Fatalf("expected the node registration, got %d %+v", r.code, r.resp)
+	}
+	for _, e := range r.resp.Events {
+		p.applyEvent(e)
+		p.applyEvent(e) // applying twice is harmless
+	}
+	if regs, _ := p.get(NodeService); len(regs) != 1 {
+		t.Errorf("expected one cached node, got %v", regs)
+	}
+
+	// a revision the registry never reached means its history was lost
+	if r := <-watch(r.resp.Revision + 100); r.code != http.StatusGone {
+		t.Errorf("expected %d for an unknown revision, got %d", http.StatusGone, r.code)
+	}
+}
+
+func TestApplyEvent(t *testing.T) {
+	p := providers{services: make(map[ServiceName][]Registration), resync: make(chan struct{}, 1), mutex: new(sync.RWMutex)}
+	premium := ServiceName("NodeService?plan=premium")
+	p.services[premium] = nil
+
+	node := Registration{ServiceName: NodeService, ServiceURL: "http://10.0.0.1:80", ServiceID: "node-1", Metadata: map[string]string{"plan": "premium"}}
+	p.applyEvent(Event{Op: opAdd, Registration: node})
+
+	// the node restarts and registers again at the same URL with a new ID
+	restarted := node
+	restarted.ServiceID = "node-2"
+	p.applyEvent(Event{Op: opAdd, Registration: restarted})
+	p.applyEvent(Event{Op: opAdd, Registration: restarted})
+	for _, ref := range []ServiceName{NodeService, premium} {
+		if regs := p.services[ref]; len(regs) != 1 || regs[0].ServiceID != "node-2" {
+			t.Errorf("%s: expected the registration at the same URL to be replaced, got %+v", ref, regs)
+		}
+	}
+
+	// an update moves the node out of the selections it no longer matches
+	updated := restarted
+	updated.Metadata = map[string]string{"plan": "free"}
+	p.applyEvent(Event{Op: opUpdate, Registration: updated})
+	if regs := p.services[premium]; len(regs) != 0 {
+		t.Errorf("expected the node to leave the premium selection, got %+v", regs)
+	}
+	if regs := p.services[NodeService]; len(regs) != 1 || regs[0].Metadata["plan"] != "free" {
+		t.Errorf("expected the updated node, got %+v", regs)
+	}
+
+	p.applyEvent(Event{Op: opRemove, Registration: updated})
+	if regs := p.services[NodeService]; len(regs) != 0 {
+		t.Errorf("expected the node to be removed, got %+v", regs)
+	}
+}
@@ -0,0 +1,156 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go-distributed/registry"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Policy decides how Start treats a dependency that is not available yet.
+type Policy int
+
+const (
+	// Block makes Start wait until the dependency is available.
+	Block Policy = iota
+	// Timeout makes Start wait up to Dependency.Timeout and fail if the dependency is still missing.
+	Timeout
+	// Degraded lets the service start without the dependency. /readyz reports the service degraded
+	// while the dependency is missing.
+	Degraded
+)
+
+// Dependency is a service required by the service being started.
+type Dependency struct {
+	Name    registry.ServiceName
+	Policy  Policy
+	Timeout time.Duration // how long Start waits with the Timeout policy
+}
+
+// pollInterval is how often Start checks for dependencies it waits for.
+var pollInterval = 500 * time.Millisecond
+
+var readiness struct {
+	deps       []Dependency
+	registered bool
+	ready      chan struct{}
+	readyOnce  sync.Once
+	handleOnce sync.Once
+	mutex      sync.Mutex
+}
+
+func init() {
+	readiness.ready = make(chan struct{})
+}
+
+// Ready returns a channel that is closed once the service is registered and every dependency
+// without the Degraded policy was available.
+func Ready() <-chan struct{} {
+	return readiness.ready
+}
+
+// available reports whether a provider of name can be given work.
+func available(name registry.ServiceName) bool {
+	providers, err := registry.GetProviders(name)
+	if err != nil {
+		return false
+	}
+	for _, p := range providers {
+		if p.Available() {
+			return true
+		}
+	}
+	return false
+}
+
+// waitFor blocks until dep is available, as its policy allows.
+func waitFor(ctx context.Context, dep Dependency) error {
+	if dep.Policy == Degraded {
+		return nil
+	}
+	if dep.Policy == Timeout {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dep.Timeout)
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	lastLog := time.Time{}
+	for !available(dep.Name) {
+		if time.Since(lastLog) > 5*time.Second {
+			log.Printf("Waiting for %s to become available", dep.Name)
+			lastLog = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			if dep.Policy == Timeout {
+				return fmt.Errorf("%s not available after %v", dep.Name, dep.Timeout)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	log.Printf("Dependency %s is available", dep.Name)
+	return nil
+}
+
+// requireDependencies adds the dependencies to the required services of reg, so the registry
+// pushes their providers to the service.
+func requireDependencies(reg *registry.Registration, deps []Dependency) {
+	for _, dep := range deps {
+		required := false
+		for _, name := range reg.RequiredServices {
+			required = required || name == dep.Name
+		}
+		if !required {
+			reg.RequiredServices = append(reg.RequiredServices, dep.Name)
+		}
+	}
+}
+
+func setRegistered(deps []Dependency) {
+	readiness.mutex.Lock()
+	defer readiness.mutex.Unlock()
+	readiness.deps = deps
+	readiness.registered = true
+}
+
+func setReady() {
+	readiness.readyOnce.Do(func() { close(readiness.ready) })
+}
+
+type readyStatus struct {
+	Ready        bool                          `json:"ready"`
+	Degraded     bool                          `json:"degraded"`
+	Dependencies map[registry.ServiceName]bool `json:"dependencies"` // whether each dependency is available
+}
+
+// handleReady serves /readyz: 200 while the service is registered and its dependencies without the
+// Degraded policy are available, 503 otherwise.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	readiness.mutex.Lock()
+	status := readyStatus{Ready: readiness.registered, Dependencies: map[registry.ServiceName]bool{}}
+	deps := readiness.deps
+	readiness.mutex.Unlock()
+
+	for _, dep := range deps {
+		ok := available(dep.Name)
+		status.Dependencies[dep.Name] = ok
+		if !ok && dep.Policy == Degraded {
+			status.Degraded = true
+		} else if !ok {
+			status.Ready = false
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
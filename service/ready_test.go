@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"go-distributed/registry"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWaitFor(t *testing.T) {
+	// no registry runs, so no dependency ever becomes available
+	if err := waitFor(context.Background(), Dependency{Name: registry.LogService, Policy: Degraded}); err != nil {
+		t.Errorf("expected a degraded dependency not to be waited for, got %v", err)
+	}
+
+	start := time.Now()
+	err := waitFor(context.Background(), Dependency{Name: registry.LogService, Policy: Timeout, Timeout: time.Second})
+	if err == nil || time.Since(start) < time.Second {
+		t.Errorf("expected the wait to fail after the timeout, got %v after %v", err, time.Since(start))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := waitFor(ctx, Dependency{Name: registry.LogService, Policy: Block}); err == nil {
+		t.Error("expected a blocking wait to end with its context")
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	get := func() (int, readyStatus) {
+		rec := httptest.NewRecorder()
+		handleReady(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var status readyStatus
+		if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, status
+	}
+
+	if code, _ := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected an unregistered service not to be ready, got %v", code)
+	}
+
+	setRegistered([]Dependency{{Name: registry.NodeService, Policy: Degraded}})
+	code, status := get()
+	if code != http.StatusOK || !status.Degraded || status.Dependencies[registry.NodeService] {
+		t.Errorf("expected a missing degraded dependency to leave the service ready but degraded, got %v %+v", code, status)
+	}
+
+	setRegistered([]Dependency{{Name: registry.LogService, Policy: Block}})
+	if code, _ := get(); code != http.StatusServiceUnavailable {
+		t.Errorf("expected a missing blocking dependency to make the service unready, got %v", code)
+	}
+}
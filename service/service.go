@@ -2,40 +2,88 @@ package service
 
 import (
 	"context"
-	"fmt"
 	"go-distributed/registry"
+	"go-distributed/tracing"
 	"log"
 	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func Start(ctx context.Context, host, port string, reg registry.Registration, registerHundlersFunc func()) (context.Context, error) {
+// Start serves the registered handlers, /readyz and the Prometheus metrics at /metrics, and registers
+// the service. Requests are traced as configured by Trace_Exporter, see package tracing. It then
+// waits for deps as their policies say; Ready is closed once it stopped waiting and /readyz reports
+// the state of deps.
+// Cancelling ctx, e.g. one from SignalContext, shuts the service down; the returned context is done
+// once the service deregistered and stopped, or ShutdownTimeout passed.
+func Start(ctx context.Context, host, port string, reg registry.Registration, registerHundlersFunc func(), deps ...Dependency) (context.Context, error) {
 	registerHundlersFunc()
+	readiness.handleOnce.Do(func() {
+		http.HandleFunc("/readyz", handleReady)
+		http.Handle("/metrics", promhttp.Handler())
+	})
+	requireDependencies(&reg, deps)
+
+	flush, err := tracing.Init(string(reg.ServiceName))
+	if err != nil {
+		return ctx, err
+	}
+	background.mutex.Lock()
+	background.flush = flush
+	background.mutex.Unlock()
+
 	log.Printf("Starting service %s at %s:%s\n", reg.ServiceName, host, port)
-	ctx = startService(ctx, reg.ServiceName, host, port)
+	ctx = startService(ctx, reg.ServiceName, reg.ServiceURL, host, port)
 	log.Printf("Service %s started at %s:%s\n", reg.ServiceName, host, port)
 
-	err := registry.RegisterService(&reg)
+	err = registry.RegisterService(&reg)
 	if err != nil {
 		return ctx, err
 	}
+	setRegistered(deps)
+
+	for _, dep := range deps {
+		if err := waitFor(ctx, dep); err != nil {
+			return ctx, err
+		}
+	}
+	setReady()
 
 	return ctx, nil
 }
 
-func startService(ctx context.Context, serviceName registry.ServiceName, host, port string) context.Context {
-	ctx, cancel := context.WithCancel(ctx)
+func startService(ctx context.Context, serviceName registry.ServiceName, serviceURL, host, port string) context.Context {
+	// the service outlives ctx until it has deregistered
+	stopped, cancel := context.WithCancel(context.WithoutCancel(ctx))
 
 	var srv http.Server
 	srv.Addr = host + ":" + port
+	srv.Handler = tracing.Handler(http.DefaultServeMux, string(serviceName))
+
+	// with mutual TLS, only services holding a certificate of the registry CA get through
+	serve := srv.ListenAndServe
+	if registry.TLSEnabled() {
+		srv.TLSConfig = registry.ServerTLSConfig()
+		serve = func() error { return srv.ListenAndServeTLS("", "") }
+	}
 
+	failed := make(chan struct{})
 	go func() {
-		log.Println(srv.ListenAndServe())
-		err := registry.ShutdownService(fmt.Sprintf("http://%v:%v", host, port))
-		if err != nil {
+		if err := serve(); err != http.ErrServerClosed {
 			log.Println(err)
+			close(failed)
+		}
+	}()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-failed:
 		}
+		log.Printf("Shutting down service %s\n", serviceName)
+		shutdown(&srv, serviceName, serviceURL)
 		cancel()
 	}()
 
-	return ctx
+	return stopped
 }
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"context"
+	"go-distributed/registry"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultShutdownTimeout is how long a service may take to shut down unless Shutdown_Timeout says otherwise.
+var DefaultShutdownTimeout = 20 * time.Second
+
+// ShutdownTimeout returns how long a service may take to shut down once asked to: to deregister,
+// drain in-flight requests and stop its background loops. Shutdown_Timeout sets it, e.g. "30s".
+func ShutdownTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(os.Getenv("Shutdown_Timeout")); err == nil && timeout > 0 {
+		return timeout
+	}
+	return DefaultShutdownTimeout
+}
+
+// SignalContext returns a context cancelled on SIGTERM or SIGINT. Passed to Start, it shuts the
+// service down on these signals.
+func SignalContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(parent, syscall.SIGTERM, os.Interrupt)
+}
+
+var background struct {
+	loops    sync.WaitGroup
+	hooks    []func(context.Context) error
+	flush    func(context.Context) error // flushes the recorded spans, once everything else stopped
+	stopping bool
+	mutex    sync.Mutex
+}
+
+// Go runs loop in the background. loop must return once ctx is done; shutting down waits for it.
+// Loops are not started once the service is shutting down.
+func Go(ctx context.Context, loop func(ctx context.Context)) {
+	background.mutex.Lock()
+	defer background.mutex.Unlock()
+	if background.stopping {
+		return
+	}
+	background.loops.Add(1)
+	go func() {
+		defer background.loops.Done()
+		loop(ctx)
+	}()
+}
+
+// OnShutdown registers fn to be called while shutting down, after the service stopped accepting
+// requests, e.g. to shut down further servers. fn should return by the deadline of its context.
+func OnShutdown(fn func(ctx context.Context) error) {
+	background.mutex.Lock()
+	defer background.mutex.Unlock()
+	background.hooks = append(background.hooks, fn)
+}
+
+// shutdown deregisters the service, so no new work is sent to it, then drains the in-flight requests
+// of srv, runs the shutdown hooks, waits for the background loops and flushes the recorded spans,
+// all within ShutdownTimeout.
+func shutdown(srv *http.Server, serviceName registry.ServiceName, serviceURL string) {
+	timeout := ShutdownTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	background.mutex.Lock()
+	background.stopping = true
+	hooks := background.hooks
+	flush := background.flush
+	background.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := registry.ShutdownService(serviceName, serviceURL); err != nil {
+			log.Println(err)
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Println(err)
+		}
+		for _, hook := range hooks {
+			if err := hook(ctx); err != nil {
+				log.Println(err)
+			}
+		}
+		background.loops.Wait()
+		if flush != nil {
+			if err := flush(ctx); err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+		log.Printf("Service %s shut down\n", serviceName)
+	case <-ctx.Done():
+		log.Printf("Service %s did not shut down within %v\n", serviceName, timeout)
+		srv.Close()
+	}
+}
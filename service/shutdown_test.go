@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"go-distributed/registry"
+	"go-distributed/registry/heartbeat"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	t.Setenv("Shutdown_Timeout", "5s")
+
+	store, _ := registry.OpenStore("memory", "")
+	HBServer := heartbeat.NewHeartBeatServer()
+	registryService, err := registry.NewRegistryService(HBServer, store, registry.ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registryService.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/heartbeat/", HBServer)
+	mux.Handle("/services", registryService)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	registry.SetEndpoints(server.URL)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	serviceURL := "http://127.0.0.1:" + port
+
+	// slow requests are in flight when the service is asked to shut down
+	started := make(chan struct{}, 1)
+	registerHandlers := func() {
+		http.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			time.Sleep(300 * time.Millisecond)
+			io.WriteString(w, "done")
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reg := registry.Registration{ServiceName: registry.ShellService, ServiceURL: serviceURL, ServiceUpdateURL: serviceURL + "/services"}
+	stopped, err := Start(ctx, "127.0.0.1", port, reg, registerHandlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if regs, _ := registry.FetchProviders(registry.ShellService); len(regs) != 1 {
+		t.Fatalf("expected the service to be registered, got %+v", regs)
+	}
+
+	loopDone := make(chan struct{})
+	Go(ctx, func(ctx context.Context) {
+		<-ctx.Done()
+		close(loopDone)
+	})
+
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		res, err := http.Get(serviceURL + "/slow")
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+	cancel()
+
+	select {
+	case <-stopped.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("service did not stop")
+	}
+	if r := <-results; r.err != nil || r.body != "done" {
+		t.Errorf("expected the in-flight request to complete, got %q %v", r.body, r.err)
+	}
+	select {
+	case <-loopDone:
+	default:
+		t.Error("expected the background loop to have stopped")
+	}
+	if regs, _ := registry.FetchProviders(registry.ShellService); len(regs) != 0 {
+		t.Errorf("expected the service to be deregistered, got %+v", regs)
+	}
+	if _, err := http.Get(serviceURL + "/slow"); err == nil {
+		t.Error("expected the service to stop accepting requests")
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	t.Setenv("Shutdown_Timeout", "45s")
+	if timeout := ShutdownTimeout(); timeout != 45*time.Second {
+		t.Errorf("expected Shutdown_Timeout to set the timeout, got %v", timeout)
+	}
+	t.Setenv("Shutdown_Timeout", "soon")
+	if timeout := ShutdownTimeout(); timeout != DefaultShutdownTimeout {
+		t.Errorf("expected an invalid Shutdown_Timeout to be ignored, got %v", timeout)
+	}
+}
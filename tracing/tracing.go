@@ -0,0 +1,131 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/stats"
+)
+
+// Requests between services carry the W3C trace context (traceparent and baggage headers), so the
+// spans of a request, e.g. web /connect → node /connect → Xray API, form one trace. Each service
+// records a server span per request it handles and a client span per request it sends.
+//
+// Spans are exported as JSON lines, picked by Trace_Exporter:
+//
+//	stdout  write spans to standard output
+//	file    append spans to the file in Trace_File, traces.json by default
+//
+// Without Trace_Exporter spans are not recorded, but services still pass the trace context on.
+
+// untraced are the paths of requests that are too frequent or too uninteresting to trace.
+var untraced = []string{"/heartbeat", "/log", "/metrics", "/readyz"}
+
+// Init sets up tracing for the service serviceName as configured by Trace_Exporter. The returned
+// function flushes the recorded spans; call it before the service exits.
+func Init(serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var w io.Writer
+	closer := func() error { return nil }
+	switch exporter := os.Getenv("Trace_Exporter"); exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		w = os.Stdout
+	case "file":
+		path := os.Getenv("Trace_File")
+		if path == "" {
+			path = "traces.json"
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = f, f.Close
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", exporter)
+	}
+
+	exp, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		closer()
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if cerr := closer(); err == nil {
+			err = cerr
+		}
+		return err
+	}, nil
+}
+
+// traced reports whether requests to the path of r are traced.
+func traced(r *http.Request) bool {
+	for _, prefix := range untraced {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func spanName(_ string, r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// Handler returns h recording a server span for each request, continuing the trace of the caller.
+func Handler(h http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(h, operation, otelhttp.WithFilter(traced), otelhttp.WithSpanNameFormatter(spanName))
+}
+
+// Transport returns base recording a client span for each request and sending the trace context along.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return otelhttp.NewTransport(base, otelhttp.WithFilter(traced), otelhttp.WithSpanNameFormatter(spanName))
+}
+
+// GRPCClientHandler records a client span for each gRPC call of a connection and sends the trace context along.
+func GRPCClientHandler() stats.Handler {
+	return otelgrpc.NewClientHandler()
+}
+
+// TraceID returns the ID of the trace ctx belongs to, or "" outside of traces, e.g. to correlate log lines.
+func TraceID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
+
+// Parent returns the traceparent header continuing the trace of ctx, to store along work done
+// later on behalf of the request, e.g. the callback of an order.
+func Parent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// WithParent returns ctx continuing the trace of the traceparent header returned by Parent.
+func WithParent(ctx context.Context, traceparent string) context.Context {
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
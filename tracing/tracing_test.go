@@ -0,0 +1,95 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestPropagation(t *testing.T) {
+	t.Setenv("Trace_Exporter", "")
+	if _, err := Init("test"); err != nil {
+		t.Fatal(err)
+	}
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	var served string
+	server := httptest.NewServer(Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = TraceID(r.Context())
+	}), "node"))
+	defer server.Close()
+	client := &http.Client{Transport: Transport(http.DefaultTransport)}
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), "connect")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/connect", nil)
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	span.End()
+
+	if want := span.SpanContext().TraceID().String(); served != want {
+		t.Errorf("expected the server to continue trace %s, got %q", want, served)
+	}
+	// the root span, the client span and the server span
+	if spans := recorder.Ended(); len(spans) != 3 {
+		t.Errorf("expected 3 spans, got %d", len(spans))
+	}
+
+	// heartbeats are not traced
+	req, _ = http.NewRequestWithContext(ctx, http.MethodPost, server.URL+"/heartbeat/", nil)
+	if res, err = client.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if spans := recorder.Ended(); len(spans) != 3 {
+		t.Errorf("expected heartbeats not to be traced, got %d spans", len(spans))
+	}
+
+	// work done later continues the stored trace
+	later := WithParent(context.Background(), Parent(ctx))
+	if got := TraceID(later); got != TraceID(ctx) {
+		t.Errorf("expected trace %s to be continued, got %q", TraceID(ctx), got)
+	}
+	if TraceID(WithParent(context.Background(), "")) != "" {
+		t.Error("expected no trace without a traceparent")
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.json")
+	t.Setenv("Trace_Exporter", "file")
+	t.Setenv("Trace_File", path)
+	flush, err := Init("webservice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := otel.Tracer("test").Start(context.Background(), "connect")
+	span.End()
+	if err := flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"Name":"connect"`) || !strings.Contains(string(data), "webservice") {
+		t.Errorf("expected the span to be written, got %s", data)
+	}
+
+	t.Setenv("Trace_Exporter", "jaeger")
+	if _, err := Init("webservice"); err == nil {
+		t.Error("expected an unknown exporter to be rejected")
+	}
+}
@@ -1,8 +1,8 @@
 package utils
 
 import (
-	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"net/http"
 	"strings"
@@ -11,7 +11,7 @@ import (
 func GetHostIP() (string, error) {
 	conn, err := net.Dial("udp", "8.8.8.8:53")
 	if err != nil {
-		fmt.Println("get current host ip err: ", err)
+		slog.Error("Failed to get the host IP", "error", err)
 		return "", err
 	}
 	addr := conn.LocalAddr().(*net.UDPAddr)
@@ -0,0 +1,531 @@
+package utils
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// The node talks to Xray through the API inbound and adds its users to the inbound of the protocol
+// they connect with; these must match node.BaseConfig and node.UserInfo.InTag.
+const (
+	XrayInboundTag     = "test"
+	XrayTrojanTag      = "trojan"
+	XrayVMessTag       = "vmess"
+	XrayShadowsocksTag = "shadowsocks"
+	XrayAPITag         = "api"
+	XrayAPIAddress     = "127.0.0.1"
+	XrayAPIPort        = 8080
+)
+
+// XrayShadowsocksMethod is the cipher of the Shadowsocks inbound. Its keys are 16 bytes.
+const XrayShadowsocksMethod = "2022-blake3-aes-128-gcm"
+
+// xrayProtocols are the protocols an Xray config may offer, and how far the port of their inbound
+// is from the port of the VLESS inbound.
+var xrayProtocols = map[string]int{
+	"vless":       0,
+	"trojan":      1,
+	"vmess":       2,
+	"shadowsocks": 3,
+}
+
+// xraySlotOffset is how far the ports of the second set of REALITY inbounds are from the first. While
+// a node rotates its REALITY key, one set serves the new key and the other the previous one.
+const xraySlotOffset = 4
+
+// XrayOptions are the settings the Xray config of a node is rendered from. They are read from the
+// JSON file in Xray_ConfigFile, if set, and then from the environment:
+//
+//	Xray_ShortIDs        ShortIDs, comma-separated hex short IDs clients may use, e.g. ",6ba85179e30d4fc2"
+//	Xray_ServerNames     ServerNames, comma-separated names clients may send as SNI
+//	Xray_Dest            Dest, the site REALITY forwards probes to, e.g. www.amazon.com:443
+//	Xray_Listen          Listen and Port of the VLESS inbound, e.g. localhost:443
+//	Xray_LogLevel        LogLevel, one of debug, info, warning, error and none
+//	Xray_Protocols       Protocols, comma-separated protocols users may connect with, e.g. vless,trojan
+//	Xray_ShadowsocksKey  ShadowsocksKey, the base64 encoded 16 byte server key of Shadowsocks
+//
+// The Trojan, VMess and Shadowsocks inbounds listen on the 3 ports after the VLESS inbound.
+type XrayOptions struct {
+	PrivateKey  string   `json:"privateKey"` // the X25519 private key of REALITY, base64url encoded
+	ShortIDs    []string `json:"shortIds"`
+	ServerNames []string `json:"serverNames"`
+	Dest        string   `json:"dest"`
+	Listen      string   `json:"listen"`
+	Port        int      `json:"port"`
+	LogLevel    string   `json:"logLevel"`
+
+	Protocols      []string `json:"protocols"`
+	ShadowsocksKey string   `json:"shadowsocksKey"`
+
+	// KeySlot is which of the two sets of REALITY inbounds, 0 or 1, serves PrivateKey. PreviousKey, the
+	// key the node rotated from, is served on the other set until the rotation ends. The node sets both.
+	KeySlot     int      `json:"-"`
+	PreviousKey *XrayKey `json:"-"`
+}
+
+// XrayKey is a REALITY key and the short IDs clients use with it.
+type XrayKey struct {
+	PrivateKey string   `json:"privateKey"`
+	ShortIDs   []string `json:"shortIds"`
+}
+
+// DefaultXrayOptions are the options of settings neither the file nor the environment set. The
+// node proxies users to the VLESS inbound on localhost:443.
+func DefaultXrayOptions() XrayOptions {
+	return XrayOptions{
+		ShortIDs:  []string{""},
+		Dest:      "www.amazon.com:443",
+		Listen:    "localhost",
+		Port:      443,
+		LogLevel:  "warning",
+		Protocols: []string{"vless"},
+	}
+}
+
+// LoadXrayOptions returns the options set by Xray_ConfigFile and the environment over the defaults.
+func LoadXrayOptions() (XrayOptions, error) {
+	opts := DefaultXrayOptions()
+	if file := os.Getenv("Xray_ConfigFile"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return opts, err
+		}
+		if err := json.Unmarshal(data, &opts); err != nil {
+			return opts, fmt.Errorf("invalid Xray options in %s: %w", file, err)
+		}
+	}
+
+	if ids, ok := os.LookupEnv("Xray_ShortIDs"); ok {
+		opts.ShortIDs = splitList(ids, true)
+	}
+	if names := os.Getenv("Xray_ServerNames"); names != "" {
+		opts.ServerNames = splitList(names, false)
+	}
+	if dest := os.Getenv("Xray_Dest"); dest != "" {
+		opts.Dest = dest
+	}
+	if listen := os.Getenv("Xray_Listen"); listen != "" {
+		host, port, err := net.SplitHostPort(listen)
+		if err != nil {
+			return opts, fmt.Errorf("invalid Xray_Listen: %w", err)
+		}
+		if opts.Port, err = strconv.Atoi(port); err != nil {
+			return opts, fmt.Errorf("invalid Xray_Listen port %q", port)
+		}
+		opts.Listen = host
+	}
+	if level := os.Getenv("Xray_LogLevel"); level != "" {
+		opts.LogLevel = level
+	}
+	if protocols := os.Getenv("Xray_Protocols"); protocols != "" {
+		opts.Protocols = splitList(protocols, false)
+	}
+	if key := os.Getenv("Xray_ShadowsocksKey"); key != "" {
+		opts.ShadowsocksKey = key
+	}
+	return opts, nil
+}
+
+// splitList splits a comma-separated list, keeping empty elements if keepEmpty, as the empty short ID is valid.
+func splitList(s string, keepEmpty bool) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" || keepEmpty {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// Validate reports settings Xray would reject or that break the node, e.g. a malformed private key.
+func (o XrayOptions) Validate() error {
+	if err := (XrayKey{o.PrivateKey, o.ShortIDs}).validate(); err != nil {
+		return err
+	}
+	if o.PreviousKey != nil {
+		if err := o.PreviousKey.validate(); err != nil {
+			return fmt.Errorf("previous key: %w", err)
+		}
+	}
+	if o.KeySlot != 0 && o.KeySlot != 1 {
+		return fmt.Errorf("invalid key slot %d", o.KeySlot)
+	}
+	host, _, err := net.SplitHostPort(o.Dest)
+	if err != nil || host == "" {
+		return fmt.Errorf("invalid REALITY dest %q: expected host:port", o.Dest)
+	}
+	if o.Port <= 0 || o.Port > 65535 {
+		return fmt.Errorf("invalid inbound port %d", o.Port)
+	}
+	switch o.LogLevel {
+	case "debug", "info", "warning", "error", "none":
+	default:
+		return fmt.Errorf("invalid Xray log level %q", o.LogLevel)
+	}
+	if len(o.Protocols) == 0 {
+		return fmt.Errorf("no protocols")
+	}
+	seen := map[string]bool{}
+	for _, protocol := range o.Protocols {
+		offset, ok := xrayProtocols[protocol]
+		if !ok || seen[protocol] {
+			return fmt.Errorf("invalid or repeated protocol %q", protocol)
+		}
+		seen[protocol] = true
+		if o.Port+offset > 65535 || (xrayReality(protocol) && o.Port+offset+xraySlotOffset > 65535) {
+			return fmt.Errorf("invalid inbound port %d of %s", o.Port+offset, protocol)
+		}
+	}
+	if seen["shadowsocks"] {
+		key, err := base64.StdEncoding.DecodeString(o.ShadowsocksKey)
+		if err != nil || len(key) != 16 {
+			return fmt.Errorf("invalid Shadowsocks key: expected 16 bytes, base64 encoded")
+		}
+	}
+	return nil
+}
+
+func (k XrayKey) validate() error {
+	key, err := base64.RawURLEncoding.DecodeString(k.PrivateKey)
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("invalid REALITY private key: expected 32 bytes, base64url encoded")
+	}
+	if len(k.ShortIDs) == 0 {
+		return fmt.Errorf("no REALITY short IDs")
+	}
+	for _, id := range k.ShortIDs {
+		if _, err := hex.DecodeString(id); err != nil || len(id) > 16 {
+			return fmt.Errorf("invalid REALITY short ID %q: expected up to 16 hex digits", id)
+		}
+	}
+	return nil
+}
+
+// NewXrayKey generates a REALITY key with a random short ID, like xray x25519 does.
+func NewXrayKey() (XrayKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return XrayKey{}, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return XrayKey{}, err
+	}
+	return XrayKey{
+		PrivateKey: base64.RawURLEncoding.EncodeToString(key.Bytes()),
+		ShortIDs:   []string{hex.EncodeToString(id)},
+	}, nil
+}
+
+// XrayPublicKey returns the REALITY public key clients connect with, of privateKey.
+func XrayPublicKey(privateKey string) (string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil {
+		return "", fmt.Errorf("invalid REALITY private key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return "", fmt.Errorf("invalid REALITY private key: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()), nil
+}
+
+// xrayReality reports whether the inbound of protocol uses REALITY.
+func xrayReality(protocol string) bool {
+	return protocol == "vless" || protocol == "trojan"
+}
+
+// XrayInboundTagOf returns the tag of the inbound of protocol on the set of REALITY inbounds slot.
+func XrayInboundTagOf(protocol string, slot int) string {
+	tag := map[string]string{
+		"vless":       XrayInboundTag,
+		"trojan":      XrayTrojanTag,
+		"vmess":       XrayVMessTag,
+		"shadowsocks": XrayShadowsocksTag,
+	}[protocol]
+	if slot != 0 && xrayReality(protocol) {
+		tag += "-" + strconv.Itoa(slot)
+	}
+	return tag
+}
+
+// XrayConfig is the part of the Xray config format the node uses.
+type XrayConfig struct {
+	Log       XrayLog        `json:"log"`
+	API       XrayAPI        `json:"api"`
+	Stats     struct{}       `json:"stats"`
+	Policy    XrayPolicy     `json:"policy"`
+	Inbounds  []XrayInbound  `json:"inbounds"`
+	Outbounds []XrayOutbound `json:"outbounds"`
+	Routing   XrayRouting    `json:"routing"`
+}
+
+type XrayLog struct {
+	LogLevel string `json:"loglevel"`
+}
+
+type XrayAPI struct {
+	Tag      string   `json:"tag"`
+	Services []string `json:"services"`
+}
+
+type XrayPolicy struct {
+	Levels map[string]XrayLevelPolicy `json:"levels"`
+	System XraySystemPolicy           `json:"system"`
+}
+
+type XrayLevelPolicy struct {
+	Handshake         int  `json:"handshake"`
+	ConnIdle          int  `json:"connIdle"`
+	UplinkOnly        int  `json:"uplinkOnly"`
+	DownlinkOnly      int  `json:"downlinkOnly"`
+	StatsUserUplink   bool `json:"statsUserUplink"`
+	StatsUserDownlink bool `json:"statsUserDownlink"`
+	BufferSize        int  `json:"bufferSize"`
+}
+
+type XraySystemPolicy struct {
+	StatsInboundUplink    bool `json:"statsInboundUplink"`
+	StatsInboundDownlink  bool `json:"statsInboundDownlink"`
+	StatsOutboundUplink   bool `json:"statsOutboundUplink"`
+	StatsOutboundDownlink bool `json:"statsOutboundDownlink"`
+}
+
+type XrayInbound struct {
+	Tag            string              `json:"tag"`
+	Listen         string              `json:"listen"`
+	Port           int                 `json:"port"`
+	Protocol       string              `json:"protocol"`
+	Settings       any                 `json:"settings"`
+	StreamSettings *XrayStreamSettings `json:"streamSettings,omitempty"`
+	Sniffing       *XraySniffing       `json:"sniffing,omitempty"`
+}
+
+// XrayVlessSettings are the settings of a VLESS inbound. The node adds and removes its clients through the API.
+type XrayVlessSettings struct {
+	Clients    []any  `json:"clients"`
+	Decryption string `json:"decryption"`
+}
+
+// XrayTrojanSettings are the settings of a Trojan inbound.
+type XrayTrojanSettings struct {
+	Clients []any `json:"clients"`
+}
+
+// XrayVMessSettings are the settings of a VMess inbound.
+type XrayVMessSettings struct {
+	Clients []any `json:"clients"`
+}
+
+// XrayShadowsocksSettings are the settings of a multi-user Shadowsocks-2022 inbound. Clients connect
+// with the server key and their own key, joined by a colon.
+type XrayShadowsocksSettings struct {
+	Method   string `json:"method"`
+	Password string `json:"password"` // the server key
+	Clients  []any  `json:"clients"`
+	Network  string `json:"network"`
+}
+
+// XrayDokodemoSettings are the settings of the API inbound.
+type XrayDokodemoSettings struct {
+	Address string `json:"address"`
+}
+
+type XrayStreamSettings struct {
+	Network         string               `json:"network"`
+	Security        string               `json:"security"`
+	RealitySettings *XrayRealitySettings `json:"realitySettings,omitempty"`
+}
+
+type XrayRealitySettings struct {
+	Show        bool     `json:"show"`
+	Dest        string   `json:"dest"`
+	Xver        int      `json:"xver"`
+	ServerNames []string `json:"serverNames"`
+	PrivateKey  string   `json:"privateKey"`
+	ShortIDs    []string `json:"shortIds"`
+}
+
+type XraySniffing struct {
+	Enabled      bool     `json:"enabled"`
+	DestOverride []string `json:"destOverride"`
+}
+
+type XrayOutbound struct {
+	Tag      string `json:"tag"`
+	Protocol string `json:"protocol"`
+}
+
+type XrayRouting struct {
+	DomainStrategy string            `json:"domainStrategy"`
+	Rules          []XrayRoutingRule `json:"rules"`
+}
+
+type XrayRoutingRule struct {
+	Type        string   `json:"type"`
+	InboundTag  []string `json:"inboundTag,omitempty"`
+	IP          []string `json:"ip,omitempty"`
+	OutboundTag string   `json:"outboundTag"`
+}
+
+// BuildXrayConfig returns the Xray config of a node: the inbounds of the protocols users connect with,
+// VLESS and Trojan over REALITY, plain VMess and Shadowsocks-2022, followed by the REALITY inbounds of
+// the previous key while the node rotates keys, the API inbound the node controls Xray through,
+// per-user traffic stats, and routing that sends API calls to the API and blocks private addresses.
+func BuildXrayConfig(o XrayOptions) (XrayConfig, error) {
+	if err := o.Validate(); err != nil {
+		return XrayConfig{}, err
+	}
+	serverNames := o.ServerNames
+	if len(serverNames) == 0 {
+		host, _, _ := net.SplitHostPort(o.Dest)
+		serverNames = []string{host}
+	}
+
+	reality := func(key XrayKey) *XrayStreamSettings {
+		return &XrayStreamSettings{
+			Network:  "tcp",
+			Security: "reality",
+			RealitySettings: &XrayRealitySettings{
+				Dest:        o.Dest,
+				ServerNames: serverNames,
+				PrivateKey:  key.PrivateKey,
+				ShortIDs:    key.ShortIDs,
+			},
+		}
+	}
+	sniffing := &XraySniffing{Enabled: true, DestOverride: []string{"http", "tls", "quic"}}
+
+	inbound := func(protocol string, key XrayKey, slot int) XrayInbound {
+		in := XrayInbound{Tag: XrayInboundTagOf(protocol, slot), Listen: o.Listen, Port: o.Port + xrayProtocols[protocol], Protocol: protocol, Sniffing: sniffing}
+		if xrayReality(protocol) {
+			in.Port += slot * xraySlotOffset
+			in.StreamSettings = reality(key)
+		}
+		switch protocol {
+		case "vless":
+			in.Settings = XrayVlessSettings{Clients: []any{}, Decryption: "none"}
+		case "trojan":
+			in.Settings = XrayTrojanSettings{Clients: []any{}}
+		case "vmess":
+			in.Settings = XrayVMessSettings{Clients: []any{}}
+			in.StreamSettings = &XrayStreamSettings{Network: "tcp", Security: "none"}
+		case "shadowsocks":
+			// the proxies of the node forward TCP only
+			in.Settings = XrayShadowsocksSettings{Method: XrayShadowsocksMethod, Password: o.ShadowsocksKey, Clients: []any{}, Network: "tcp"}
+		}
+		return in
+	}
+
+	var inbounds []XrayInbound
+	for _, protocol := range o.Protocols {
+		inbounds = append(inbounds, inbound(protocol, XrayKey{o.PrivateKey, o.ShortIDs}, o.KeySlot))
+	}
+	if o.PreviousKey != nil {
+		for _, protocol := range o.Protocols {
+			if xrayReality(protocol) {
+				inbounds = append(inbounds, inbound(protocol, *o.PreviousKey, 1-o.KeySlot))
+			}
+		}
+	}
+
+	return XrayConfig{
+		Log: XrayLog{LogLevel: o.LogLevel},
+		API: XrayAPI{
+			Tag:      XrayAPITag,
+			Services: []string{"HandlerService", "LoggerService", "StatsService", "RoutingService"},
+		},
+		Policy: XrayPolicy{
+			Levels: map[string]XrayLevelPolicy{
+				"0": {Handshake: 4, ConnIdle: 300, UplinkOnly: 2, DownlinkOnly: 5, StatsUserUplink: true, StatsUserDownlink: true, BufferSize: 4},
+			},
+			System: XraySystemPolicy{StatsInboundUplink: true, StatsInboundDownlink: true, StatsOutboundUplink: true, StatsOutboundDownlink: true},
+		},
+		Inbounds: append(inbounds, XrayInbound{
+			Tag:      XrayAPITag,
+			Listen:   XrayAPIAddress,
+			Port:     XrayAPIPort,
+			Protocol: "dokodemo-door",
+			Settings: XrayDokodemoSettings{Address: XrayAPIAddress},
+		}),
+		Outbounds: []XrayOutbound{
+			{Tag: "direct", Protocol: "freedom"},
+			{Tag: "block", Protocol: "blackhole"},
+		},
+		Routing: XrayRouting{
+			DomainStrategy: "AsIs",
+			Rules: []XrayRoutingRule{
+				{Type: "field", InboundTag: []string{XrayAPITag}, OutboundTag: XrayAPITag},
+				{Type: "field", IP: []string{"geoip:private"}, OutboundTag: "block"},
+			},
+		},
+	}, nil
+}
+
+// XrayConfigPath returns where the Xray config is written: Xray_Config, or config.json next to the
+// Xray binary, where Xray looks for it.
+func XrayConfigPath() string {
+	if path := os.Getenv("Xray_Config"); path != "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(XrayPath()), "config.json")
+}
+
+// XrayPath returns the path of the Xray binary for this architecture, set with XRAY_PATH.
+func XrayPath() string {
+	path := os.Getenv("XRAY_PATH")
+	// add arm64 support
+	if runtime.GOARCH == "arm64" {
+		path += "_arm"
+	}
+	return path
+}
+
+// WriteXrayConfig writes cfg to path atomically, so Xray never reads a partly written config.
+func WriteXrayConfig(cfg XrayConfig, path string) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".config-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// ConfigXray renders the Xray config of the node from opts, writes it to XrayConfigPath and returns it.
+func ConfigXray(opts XrayOptions) (XrayConfig, error) {
+	cfg, err := BuildXrayConfig(opts)
+	if err != nil {
+		return XrayConfig{}, err
+	}
+	return cfg, WriteXrayConfig(cfg, XrayConfigPath())
+}
@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+const (
+	testKey            = "mNoGzlLbIVdKM0ZJY4sVZ8IOnFhwhdpcIYWBDQ_xQiw"
+	testShadowsocksKey = "l8FMqp0EGA0NnGbdsD3j8A=="
+)
+
+func TestXrayConfigGolden(t *testing.T) {
+	custom := DefaultXrayOptions()
+	custom.PrivateKey = testKey
+	custom.ShortIDs = []string{"", "6ba85179e30d4fc2"}
+	custom.ServerNames = []string{"www.microsoft.com", "microsoft.com"}
+	custom.Dest = "www.microsoft.com:443"
+	custom.Listen = "0.0.0.0"
+	custom.Port = 8443
+	custom.LogLevel = "info"
+	custom.Protocols = []string{"vless", "trojan", "vmess", "shadowsocks"}
+	custom.ShadowsocksKey = testShadowsocksKey
+
+	defaults := DefaultXrayOptions()
+	defaults.PrivateKey = testKey
+
+	// the new key on the second set of REALITY inbounds, the previous one on the first
+	rotating := DefaultXrayOptions()
+	rotating.Protocols = []string{"vless", "trojan", "vmess"}
+	rotating.PrivateKey = "oFaQaKpHE1CTQ0AczNmUA1ZqbI8IpDvz8ImWkQ9c0EI"
+	rotating.ShortIDs = []string{"0c3fba9d5ab1e0f7"}
+	rotating.KeySlot = 1
+	rotating.PreviousKey = &XrayKey{PrivateKey: testKey, ShortIDs: []string{"6ba85179e30d4fc2"}}
+
+	for name, opts := range map[string]XrayOptions{
+		"default":  defaults,
+		"custom":   custom,
+		"rotating": rotating,
+	} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := BuildXrayConfig(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(t.TempDir(), "config.json")
+			if err := WriteXrayConfig(cfg, path); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			golden := filepath.Join("testdata", "xray_"+name+".golden.json")
+			if *update {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("config differs from %s, run go test -update to accept it:\n%s", golden, got)
+			}
+		})
+	}
+}
+
+func TestXrayOptions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "xray.json")
+	os.WriteFile(file, []byte(`{"dest": "www.apple.com:443", "shortIds": ["0123"], "logLevel": "error"}`), 0644)
+	t.Setenv("Xray_ConfigFile", file)
+	t.Setenv("Xray_ServerNames", "www.apple.com, apple.com")
+	t.Setenv("Xray_Listen", "127.0.0.1:10443")
+	t.Setenv("Xray_Protocols", "vless, vmess")
+
+	opts, err := LoadXrayOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Dest != "www.apple.com:443" || opts.LogLevel != "error" || len(opts.ShortIDs) != 1 || opts.ShortIDs[0] != "0123" {
+		t.Errorf("expected the options of the file, got %+v", opts)
+	}
+	if len(opts.ServerNames) != 2 || opts.ServerNames[1] != "apple.com" || opts.Listen != "127.0.0.1" || opts.Port != 10443 {
+		t.Errorf("expected the options of the environment, got %+v", opts)
+	}
+	if len(opts.Protocols) != 2 || opts.Protocols[1] != "vmess" {
+		t.Errorf("expected the protocols of the environment, got %q", opts.Protocols)
+	}
+
+	// the empty short ID is kept
+	t.Setenv("Xray_ShortIDs", ",abcd")
+	if opts, _ := LoadXrayOptions(); len(opts.ShortIDs) != 2 || opts.ShortIDs[0] != "" {
+		t.Errorf("expected the empty short ID to be kept, got %q", opts.ShortIDs)
+	}
+
+	for name, mutate := range map[string]func(*XrayOptions){
+		"no private key":    func(o *XrayOptions) { o.PrivateKey = "" },
+		"short key":         func(o *XrayOptions) { o.PrivateKey = "mNoGzlLbIVdKM0ZJ" },
+		"odd short ID":      func(o *XrayOptions) { o.ShortIDs = []string{"abc"} },
+		"long short ID":     func(o *XrayOptions) { o.ShortIDs = []string{"0123456789abcdef01"} },
+		"no short IDs":      func(o *XrayOptions) { o.ShortIDs = nil },
+		"dest without port": func(o *XrayOptions) { o.Dest = "www.amazon.com" },
+		"port":              func(o *XrayOptions) { o.Port = 70000 },
+		"log level":         func(o *XrayOptions) { o.LogLevel = "verbose" },
+		"no protocols":      func(o *XrayOptions) { o.Protocols = nil },
+		"unknown protocol":  func(o *XrayOptions) { o.Protocols = []string{"vless", "socks"} },
+		"repeated protocol": func(o *XrayOptions) { o.Protocols = []string{"vless", "vless"} },
+		"port of protocol":  func(o *XrayOptions) { o.Port, o.Protocols = 65535, []string{"vless", "trojan"} },
+		"shadowsocks key":   func(o *XrayOptions) { o.Protocols = []string{"shadowsocks"} },
+		"previous key":      func(o *XrayOptions) { o.PreviousKey = &XrayKey{PrivateKey: testKey} },
+		"key slot":          func(o *XrayOptions) { o.KeySlot = 2 },
+		"port of key slot":  func(o *XrayOptions) { o.Port = 65533 },
+	} {
+		opts := DefaultXrayOptions()
+		opts.PrivateKey = testKey
+		mutate(&opts)
+		if _, err := BuildXrayConfig(opts); err == nil {
+			t.Errorf("%s: expected the options to be rejected", name)
+		}
+	}
+}
+
+func TestNewXrayKey(t *testing.T) {
+	key, err := NewXrayKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := key.validate(); err != nil {
+		t.Fatal(err)
+	}
+	public, err := XrayPublicKey(key.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(public) != 43 || public == key.PrivateKey {
+		t.Errorf("expected a base64url encoded X25519 public key, got %q", public)
+	}
+	if other, _ := NewXrayKey(); other.PrivateKey == key.PrivateKey || other.ShortIDs[0] == key.ShortIDs[0] {
+		t.Error("expected every key to be new")
+	}
+	if _, err := XrayPublicKey("short"); err == nil {
+		t.Error("expected malformed keys to be rejected")
+	}
+}
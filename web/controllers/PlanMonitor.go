@@ -1,19 +1,25 @@
 package controllers
 
 import (
+	"context"
+	"go-distributed/service"
 	"go-distributed/web/db"
 	"log"
-	"os"
 	"sync"
 	"time"
 )
 
 const PLAN_MONITOR_INTERVAL = 10 * time.Second
 
-func StartPlanMonitor() {
-	go func() {
+// StartPlanMonitor renews the traffic of users and disconnects users out of plan until ctx is done.
+func StartPlanMonitor(ctx context.Context) {
+	service.Go(ctx, func(ctx context.Context) {
 		for {
-			time.Sleep(PLAN_MONITOR_INTERVAL)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(PLAN_MONITOR_INTERVAL):
+			}
 
 			var users []db.User
 
@@ -56,7 +62,7 @@ func StartPlanMonitor() {
 				if exists {
 					delete(userConnectionMap, user.UUID)
 					for _, conn := range connections {
-						disconnectURL := "http://" + conn.NodeIP + ":" + os.Getenv("Node_Port")
+						disconnectURL := conn.NodeURL + "/disconnect"
 						disconnectURLs[disconnectURL] = append(disconnectURLs[disconnectURL], user.UUID)
 					}
 				}
@@ -78,5 +84,5 @@ func StartPlanMonitor() {
 			}
 			wg.Wait()
 		}
-	}()
+	})
 }
@@ -2,12 +2,14 @@ package controllers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"go-distributed/log"
 	"go-distributed/registry"
-	"log"
+	"go-distributed/service"
+	"log/slog"
 	"net/http"
-	"os"
 	"sync"
 	"time"
 )
@@ -24,9 +26,9 @@ func sendDisconnectRequest(apiURL string, uuids []string) error {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	registry.Authorize(req)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := registry.HTTPClient().Do(req)
 	if err != nil {
 		return fmt.Errorf("failed to send request: %w", err)
 	}
@@ -36,22 +38,36 @@ func sendDisconnectRequest(apiURL string, uuids []string) error {
 		return fmt.Errorf("received non-200 response status: %s", resp.Status)
 	}
 
-	fmt.Printf("Successfully sent disconnect request for %d UUIDs\n", len(uuids))
+	slog.Info("Sent disconnect request", "users", len(uuids))
 	return nil
 }
 
-func StartHeartbeatMonitor() {
-	go func() {
-		log.Println("Starting heartbeat monitor...")
+// disconnect closes the connections of the user with uuid on the nodes at nodeURLs.
+func disconnect(uuid string, nodeURLs []string) {
+	for _, nodeURL := range nodeURLs {
+		if err := sendDisconnectRequest(nodeURL+"/disconnect", []string{uuid}); err != nil {
+			slog.Error("Failed to close connection", log.User(uuid), "node", nodeURL, "error", err)
+		}
+	}
+}
+
+// StartHeartbeatMonitor disconnects clients that stopped sending heartbeats until ctx is done.
+func StartHeartbeatMonitor(ctx context.Context) {
+	service.Go(ctx, func(ctx context.Context) {
+		slog.Info("Starting heartbeat monitor")
 
 		for {
-			time.Sleep(HEARTBEAT_CHECK_INTERVAL)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(HEARTBEAT_CHECK_INTERVAL):
+			}
 
 			// remove disconnected nodes from userConnectionMap
-			regs, err := registry.GetProviders(registry.NodeService)
+			regs, err := registry.GetProviders(Nodes)
 
 			if err != nil {
-				log.Printf("Error fetching node services: %v", err)
+				slog.Error("Error fetching node services", "error", err)
 			}
 
 			userConnectionMapMutex.Lock()
@@ -68,12 +84,12 @@ func StartHeartbeatMonitor() {
 					if found {
 						validConnections = append(validConnections, conn)
 					} else {
-						log.Printf("Removing connection for user %s to node %s as it is no longer available.", userUUID, conn.NodeIP)
+						slog.Info("Removing connection to a node that is no longer available", log.User(userUUID), "node", conn.NodeIP)
 					}
 				}
 				if len(validConnections) == 0 {
 					delete(userConnectionMap, userUUID)
-					log.Printf("Removed user %s from connection map as they have no valid connections left.", userUUID)
+					slog.Info("Removed user without valid connections left", log.User(userUUID))
 				} else {
 					userConnectionMap[userUUID] = validConnections
 				}
@@ -99,10 +115,10 @@ func StartHeartbeatMonitor() {
 				var validConnections []UserConnection
 
 				for _, conn := range connections {
-					if now.Sub(conn.LastHeartBeat) <= HEARTBEAT_TIMEOUT {
+					if now.Sub(conn.LastHeartBeat) <= conn.timeout() {
 						validConnections = append(validConnections, conn)
 					} else {
-						disconnectURL := "http://" + conn.NodeIP + ":" + os.Getenv("Node_Port") + "/disconnect"
+						disconnectURL := conn.NodeURL + "/disconnect"
 						timedOutMap[disconnectURL] = append(timedOutMap[disconnectURL], userUUID)
 					}
 				}
@@ -112,7 +128,7 @@ func StartHeartbeatMonitor() {
 				if len(validConnections) == 0 {
 					delete(userConnectionMap, userUUID)
 
-					log.Printf("Removed user %s from connection map as they have no valid connections left.", userUUID)
+					slog.Info("Removed user without valid connections left", log.User(userUUID))
 				} else {
 					userConnectionMap[userUUID] = validConnections
 				}
@@ -126,13 +142,13 @@ func StartHeartbeatMonitor() {
 				go func(disconnectURL string, uuids []string) {
 					defer wg.Done()
 					if err := sendDisconnectRequest(disconnectURL, uuids); err != nil {
-						log.Printf("Error sending batch disconnect request to %s: %v", disconnectURL, err)
+						slog.Error("Error sending batch disconnect request", "url", disconnectURL, "error", err)
 					} else {
-						log.Printf("Successfully sent batch disconnect request to %s for %d users.", disconnectURL, len(uuids))
+						slog.Info("Sent batch disconnect request", "url", disconnectURL, "users", len(uuids))
 					}
 				}(url, uuids)
 			}
 			wg.Wait()
 		}
-	}()
+	})
 }
@@ -1,15 +1,19 @@
 package controllers
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"go-distributed/registry"
-	"go-distributed/utils"
+	"go-distributed/registry/heartbeat"
 	"go-distributed/web/db"
 	"go-distributed/web/email"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,6 +27,9 @@ const MAX_CONNECTIONS_PER_USER = 2
 const HEARTBEAT_TIMEOUT = 30 * time.Second
 const HEARTBEAT_CHECK_INTERVAL = 10 * time.Second
 
+// SUBSCRIPTION_TIMEOUT is how long connections made for a subscription feed last after the feed was last fetched
+const SUBSCRIPTION_TIMEOUT = 24 * time.Hour
+
 var expireMap = make(map[string]time.Time)
 
 var RateMap = map[string]int{
@@ -36,15 +43,27 @@ type Server struct {
 	ServiceID   string   `json:"serviceid"`
 	Description string   `json:"description"`
 	Tags        []string `json:"tags"`
+	// Load is the latest telemetry reported by the node, absent until its first info heartbeat
+	Load *heartbeat.ServerInfo `json:"load,omitempty"`
 	// TrafficMultiplier int      `json:"traffic_multiplier"` // 0 means free, and for better servers the value will be higher
 }
 
 type UserConnection struct {
 	NodeIP        string
+	NodeURL       string // ServiceURL of the node
 	ServiceID     string
 	NodePort      string
 	ClientIP      string
 	LastHeartBeat time.Time
+	Subscription  bool // kept alive by fetching the subscription feed instead of heartbeats
+}
+
+// timeout is how long the connection lasts without a heartbeat.
+func (conn UserConnection) timeout() time.Duration {
+	if conn.Subscription {
+		return SUBSCRIPTION_TIMEOUT
+	}
+	return HEARTBEAT_TIMEOUT
 }
 
 var userConnectionMap = make(map[string][]UserConnection) // user UUID: UserConnection list
@@ -198,14 +217,48 @@ func User(c *gin.Context) {
 	})
 }
 
+// Realitykey returns the REALITY public key of the node with ?serviceid=, or REALITY_PUBKEY, the key
+// shared by nodes that pin theirs, without one.
 func Realitykey(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"pubkey": os.Getenv("REALITY_PUBKEY"),
+	serviceID := c.Query("serviceid")
+	if serviceID == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"pubkey": os.Getenv("REALITY_PUBKEY"),
+		})
+		return
+	}
+
+	regs, err := registry.GetProviders(Nodes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch node service",
+		})
+		return
+	}
+	for _, reg := range regs {
+		if reg.ServiceID == serviceID {
+			c.JSON(http.StatusOK, gin.H{
+				"pubkey": realityPublicKey(reg),
+			})
+			return
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": "Node service not found",
 	})
 }
 
+// realityPublicKey returns the REALITY public key the node of reg publishes in its registration, or
+// REALITY_PUBKEY for nodes that pin the shared key and publish none.
+func realityPublicKey(reg registry.Registration) string {
+	if key := reg.Metadata["reality_pubkey"]; key != "" {
+		return key
+	}
+	return os.Getenv("REALITY_PUBKEY")
+}
+
 func Servers(c *gin.Context) {
-	regs, err := registry.GetProviders(registry.NodeService)
+	regs, err := nodeRegistrations()
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
@@ -217,12 +270,18 @@ func Servers(c *gin.Context) {
 	servers := []Server{}
 
 	for _, reg := range regs {
+		// draining nodes take no new users, unhealthy nodes may be gone
+		if !reg.Available() {
+			continue
+		}
+
 		server := Server{
 			IP:          reg.PublicIP,
 			IPV6:        reg.PublicIPv6,
 			ServiceID:   reg.ServiceID,
 			Description: reg.Description,
 			Tags:        reg.Tags,
+			Load:        reg.Info,
 		}
 
 		servers = append(servers, server)
@@ -261,6 +320,7 @@ func Connect(c *gin.Context) {
 	clientIP := c.ClientIP()
 
 	serviceID := c.Query("serviceid")
+	protocol := c.DefaultQuery("protocol", "vless")
 
 	user, ok := c.Get("user")
 
@@ -292,8 +352,16 @@ func Connect(c *gin.Context) {
 	uuid := userinfo.UUID
 	email := userinfo.Email
 
+	plan := planOf(userinfo)
+
 	// Get the server's api end point with the service ID
-	regs, err := registry.GetProviders(registry.NodeService)
+	var regs []registry.Registration
+	var err error
+	if serviceID == "auto" {
+		regs, err = nodeRegistrations()
+	} else {
+		regs, err = registry.GetProviders(Nodes)
+	}
 	if err != nil || len(regs) == 0 {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to fetch node service",
@@ -302,10 +370,30 @@ func Connect(c *gin.Context) {
 	}
 
 	var server *registry.Registration
-	for _, reg := range regs {
-		if reg.ServiceID == serviceID {
-			server = &reg
-			break
+	if serviceID == "auto" {
+		// connect to the least loaded node offering the protocol and the requested tags
+		var offering []registry.Registration
+		for _, reg := range regs {
+			if offersProtocol(reg, protocol) {
+				offering = append(offering, reg)
+			}
+		}
+		if len(offering) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "No node service offers protocol " + protocol,
+			})
+			return
+		}
+		if ranked := rankNodes(offering, plan, requestedTags(c)); len(ranked) > 0 {
+			server = &ranked[0].Registration
+			serviceID = server.ServiceID
+		}
+	} else {
+		for _, reg := range regs {
+			if reg.ServiceID == serviceID {
+				server = &reg
+				break
+			}
 		}
 	}
 
@@ -316,9 +404,24 @@ func Connect(c *gin.Context) {
 		return
 	}
 
-	plan := userinfo.Plan
-	if plan == "" {
-		plan = "Free plan" // Default to free plan if not set
+	if server.Draining {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Node service is draining, please choose another server",
+		})
+		return
+	}
+	if !server.Healthy() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "Node service is unhealthy, please choose another server",
+		})
+		return
+	}
+
+	if !offersProtocol(*server, protocol) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Node service does not offer protocol " + protocol,
+		})
+		return
 	}
 
 	rate := RateMap[plan]
@@ -329,75 +432,116 @@ func Connect(c *gin.Context) {
 		return
 	}
 
-	apiEndpoint := server.PublicIP + ":" + os.Getenv("Node_Port")
-
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "http://"+apiEndpoint+"/connect?uuid="+uuid+"&email="+email+"&clientip="+clientIP+"&rate="+strconv.Itoa(rate)+"&burst="+strconv.Itoa(rate)+"&regkey="+utils.Regkey(), nil)
+	responseBody, status, err := connectNode(c.Request.Context(), *server, uuid, email, clientIP, protocol, rate)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to create request to node service",
+		c.JSON(status, gin.H{
+			"error": err.Error(),
 		})
 		return
 	}
 
-	resp, err := client.Do(req)
+	evicted := trackConnection(uuid, UserConnection{
+		NodeIP:        server.PublicIP,
+		NodeURL:       server.ServiceURL,
+		ServiceID:     serviceID,
+		NodePort:      responseBody["port"],
+		ClientIP:      clientIP,
+		LastHeartBeat: time.Now(),
+	})
+	disconnect(uuid, evicted)
+
+	// Respond with the node port and pubkey
+
+	// the public key the node answers with wins, as its registration may lag behind a key rotation
+	response := gin.H{
+		"uuid":      uuid,
+		"serviceid": serviceID,
+		"pubkey":    realityPublicKey(*server),
+	}
+	for k, v := range responseBody {
+		response[k] = v
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// connectNode asks the node of server to let the user with uuid and email connect from clientIP with
+// protocol, at rate bytes per second. It returns the port and the connection parameters the node
+// answers with, or the status to answer the client with and why the node refused.
+func connectNode(ctx context.Context, server registry.Registration, uuid, email, clientIP, protocol string, rate int) (map[string]string, int, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", server.ServiceURL+"/connect?uuid="+uuid+"&email="+url.QueryEscape(email)+"&clientip="+clientIP+"&rate="+strconv.Itoa(rate)+"&burst="+strconv.Itoa(rate)+"&protocol="+url.QueryEscape(protocol), nil)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to connect to node service: " + err.Error(),
-		})
-		return
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to create request to node service")
+	}
+	registry.Authorize(req)
+
+	resp, err := registry.HTTPClient().Do(req)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to connect to node service: %w", err)
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		c.JSON(resp.StatusCode, gin.H{
-			"error": "Failed to connect to node service, status code: " + resp.Status,
-		})
-		return
+		return nil, resp.StatusCode, fmt.Errorf("Failed to connect to node service, status code: %s", resp.Status)
 	}
 
-	// get the port from the response
-	var responseBody struct {
-		Port string `json:"port"`
-	}
+	// get the port and the connection parameters of the protocol from the response
+	var responseBody map[string]string
 
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to read response from node service: " + err.Error(),
-		})
-		return
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to read response from node service: %w", err)
 	}
 
 	if err := json.Unmarshal(bodyBytes, &responseBody); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error": "Failed to read response from node service" + err.Error(),
-		})
-		return
+		return nil, http.StatusInternalServerError, fmt.Errorf("Failed to read response from node service: %w", err)
 	}
+	return responseBody, http.StatusOK, nil
+}
 
-	// Respond with the node port and pubkey
+// trackConnection records connections of the user with uuid, so the heartbeat monitor disconnects them
+// once they time out. A connection to a node the user is connected to already replaces the old one, and
+// the oldest connections are forgotten once the user has too many. It returns the node URLs of these,
+// which the caller disconnects.
+func trackConnection(uuid string, conns ...UserConnection) (evicted []string) {
 	userConnectionMapMutex.Lock()
 	defer userConnectionMapMutex.Unlock()
 
-	userConnections := userConnectionMap[uuid]
+	var connections []UserConnection
+	for _, old := range userConnectionMap[uuid] {
+		replaced := false
+		for i := range conns {
+			if conns[i].ServiceID == old.ServiceID {
+				conns[i].Subscription = conns[i].Subscription || old.Subscription
+				replaced = true
+			}
+		}
+		if !replaced {
+			connections = append(connections, old)
+		}
+	}
 
-	if len(userConnections) >= MAX_CONNECTIONS_PER_USER {
-		userConnectionMap[uuid] = userConnectionMap[uuid][1:]
+	// connections of the subscription feed count too, but the new connections are never forgotten
+	for len(connections) > 0 && len(connections)+len(conns) > MAX_CONNECTIONS_PER_USER {
+		evicted = append(evicted, connections[0].NodeURL)
+		connections = connections[1:]
 	}
 
-	userConnectionMap[uuid] = append(userConnectionMap[uuid], UserConnection{
-		NodeIP:        server.PublicIP,
-		ServiceID:     serviceID,
-		NodePort:      responseBody.Port,
-		ClientIP:      clientIP,
-		LastHeartBeat: time.Now(),
-	})
+	userConnectionMap[uuid] = append(connections, conns...)
+	return evicted
+}
 
-	c.JSON(http.StatusOK, gin.H{
-		"port":   responseBody.Port,
-		"uuid":   uuid,
-		"pubkey": os.Getenv("REALITY_PUBKEY"), // TODO
-	})
+// offersProtocol reports whether the node of reg offers protocol. Nodes that do not list their
+// protocols offer VLESS only.
+func offersProtocol(reg registry.Registration, protocol string) bool {
+	protocols, ok := reg.Metadata["protocols"]
+	if !ok {
+		return protocol == "vless"
+	}
+	for _, p := range strings.Split(protocols, ",") {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
 }
 
 func HeartbeatFromClient(c *gin.Context) {
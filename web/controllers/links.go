@@ -0,0 +1,261 @@
+package controllers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fingerprint is the TLS fingerprint clients imitate when connecting over REALITY.
+const fingerprint = "chrome"
+
+// shareLink is what a client needs to connect to a node: the address of the proxy of the user on the
+// node, and the parameters of the protocol the node answered the connect request with.
+type shareLink struct {
+	Name   string
+	Host   string
+	Port   int
+	UUID   string
+	PubKey string            // the REALITY public key
+	Params map[string]string // protocol, security, sni, sid, flow, password, method
+}
+
+func (l shareLink) protocol() string {
+	if p := l.Params["protocol"]; p != "" {
+		return p
+	}
+	return "vless"
+}
+
+func (l shareLink) reality() bool {
+	return l.Params["security"] == "reality"
+}
+
+// realityQuery returns the query of vless:// and trojan:// links describing REALITY.
+func (l shareLink) realityQuery() url.Values {
+	q := url.Values{"type": {"tcp"}}
+	if l.reality() {
+		q.Set("security", "reality")
+		q.Set("sni", l.Params["sni"])
+		q.Set("fp", fingerprint)
+		q.Set("pbk", l.PubKey)
+		q.Set("sid", l.Params["sid"])
+	}
+	return q
+}
+
+// URI returns the share link, the vless://, trojan://, vmess:// or ss:// URI clients import.
+func (l shareLink) URI() (string, error) {
+	host := net.JoinHostPort(l.Host, strconv.Itoa(l.Port))
+	switch l.protocol() {
+	case "vless":
+		q := l.realityQuery()
+		q.Set("encryption", "none")
+		if flow := l.Params["flow"]; flow != "" {
+			q.Set("flow", flow)
+		}
+		u := url.URL{Scheme: "vless", User: url.User(l.UUID), Host: host, RawQuery: q.Encode(), Fragment: l.Name}
+		return u.String(), nil
+	case "trojan":
+		u := url.URL{Scheme: "trojan", User: url.User(l.Params["password"]), Host: host, RawQuery: l.realityQuery().Encode(), Fragment: l.Name}
+		return u.String(), nil
+	case "shadowsocks":
+		// SIP002 with the plain method and password, as Shadowsocks-2022 links have them
+		u := url.URL{Scheme: "ss", User: url.UserPassword(l.Params["method"], l.Params["password"]), Host: host, Fragment: l.Name}
+		return u.String(), nil
+	case "vmess":
+		// the format of v2rayN
+		data, err := json.Marshal(map[string]string{
+			"v":    "2",
+			"ps":   l.Name,
+			"add":  l.Host,
+			"port": strconv.Itoa(l.Port),
+			"id":   l.UUID,
+			"aid":  "0",
+			"scy":  l.Params["encryption"],
+			"net":  "tcp",
+			"type": "none",
+			"tls":  "",
+		})
+		if err != nil {
+			return "", err
+		}
+		return "vmess://" + base64.StdEncoding.EncodeToString(data), nil
+	}
+	return "", fmt.Errorf("unknown protocol %q", l.protocol())
+}
+
+// base64Feed returns the links as the base64 encoded list most clients subscribe to.
+func base64Feed(links []shareLink) ([]byte, error) {
+	var uris []string
+	for _, l := range links {
+		uri, err := l.URI()
+		if err != nil {
+			return nil, err
+		}
+		uris = append(uris, uri)
+	}
+	return []byte(base64.StdEncoding.EncodeToString([]byte(strings.Join(uris, "\n")))), nil
+}
+
+type clashConfig struct {
+	Proxies     []clashProxy      `yaml:"proxies"`
+	ProxyGroups []clashProxyGroup `yaml:"proxy-groups"`
+	Rules       []string          `yaml:"rules"`
+}
+
+type clashProxy struct {
+	Name              string        `yaml:"name"`
+	Type              string        `yaml:"type"`
+	Server            string        `yaml:"server"`
+	Port              int           `yaml:"port"`
+	UUID              string        `yaml:"uuid,omitempty"`
+	Password          string        `yaml:"password,omitempty"`
+	Cipher            string        `yaml:"cipher,omitempty"`
+	Network           string        `yaml:"network,omitempty"`
+	UDP               bool          `yaml:"udp"`
+	TLS               bool          `yaml:"tls,omitempty"`
+	Flow              string        `yaml:"flow,omitempty"`
+	ServerName        string        `yaml:"servername,omitempty"` // VLESS
+	SNI               string        `yaml:"sni,omitempty"`        // Trojan
+	ClientFingerprint string        `yaml:"client-fingerprint,omitempty"`
+	RealityOpts       *clashReality `yaml:"reality-opts,omitempty"`
+}
+
+type clashReality struct {
+	PublicKey string `yaml:"public-key"`
+	ShortID   string `yaml:"short-id"`
+}
+
+type clashProxyGroup struct {
+	Name    string   `yaml:"name"`
+	Type    string   `yaml:"type"`
+	Proxies []string `yaml:"proxies"`
+}
+
+// clashFeed returns the links as a Clash/Mihomo config, with a group to select a node from.
+func clashFeed(links []shareLink) ([]byte, error) {
+	cfg := clashConfig{
+		Proxies:     []clashProxy{},
+		ProxyGroups: []clashProxyGroup{{Name: "Proxy", Type: "select", Proxies: []string{}}},
+		Rules:       []string{"MATCH,Proxy"},
+	}
+	for _, l := range links {
+		p := clashProxy{Name: l.Name, Server: l.Host, Port: l.Port, Network: "tcp"}
+		if l.reality() {
+			p.ClientFingerprint = fingerprint
+			p.RealityOpts = &clashReality{PublicKey: l.PubKey, ShortID: l.Params["sid"]}
+		}
+		switch l.protocol() {
+		case "vless":
+			p.Type, p.UUID, p.Flow = "vless", l.UUID, l.Params["flow"]
+			p.TLS, p.ServerName = l.reality(), l.Params["sni"]
+		case "trojan":
+			p.Type, p.Password, p.SNI = "trojan", l.Params["password"], l.Params["sni"]
+		case "shadowsocks":
+			// the proxies of nodes forward TCP only
+			p.Type, p.Cipher, p.Password, p.Network = "ss", l.Params["method"], l.Params["password"], ""
+		case "vmess":
+			p.Type, p.UUID, p.Cipher = "vmess", l.UUID, l.Params["encryption"]
+		default:
+			return nil, fmt.Errorf("unknown protocol %q", l.protocol())
+		}
+		cfg.Proxies = append(cfg.Proxies, p)
+		cfg.ProxyGroups[0].Proxies = append(cfg.ProxyGroups[0].Proxies, l.Name)
+	}
+	if len(cfg.Proxies) == 0 {
+		// a group needs a proxy to select
+		cfg.ProxyGroups[0].Proxies = append(cfg.ProxyGroups[0].Proxies, "DIRECT")
+	}
+	return yaml.Marshal(cfg)
+}
+
+type singBoxConfig struct {
+	Outbounds []singBoxOutbound `json:"outbounds"`
+	Route     singBoxRoute      `json:"route"`
+}
+
+type singBoxOutbound struct {
+	Type       string      `json:"type"`
+	Tag        string      `json:"tag"`
+	Server     string      `json:"server,omitempty"`
+	ServerPort int         `json:"server_port,omitempty"`
+	UUID       string      `json:"uuid,omitempty"`
+	Flow       string      `json:"flow,omitempty"`
+	Password   string      `json:"password,omitempty"`
+	Method     string      `json:"method,omitempty"`   // Shadowsocks
+	Security   string      `json:"security,omitempty"` // VMess
+	Network    string      `json:"network,omitempty"`
+	TLS        *singBoxTLS `json:"tls,omitempty"`
+	Outbounds  []string    `json:"outbounds,omitempty"` // selector
+}
+
+type singBoxTLS struct {
+	Enabled    bool           `json:"enabled"`
+	ServerName string         `json:"server_name"`
+	UTLS       singBoxUTLS    `json:"utls"`
+	Reality    singBoxReality `json:"reality"`
+}
+
+type singBoxUTLS struct {
+	Enabled     bool   `json:"enabled"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type singBoxReality struct {
+	Enabled   bool   `json:"enabled"`
+	PublicKey string `json:"public_key"`
+	ShortID   string `json:"short_id"`
+}
+
+type singBoxRoute struct {
+	Final string `json:"final"`
+}
+
+// singBoxFeed returns the links as the outbounds of a sing-box config, with a selector of the nodes
+// the route ends at.
+func singBoxFeed(links []shareLink) ([]byte, error) {
+	selector := singBoxOutbound{Type: "selector", Tag: "proxy", Outbounds: []string{}}
+	var outbounds []singBoxOutbound
+	for _, l := range links {
+		o := singBoxOutbound{Tag: l.Name, Server: l.Host, ServerPort: l.Port}
+		if l.reality() {
+			o.TLS = &singBoxTLS{
+				Enabled:    true,
+				ServerName: l.Params["sni"],
+				UTLS:       singBoxUTLS{Enabled: true, Fingerprint: fingerprint},
+				Reality:    singBoxReality{Enabled: true, PublicKey: l.PubKey, ShortID: l.Params["sid"]},
+			}
+		}
+		switch l.protocol() {
+		case "vless":
+			o.Type, o.UUID, o.Flow = "vless", l.UUID, l.Params["flow"]
+		case "trojan":
+			o.Type, o.Password = "trojan", l.Params["password"]
+		case "shadowsocks":
+			o.Type, o.Method, o.Password, o.Network = "shadowsocks", l.Params["method"], l.Params["password"], "tcp"
+		case "vmess":
+			o.Type, o.UUID, o.Security = "vmess", l.UUID, l.Params["encryption"]
+		default:
+			return nil, fmt.Errorf("unknown protocol %q", l.protocol())
+		}
+		outbounds = append(outbounds, o)
+		selector.Outbounds = append(selector.Outbounds, l.Name)
+	}
+	if len(selector.Outbounds) == 0 {
+		// a selector needs an outbound to select
+		selector.Outbounds = append(selector.Outbounds, "direct")
+	}
+
+	cfg := singBoxConfig{
+		Outbounds: append([]singBoxOutbound{selector}, append(outbounds, singBoxOutbound{Type: "direct", Tag: "direct"})...),
+		Route:     singBoxRoute{Final: "proxy"},
+	}
+	return json.MarshalIndent(cfg, "", "  ")
+}
@@ -0,0 +1,248 @@
+package controllers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"go-distributed/registry"
+	"go-distributed/registry/heartbeat"
+	"go-distributed/web/db"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+var testLinks = []shareLink{
+	{Name: "Tokyo", Host: "203.0.113.1", Port: 20001, UUID: "123e4567-e89b-12d3-a456-426614174000", PubKey: "Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw",
+		Params: map[string]string{"protocol": "vless", "security": "reality", "sni": "www.microsoft.com", "sid": "6ba85179e30d4fc2", "flow": "xtls-rprx-vision"}},
+	{Name: "Tokyo 2", Host: "203.0.113.2", Port: 20002, UUID: "123e4567-e89b-12d3-a456-426614174000", PubKey: "Z84J2IelR9ch3k8VtlVhhs5ycBUlXA7wHBWcBrjqnAw",
+		Params: map[string]string{"protocol": "trojan", "security": "reality", "sni": "www.microsoft.com", "sid": "", "password": "secret"}},
+	{Name: "Paris", Host: "2001:db8::1", Port: 20003, UUID: "123e4567-e89b-12d3-a456-426614174000",
+		Params: map[string]string{"protocol": "shadowsocks", "method": "2022-blake3-aes-128-gcm", "password": "l8FMqp0EGA0NnGbdsD3j8A==:Ej5FZ+ibEtOkVkJmFBdAAA=="}},
+	{Name: "Berlin", Host: "203.0.113.4", Port: 20004, UUID: "123e4567-e89b-12d3-a456-426614174000",
+		Params: map[string]string{"protocol": "vmess", "encryption": "auto"}},
+}
+
+func TestShareLinks(t *testing.T) {
+	feed, err := base64Feed(testLinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(string(feed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uris := strings.Split(string(data), "\n")
+	if len(uris) != len(testLinks) {
+		t.Fatalf("expected a link per node, got %q", uris)
+	}
+
+	vless, err := url.Parse(uris[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := vless.Query()
+	if vless.Scheme != "vless" || vless.User.Username() != testLinks[0].UUID || vless.Host != "203.0.113.1:20001" || vless.Fragment != "Tokyo" {
+		t.Errorf("expected the UUID and address of the user, got %s", uris[0])
+	}
+	if q.Get("security") != "reality" || q.Get("pbk") != testLinks[0].PubKey || q.Get("sni") != "www.microsoft.com" ||
+		q.Get("sid") != "6ba85179e30d4fc2" || q.Get("flow") != "xtls-rprx-vision" || q.Get("fp") != "chrome" {
+		t.Errorf("expected the REALITY parameters, got %s", uris[0])
+	}
+
+	trojan, err := url.Parse(uris[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trojan.Scheme != "trojan" || trojan.User.Username() != "secret" || trojan.Fragment != "Tokyo 2" || trojan.Query().Get("security") != "reality" {
+		t.Errorf("expected the Trojan password and REALITY, got %s", uris[1])
+	}
+
+	ss, err := url.Parse(uris[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, _ := ss.User.Password()
+	if ss.Scheme != "ss" || ss.User.Username() != "2022-blake3-aes-128-gcm" || password != testLinks[2].Params["password"] || ss.Host != "[2001:db8::1]:20003" {
+		t.Errorf("expected the method and password, got %s", uris[2])
+	}
+
+	vmess, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(uris[3], "vmess://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v map[string]string
+	if err := json.Unmarshal(vmess, &v); err != nil || v["id"] != testLinks[3].UUID || v["port"] != "20004" || v["ps"] != "Berlin" {
+		t.Errorf("expected the VMess link in the format of v2rayN, got %s", vmess)
+	}
+
+	if _, err := (shareLink{Params: map[string]string{"protocol": "socks"}}).URI(); err == nil {
+		t.Error("expected unknown protocols to be rejected")
+	}
+}
+
+func TestClashFeed(t *testing.T) {
+	feed, err := clashFeed(testLinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg struct {
+		Proxies     []map[string]any `yaml:"proxies"`
+		ProxyGroups []struct {
+			Proxies []string `yaml:"proxies"`
+		} `yaml:"proxy-groups"`
+	}
+	if err := yaml.Unmarshal(feed, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Proxies) != 4 || len(cfg.ProxyGroups) != 1 || len(cfg.ProxyGroups[0].Proxies) != 4 {
+		t.Fatalf("expected a proxy per node and a group selecting them, got\n%s", feed)
+	}
+	vless := cfg.Proxies[0]
+	reality, _ := vless["reality-opts"].(map[string]any)
+	if vless["type"] != "vless" || vless["port"] != 20001 || vless["servername"] != "www.microsoft.com" || reality["public-key"] != testLinks[0].PubKey {
+		t.Errorf("expected the VLESS proxy with REALITY, got %v", vless)
+	}
+	if ss := cfg.Proxies[2]; ss["type"] != "ss" || ss["cipher"] != "2022-blake3-aes-128-gcm" {
+		t.Errorf("expected the Shadowsocks proxy, got %v", ss)
+	}
+}
+
+func TestSingBoxFeed(t *testing.T) {
+	feed, err := singBoxFeed(testLinks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfg singBoxConfig
+	if err := json.Unmarshal(feed, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	// the selector, the nodes and direct
+	if len(cfg.Outbounds) != 6 || cfg.Outbounds[0].Type != "selector" || len(cfg.Outbounds[0].Outbounds) != 4 || cfg.Route.Final != "proxy" {
+		t.Fatalf("expected a selector of the nodes, got\n%s", feed)
+	}
+	trojan := cfg.Outbounds[2]
+	if trojan.Type != "trojan" || trojan.Password != "secret" || trojan.TLS == nil || !trojan.TLS.Reality.Enabled || trojan.TLS.Reality.PublicKey != testLinks[1].PubKey {
+		t.Errorf("expected the Trojan outbound with REALITY, got %+v", trojan)
+	}
+}
+
+func TestTrackConnection(t *testing.T) {
+	const uuid = "TestTrackConnection"
+	defer func() {
+		userConnectionMapMutex.Lock()
+		delete(userConnectionMap, uuid)
+		userConnectionMapMutex.Unlock()
+	}()
+
+	trackConnection(uuid, UserConnection{ServiceID: "a", NodeURL: "http://a", Subscription: true})
+	trackConnection(uuid, UserConnection{ServiceID: "b", NodeURL: "http://b"})
+	if evicted := trackConnection(uuid, UserConnection{ServiceID: "a", NodeURL: "http://a"}); len(evicted) != 0 {
+		t.Errorf("expected a connection to the same node to replace the old one, got %v evicted", evicted)
+	}
+	// connections of the subscription count against the limit too
+	if got := strings.Join(trackConnection(uuid, UserConnection{ServiceID: "c", NodeURL: "http://c"}), ","); got != "http://b" {
+		t.Errorf("expected the oldest connection to go, got %s", got)
+	}
+
+	var ids []string
+	userConnectionMapMutex.RLock()
+	for _, conn := range userConnectionMap[uuid] {
+		ids = append(ids, conn.ServiceID)
+		if conn.ServiceID == "a" && !conn.Subscription {
+			t.Error("expected a connection of the subscription to stay one")
+		}
+	}
+	userConnectionMapMutex.RUnlock()
+	if got := strings.Join(ids, ","); got != "a,c" {
+		t.Errorf("expected the connections a,c, got %s", got)
+	}
+
+	// connections tracked at once are all kept
+	if got := strings.Join(trackConnection(uuid, UserConnection{ServiceID: "d"}, UserConnection{ServiceID: "e"}), ","); got != "http://a,http://c" {
+		t.Errorf("expected the older connections to go, got %s", got)
+	}
+}
+
+func TestSubscriptionLinks(t *testing.T) {
+	user := db.User{UUID: "TestSubscriptionLinks", Email: "feed@example.com"}
+	defer func() {
+		userConnectionMapMutex.Lock()
+		delete(userConnectionMap, user.UUID)
+		userConnectionMapMutex.Unlock()
+	}()
+
+	var mutex sync.Mutex
+	var connected, disconnected []string
+	node := func(id string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			if r.URL.Path == "/disconnect" {
+				disconnected = append(disconnected, id)
+				return
+			}
+			connected = append(connected, id)
+			w.Write([]byte(`{"port":"20001"}`))
+		}))
+	}
+	var regs []registry.Registration
+	for i, id := range []string{"busy", "idle", "quiet"} {
+		srv := node(id)
+		defer srv.Close()
+		regs = append(regs, registry.Registration{ServiceID: id, ServiceURL: srv.URL, PublicIP: "203.0.113.1",
+			Info: &heartbeat.ServerInfo{CPUUsage: []float64{90, 0, 10}[i]}})
+	}
+	old := node("old")
+	defer old.Close()
+	trackConnection(user.UUID, UserConnection{ServiceID: "old", NodeURL: old.URL})
+
+	links := subscriptionLinks(context.Background(), regs, user, "198.51.100.1", "vless", RateMap["Free plan"])
+	if len(links) != MAX_CONNECTIONS_PER_USER {
+		t.Fatalf("expected %d links, got %+v", MAX_CONNECTIONS_PER_USER, links)
+	}
+	sort.Strings(connected)
+	if got := strings.Join(connected, ","); got != "idle,quiet" {
+		t.Errorf("expected the feed to connect to the least loaded nodes, got %s", got)
+	}
+	if got := strings.Join(disconnected, ","); got != "old" {
+		t.Errorf("expected the connection over the limit to be closed, got %s", got)
+	}
+}
+
+func TestDropSubscriptionConnections(t *testing.T) {
+	const uuid = "TestDropSubscriptionConnections"
+	defer func() {
+		userConnectionMapMutex.Lock()
+		delete(userConnectionMap, uuid)
+		userConnectionMapMutex.Unlock()
+	}()
+
+	trackConnection(uuid, UserConnection{ServiceID: "a", NodeURL: "http://a", Subscription: true})
+	trackConnection(uuid, UserConnection{ServiceID: "b", NodeURL: "http://b"})
+
+	if got := strings.Join(dropSubscriptionConnections(uuid), ","); got != "http://a" {
+		t.Errorf("expected the nodes of the subscription connections, got %s", got)
+	}
+	userConnectionMapMutex.RLock()
+	connections := userConnectionMap[uuid]
+	userConnectionMapMutex.RUnlock()
+	if len(connections) != 1 || connections[0].ServiceID != "b" {
+		t.Errorf("expected only the connection kept alive by heartbeats to stay, got %+v", connections)
+	}
+
+	trackConnection(uuid+"-feed", UserConnection{ServiceID: "a", Subscription: true})
+	dropSubscriptionConnections(uuid + "-feed")
+	userConnectionMapMutex.RLock()
+	_, ok := userConnectionMap[uuid+"-feed"]
+	userConnectionMapMutex.RUnlock()
+	if ok {
+		t.Error("expected a user left without connections to be forgotten")
+	}
+}
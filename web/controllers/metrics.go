@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// web_connected_users: users with at least one connection to a node in userConnectionMap.
+	connectedUsers = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "web_connected_users",
+		Help: "Users connected to a node.",
+	}, func() float64 {
+		userConnectionMapMutex.RLock()
+		defer userConnectionMapMutex.RUnlock()
+		return float64(len(userConnectionMap))
+	})
+
+	// web_user_connections: connections of users to nodes in userConnectionMap.
+	userConnections = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "web_user_connections",
+		Help: "Connections of users to nodes.",
+	}, func() float64 {
+		userConnectionMapMutex.RLock()
+		defer userConnectionMapMutex.RUnlock()
+		n := 0
+		for _, connections := range userConnectionMap {
+			n += len(connections)
+		}
+		return float64(n)
+	})
+)
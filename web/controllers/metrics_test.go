@@ -0,0 +1,27 @@
+package controllers
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConnectionMetrics(t *testing.T) {
+	const uuid = "TestConnectionMetrics"
+	defer func() {
+		userConnectionMapMutex.Lock()
+		delete(userConnectionMap, uuid)
+		userConnectionMapMutex.Unlock()
+	}()
+	users, connections := testutil.ToFloat64(connectedUsers), testutil.ToFloat64(userConnections)
+
+	// a connect records the connection of the user to the node
+	trackConnection(uuid, UserConnection{ServiceID: "a"})
+	trackConnection(uuid, UserConnection{ServiceID: "b"})
+	if got := testutil.ToFloat64(connectedUsers) - users; got != 1 {
+		t.Errorf("expected one more connected user, got %v", got)
+	}
+	if got := testutil.ToFloat64(userConnections) - connections; got != 2 {
+		t.Errorf("expected two more connections, got %v", got)
+	}
+}
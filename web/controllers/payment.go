@@ -3,9 +3,11 @@ package controllers
 import (
 	"encoding/json"
 	"fmt"
+	"go-distributed/log"
 	"go-distributed/registry"
 	"go-distributed/utils"
 	"go-distributed/web/db"
+	"log/slog"
 	"os"
 
 	"net/http"
@@ -15,6 +17,8 @@ import (
 	"gorm.io/gorm/clause"
 )
 
+var paymentPicker = registry.NewPicker(registry.PaymentService, registry.LeastOutstanding)
+
 func Payment(c *gin.Context) {
 	user, ok := c.Get("user")
 	if !ok {
@@ -51,20 +55,21 @@ func Payment(c *gin.Context) {
 		return
 	}
 
-	paymentService, err := registry.GetProviders(registry.PaymentService)
+	paymentService, done, err := paymentPicker.Pick("")
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to get payment service"})
 		return
 	}
 
-	addr := paymentService[0].ServiceURL
-	client := &http.Client{}
+	addr := paymentService.ServiceURL
+	client := registry.HTTPClient()
 	publicIP, err := utils.GetPublicIP()
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to get public IP"})
 		return
 	}
-	callbackURL := fmt.Sprintf("http://%s:%s/payment/callback", publicIP, os.Getenv("GIN_PORT"))
+	// the callback is served on the service port, see cmd/webservice
+	callbackURL := registry.ServiceURL(publicIP, os.Getenv("Web_Port")) + "/payment/callback"
 
 	reqURL := fmt.Sprintf("%s/api/payment/order/create?order_id=%s&amount=%d&callback=%s&method=%s&currency=%s",
 		addr,
@@ -75,15 +80,18 @@ func Payment(c *gin.Context) {
 		req.Currency,
 	)
 
-	request, err := http.NewRequest("POST", reqURL, nil)
+	request, err := http.NewRequestWithContext(c.Request.Context(), "POST", reqURL, nil)
 
 	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to create payment request"})
 		return
 	}
+	registry.Authorize(request)
 
 	resp, err := client.Do(request)
-	if err != nil || resp.StatusCode != 200 {
+	err = responseError(resp, err)
+	done(err)
+	if err != nil {
 		c.JSON(500, gin.H{"error": "Failed to process payment"})
 		return
 	}
@@ -109,7 +117,7 @@ func Payment(c *gin.Context) {
 			actualAmount = 0
 		}
 
-		fmt.Println("Payment created:", result)
+		slog.InfoContext(c.Request.Context(), "Payment created", log.Order(orderid), "trx_address", result["trx_address"], "actual_amount", actualAmount)
 		c.JSON(200, gin.H{"message": "Payment submitted", "order_id": orderid, "trx_address": result["trx_address"].(string), "actual_amount": actualAmount})
 		return
 	}
@@ -157,27 +165,26 @@ func Callback(c *gin.Context) {
 }
 
 func updatePaymentStatus(orderID string) error { // query payment service for orders that failed to callback
-	paymentService, err := registry.GetProviders(registry.PaymentService)
+	paymentService, done, err := paymentPicker.Pick("")
 	if err != nil {
 		return err
 	}
-	addr := paymentService[0].ServiceURL
-	client := &http.Client{}
-	request, err := http.NewRequest("POST", addr+"/api/payment/order/status?order_id="+orderID, nil)
+	addr := paymentService.ServiceURL
+	client := registry.HTTPClient()
+	request, err := http.NewRequest("GET", addr+"/api/payment/order/status?order_id="+url.QueryEscape(orderID), nil)
 	if err != nil {
+		done(nil)
 		return err
 	}
 
 	resp, err := client.Do(request)
+	err = responseError(resp, err)
+	done(err)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to update payment status: %w", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("failed to update payment status")
-	}
-
 	// Parse the response body as JSON and return the order info if needed
 	var result map[string]interface{}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
@@ -220,3 +227,16 @@ func ListPayments(c *gin.Context) {
 
 	c.JSON(200, gin.H{"payments": payments})
 }
+
+// responseError returns err, the error of a request to the payment service, or an error for a response
+// with a status other than 2xx, whose body it closes. The picker counts both as failures.
+func responseError(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return fmt.Errorf("payment service responded with %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"go-distributed/registry"
+	"go-distributed/web/db"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Nodes refers to the nodes offered to users: all nodes of the namespace, unless narrowed with a selector.
+var Nodes = registry.NodeService
+
+// nodeBandwidth is the throughput, in bytes per second, at which a node counts as fully loaded.
+var nodeBandwidth int64 = 1000 * 1000 * 1000 / 8 // 1 Gbps
+
+// usersPerNode is the number of connected users at which the user load of a node counts as half full.
+const usersPerNode = 20
+
+type rankedNode struct {
+	registry.Registration
+	Score float64 // lower is better
+}
+
+// nodeRegistrations returns the node services with their latest telemetry, falling back to the
+// cached list when the registry cannot be reached.
+func nodeRegistrations() ([]registry.Registration, error) {
+	regs, err := registry.FetchProviders(Nodes)
+	if err != nil {
+		return registry.GetProviders(Nodes)
+	}
+	return regs, nil
+}
+
+// rankNodes orders the nodes offering all of tags from the least to the most loaded for a user of plan.
+// Draining and unhealthy nodes are left out.
+func rankNodes(regs []registry.Registration, plan string, tags []string) []rankedNode {
+	users := usersByNode()
+
+	var ranked []rankedNode
+	for _, reg := range regs {
+		if !reg.Available() || !hasTags(reg, tags) {
+			continue
+		}
+		ranked = append(ranked, rankedNode{Registration: reg, Score: nodeScore(reg, plan, users[reg.ServiceID])})
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Score < ranked[j].Score
+	})
+	return ranked
+}
+
+// nodeScore adds up the load of a node, each part between 0 and 1. Nodes that have not reported
+// telemetry yet rank behind idle nodes but ahead of busy ones.
+func nodeScore(reg registry.Registration, plan string, users int) float64 {
+	score := float64(users) / float64(users+usersPerNode)
+
+	info := reg.Info
+	if info == nil {
+		return score + 1
+	}
+	score += info.CPUUsage/100 + info.MemoryUsage/200
+
+	// paying users are sensitive to the bandwidth left on a node, so its throughput weighs more for them
+	weight := float64(RateMap[plan]) / float64(RateMap["Premium plan"])
+	if weight < 0.25 {
+		weight = 0.25
+	}
+	score += weight * float64(info.Throughput) / float64(info.Throughput+nodeBandwidth)
+
+	return score
+}
+
+// usersByNode counts the connections of the users on each node, by ServiceID.
+func usersByNode() map[string]int {
+	userConnectionMapMutex.RLock()
+	defer userConnectionMapMutex.RUnlock()
+
+	users := make(map[string]int)
+	for _, conns := range userConnectionMap {
+		for _, conn := range conns {
+			users[conn.ServiceID]++
+		}
+	}
+	return users
+}
+
+func hasTags(reg registry.Registration, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range reg.Tags {
+			if strings.EqualFold(t, tag) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// planOf returns the plan of user, which is the free plan when not set.
+func planOf(user db.User) string {
+	if user.Plan == "" {
+		return "Free plan"
+	}
+	return user.Plan
+}
+
+// requestedTags reads the tags a client asks for, given as ?tags=Netflix,ChatGPT or repeated tags parameters.
+func requestedTags(c *gin.Context) []string {
+	var tags []string
+	for _, v := range c.QueryArray("tags") {
+		for _, tag := range strings.Split(v, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags
+}
+
+func RecommendedServers(c *gin.Context) {
+	user, ok := c.Get("user")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Failed to get user ID",
+		})
+		return
+	}
+	plan := planOf(user.(db.User))
+
+	regs, err := nodeRegistrations()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch servers",
+		})
+		return
+	}
+
+	servers := []Server{}
+	for _, node := range rankNodes(regs, plan, requestedTags(c)) {
+		servers = append(servers, Server{
+			IP:          node.PublicIP,
+			IPV6:        node.PublicIPv6,
+			ServiceID:   node.ServiceID,
+			Description: node.Description,
+			Tags:        node.Tags,
+			Load:        node.Info,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"servers": servers,
+	})
+}
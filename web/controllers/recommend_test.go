@@ -0,0 +1,98 @@
+package controllers
+
+import (
+	"go-distributed/registry"
+	"go-distributed/registry/heartbeat"
+	"strings"
+	"testing"
+)
+
+func TestRankNodes(t *testing.T) {
+	node := func(id string, info *heartbeat.ServerInfo, tags ...string) registry.Registration {
+		return registry.Registration{ServiceName: registry.NodeService, ServiceID: id, Info: info, Tags: tags}
+	}
+	cpu := func(usage float64) *heartbeat.ServerInfo { return &heartbeat.ServerInfo{CPUUsage: usage} }
+	// half the bandwidth of a node in use, and a node using none but busier
+	busyLink := &heartbeat.ServerInfo{Throughput: nodeBandwidth / 2}
+	busyCPU := &heartbeat.ServerInfo{CPUUsage: 20}
+
+	for _, test := range []struct {
+		name  string
+		regs  []registry.Registration
+		plan  string
+		tags  []string
+		users map[string]int // connections on each node, by ServiceID
+		want  string
+	}{
+		{
+			name: "less loaded first",
+			regs: []registry.Registration{node("a", cpu(80)), node("b", cpu(10)), node("c", cpu(40))},
+			want: "b,c,a",
+		},
+		{
+			name: "nodes without telemetry behind idle ones",
+			regs: []registry.Registration{node("a", nil), node("b", cpu(0)), node("c", cpu(100))},
+			want: "b,a,c",
+		},
+		{
+			name:  "connected users count",
+			regs:  []registry.Registration{node("a", cpu(10)), node("b", cpu(10))},
+			users: map[string]int{"a": 20},
+			want:  "b,a",
+		},
+		{
+			name: "throughput weighs little for free users",
+			regs: []registry.Registration{node("a", busyCPU), node("b", busyLink)},
+			plan: "Free plan",
+			want: "b,a",
+		},
+		{
+			name: "throughput weighs more for paying users",
+			regs: []registry.Registration{node("a", busyCPU), node("b", busyLink)},
+			plan: "Premium plan",
+			want: "a,b",
+		},
+		{
+			name: "nodes with every requested tag",
+			regs: []registry.Registration{node("a", cpu(0), "Netflix"), node("b", cpu(50), "netflix", "ChatGPT"), node("c", cpu(10), "ChatGPT")},
+			tags: []string{"NETFLIX", "chatgpt"},
+			want: "b",
+		},
+		{
+			name: "draining and unhealthy nodes left out",
+			regs: []registry.Registration{
+				{ServiceID: "a", Draining: true},
+				{ServiceID: "b", Health: registry.Unhealthy},
+				{ServiceID: "c", Health: registry.Healthy},
+			},
+			want: "c",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			userConnectionMapMutex.Lock()
+			for serviceID, n := range test.users {
+				for range n {
+					userConnectionMap["TestRankNodes"] = append(userConnectionMap["TestRankNodes"], UserConnection{ServiceID: serviceID})
+				}
+			}
+			userConnectionMapMutex.Unlock()
+			defer func() {
+				userConnectionMapMutex.Lock()
+				delete(userConnectionMap, "TestRankNodes")
+				userConnectionMapMutex.Unlock()
+			}()
+
+			plan := test.plan
+			if plan == "" {
+				plan = "Free plan"
+			}
+			var ids []string
+			for _, ranked := range rankNodes(test.regs, plan, test.tags) {
+				ids = append(ids, ranked.ServiceID)
+			}
+			if got := strings.Join(ids, ","); got != test.want {
+				t.Errorf("expected %s, got %s", test.want, got)
+			}
+		})
+	}
+}
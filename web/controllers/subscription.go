@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"go-distributed/log"
+	"go-distributed/registry"
+	"go-distributed/web/db"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// SUBSCRIPTION_UPDATE_INTERVAL is how often clients are asked to fetch the subscription feed again, well
+// within SUBSCRIPTION_TIMEOUT so the connections it made stay open.
+const SUBSCRIPTION_UPDATE_INTERVAL = 12 * time.Hour
+
+// feedFormats are the formats the subscription feed is served in, chosen with ?format=.
+var feedFormats = map[string]struct {
+	contentType string
+	render      func([]shareLink) ([]byte, error)
+}{
+	"base64":  {"text/plain; charset=utf-8", base64Feed},
+	"clash":   {"text/yaml; charset=utf-8", clashFeed},
+	"singbox": {"application/json; charset=utf-8", singBoxFeed},
+}
+
+// SubscriptionToken issues the user a new subscription token, which revokes the old one and closes the
+// connections its feed made, and returns the path of the feed it opens.
+func SubscriptionToken(c *gin.Context) {
+	user, ok := c.Get("user")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Failed to get user ID",
+		})
+		return
+	}
+	userinfo := user.(db.User)
+
+	token := uuid.New().String()
+	if err := db.DB.Model(&userinfo).Update("subscription_token", token).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to create subscription token",
+		})
+		return
+	}
+	disconnect(userinfo.UUID, dropSubscriptionConnections(userinfo.UUID))
+
+	slog.Info("Issued subscription token", log.User(userinfo.UUID))
+	c.JSON(http.StatusOK, gin.H{
+		"token": token,
+		"url":   "/subscription/" + token,
+	})
+}
+
+// RevokeSubscription revokes the subscription token of the user and closes the connections the feed
+// made, so the links it served stop working at once.
+func RevokeSubscription(c *gin.Context) {
+	user, ok := c.Get("user")
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Failed to get user ID",
+		})
+		return
+	}
+	userinfo := user.(db.User)
+
+	if err := db.DB.Model(&userinfo).Update("subscription_token", "").Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to revoke subscription token",
+		})
+		return
+	}
+
+	disconnect(userinfo.UUID, dropSubscriptionConnections(userinfo.UUID))
+
+	slog.Info("Revoked subscription token", log.User(userinfo.UUID))
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// dropSubscriptionConnections forgets the connections of the user with uuid that the subscription feed
+// keeps alive and returns the URLs of their nodes.
+func dropSubscriptionConnections(uuid string) []string {
+	userConnectionMapMutex.Lock()
+	defer userConnectionMapMutex.Unlock()
+
+	var kept []UserConnection
+	var nodeURLs []string
+	for _, conn := range userConnectionMap[uuid] {
+		if conn.Subscription {
+			nodeURLs = append(nodeURLs, conn.NodeURL)
+		} else {
+			kept = append(kept, conn)
+		}
+	}
+	if len(kept) == 0 {
+		delete(userConnectionMap, uuid)
+	} else {
+		userConnectionMap[uuid] = kept
+	}
+	return nodeURLs
+}
+
+// Subscription serves the subscription feed of the token in the path, e.g.
+// GET /subscription/<token>?format=clash&protocol=trojan. Nodes only forward connections from the address
+// a user connected from, so fetching the feed connects the user to the least loaded nodes offering the
+// protocol from the address fetching it, as many as a user may be connected to, and the feed links to
+// these connections.
+func Subscription(c *gin.Context) {
+	format, ok := feedFormats[c.DefaultQuery("format", "base64")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "Unsupported format, expected base64, clash or singbox",
+		})
+		return
+	}
+	protocol := c.DefaultQuery("protocol", "vless")
+
+	token := c.Param("token")
+	var user db.User
+	if token == "" || db.DB.Where("subscription_token = ?", token).First(&user).Error != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": "Subscription not found",
+		})
+		return
+	}
+
+	if user.PlanEnd.Before(time.Now()) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "Your plan has expired. Please renew your plan to continue using the service.",
+		})
+		return
+	}
+	if user.TrafficUsed >= user.TrafficLimit && user.TrafficLimit != -1 {
+		c.JSON(http.StatusForbidden, gin.H{
+			"error": "You have reached your traffic limit",
+		})
+		return
+	}
+
+	rate := RateMap[planOf(user)]
+	if rate == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Invalid plan or rate limit not set for the plan",
+		})
+		return
+	}
+
+	regs, err := nodeRegistrations()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to fetch servers",
+		})
+		return
+	}
+
+	links := subscriptionLinks(c.Request.Context(), regs, user, c.ClientIP(), protocol, rate)
+	body, err := format.render(links)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to render subscription: " + err.Error(),
+		})
+		return
+	}
+
+	// the headers clients show the traffic and plan of a subscription from, and refresh it by
+	total := max(user.TrafficLimit, 0)
+	c.Header("Subscription-Userinfo", fmt.Sprintf("upload=0; download=%d; total=%d; expire=%d", user.TrafficUsed, total, user.PlanEnd.Unix()))
+	c.Header("Profile-Update-Interval", strconv.Itoa(int(SUBSCRIPTION_UPDATE_INTERVAL/time.Hour)))
+	c.Data(http.StatusOK, format.contentType, body)
+}
+
+// subscriptionLinks connects user from clientIP to the least loaded available nodes offering protocol,
+// as many as MAX_CONNECTIONS_PER_USER, and returns the share links of the connections, in the order of
+// regs. Nodes that refuse are left out.
+func subscriptionLinks(ctx context.Context, regs []registry.Registration, user db.User, clientIP, protocol string, rate int) []shareLink {
+	var offering []registry.Registration
+	for _, reg := range regs {
+		if offersProtocol(reg, protocol) {
+			offering = append(offering, reg)
+		}
+	}
+	chosen := make(map[string]bool)
+	for _, ranked := range rankNodes(offering, planOf(user), nil) {
+		if len(chosen) == MAX_CONNECTIONS_PER_USER {
+			break
+		}
+		chosen[ranked.ServiceID] = true
+	}
+
+	results := make([]*shareLink, len(regs))
+	conns := make([]*UserConnection, len(regs))
+	var wg sync.WaitGroup
+	for i, reg := range regs {
+		if !chosen[reg.ServiceID] {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, reg registry.Registration) {
+			defer wg.Done()
+			params, _, err := connectNode(ctx, reg, user.UUID, user.Email, clientIP, protocol, rate)
+			if err != nil {
+				slog.WarnContext(ctx, "Failed to connect subscription to node", log.User(user.UUID), "node", reg.ServiceID, "error", err)
+				return
+			}
+			port, err := strconv.Atoi(params["port"])
+			if err != nil {
+				slog.WarnContext(ctx, "Node answered with an invalid port", "node", reg.ServiceID, "port", params["port"])
+				return
+			}
+
+			conns[i] = &UserConnection{
+				NodeIP:        reg.PublicIP,
+				NodeURL:       reg.ServiceURL,
+				ServiceID:     reg.ServiceID,
+				NodePort:      params["port"],
+				ClientIP:      clientIP,
+				LastHeartBeat: time.Now(),
+				Subscription:  true,
+			}
+			pubkey := params["pubkey"]
+			if pubkey == "" {
+				pubkey = realityPublicKey(reg)
+			}
+			results[i] = &shareLink{
+				Host:   reg.PublicIP,
+				Port:   port,
+				UUID:   user.UUID,
+				PubKey: pubkey,
+				Params: params,
+			}
+		}(i, reg)
+	}
+	wg.Wait()
+
+	// the connections are tracked at once, so none of them pushes another one out
+	var connected []UserConnection
+	for _, conn := range conns {
+		if conn != nil {
+			connected = append(connected, *conn)
+		}
+	}
+	disconnect(user.UUID, trackConnection(user.UUID, connected...))
+
+	// clients tell the nodes apart by name
+	var links []shareLink
+	names := map[string]int{}
+	for i, link := range results {
+		if link == nil {
+			continue
+		}
+		name := regs[i].Description
+		if name == "" {
+			name = regs[i].PublicIP
+		}
+		if names[name]++; names[name] > 1 {
+			name += " " + strconv.Itoa(names[name])
+		}
+		link.Name = name
+		links = append(links, *link)
+	}
+	return links
+}
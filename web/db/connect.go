@@ -2,6 +2,7 @@ package db
 
 import (
 	"fmt"
+	"log/slog"
 	"os"
 
 	"gorm.io/driver/mysql"
@@ -14,7 +15,6 @@ func Connect() {
 	var err error
 
 	baseDSN := os.Getenv("DB") + "/"
-	fmt.Println("Initial DSN:", baseDSN)
 
 	tempDB, err := gorm.Open(mysql.Open(baseDSN), &gorm.Config{})
 	if err != nil {
@@ -30,7 +30,7 @@ func Connect() {
 	sqlDB.Close()
 
 	dsnWithDB := baseDSN + "vpn?charset=utf8mb4&parseTime=True&loc=Local"
-	fmt.Println("Connecting to:", dsnWithDB)
+	slog.Info("Connecting to database", "database", "vpn")
 
 	DB, err = gorm.Open(mysql.Open(dsnWithDB), &gorm.Config{})
 	if err != nil {
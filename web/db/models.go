@@ -28,6 +28,9 @@ type User struct {
 	IsVerified  bool
 	VerifyToken string
 	TokenExpiry time.Time
+
+	// the subscription feed, fetched without logging in; empty when revoked
+	SubscriptionToken string `gorm:"type:varchar(191);index"`
 }
 
 type Voucher struct {
@@ -0,0 +1,31 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// web_request_duration_seconds{route, method, status}: latency of the web API, by the route
+// pattern, e.g. /payment/status/:order_id, the HTTP method and the status code. Requests matching
+// no route have the route "unmatched".
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "web_request_duration_seconds",
+	Help:    "Latency of the web API requests.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"route", "method", "status"})
+
+// Metrics records the latency of each request.
+func Metrics(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	requestDuration.WithLabelValues(route, c.Request.Method, strconv.Itoa(c.Writer.Status())).Observe(time.Since(start).Seconds())
+}
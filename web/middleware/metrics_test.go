@@ -0,0 +1,26 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(Metrics)
+	r.GET("/payment/status/:order_id", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for _, path := range []string{"/payment/status/1", "/payment/status/2", "/missing"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	// requests are recorded by route pattern, not by path
+	if n := testutil.CollectAndCount(requestDuration, "web_request_duration_seconds"); n != 2 {
+		t.Errorf("expected a series for the route and one for unmatched requests, got %d", n)
+	}
+}
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"fmt"
+	"go-distributed/registry"
 	"go-distributed/web/db"
 	"net/http"
 	"os"
@@ -61,3 +62,14 @@ func AdminAuth(c *gin.Context) {
 	}
 	c.Next()
 }
+
+// RequireService only lets requests through that carry the registry-issued token of one of services.
+func RequireService(services ...registry.ServiceName) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, err := registry.Verify(c.Request, services...); err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
+		c.Next()
+	}
+}